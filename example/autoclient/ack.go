@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+
+	"unixsocket/pkg/gnetrw"
+)
+
+// DefaultMaxAttempts is how many times a message is written before it is dropped
+// unacknowledged, the server closing the connection on it every time.
+const DefaultMaxAttempts = 5
+
+var ErrTooManyUnacked = errors.New("too many unacknowledged messages")
+
+// pendingMessage is a numbered message waiting for its acknowledgement.
+type pendingMessage struct {
+	seq      uint64
+	f        *gnetrw.Frame
+	sent     uint64 // generation of the connection it was last tried on, 0 while queued
+	attempts int    // times it was written
+}
+
+// WithAckedDelivery numbers the messages of Write and WriteMessage and keeps them until
+// the server acknowledges them, see gnetrw.WithAckedDelivery. Those unacknowledged when
+// the connection is lost are sent again after reconnecting, the server skips the ones it
+// already handled. Writing fails with ErrTooManyUnacked while maxUnacked messages wait.
+// It needs WithHello, whose ClientID is generated when empty, the ID of the outbox with
+// WithOutbox. Messages are numbered from 1 in a new Hello.Epoch per Client, or by their
+// id in the outbox, so the numbers keep growing across restarts. A server without
+// acknowledgements gets each message once.
+func WithAckedDelivery(maxUnacked int) Option {
+	return func(c *Client) { c.maxUnacked = maxUnacked }
+}
+
+func newClientID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// queueAcked numbers f with seq and queues it, 0 takes the number after the last one.
+// The number is given under ackMu so that the queue is in order.
+func (c *Client) queueAcked(f *gnetrw.Frame, seq uint64) error {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+	if len(c.pending) >= c.maxUnacked {
+		return ErrTooManyUnacked
+	}
+	if seq == 0 {
+		seq = c.seq + 1
+	}
+	if f.Header == nil {
+		f.Header = gnetrw.Header{}
+	}
+	f.Header.Set(gnetrw.HeaderSeq, strconv.FormatUint(seq, 10))
+	select {
+	case c.writeChan <- f:
+	default:
+		return ErrWriteQueueFull
+	}
+	c.seq = seq
+	c.pending = append(c.pending, &pendingMessage{seq: seq, f: f})
+	c.metrics.Unacked.Set(int64(len(c.pending)))
+	return nil
+}
+
+// markSent records that writing f on connection gen was tried, it runs on the write
+// loop. A message not written is sent again on the next connection, a written one is
+// forgotten without acknowledgements from the server.
+func (c *Client) markSent(f *gnetrw.Frame, gen uint64, written bool) {
+	seq, _ := strconv.ParseUint(f.Header.Get(gnetrw.HeaderSeq), 10, 64)
+	if seq == 0 {
+		return
+	}
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+	i := c.pendingIndex(seq)
+	if i < 0 {
+		return
+	}
+	if !written {
+		c.pending[i].sent = gen
+		return
+	}
+	if !c.ackOK {
+		delete(f.Header, gnetrw.HeaderSeq)
+		c.removePending(i, i+1)
+		return
+	}
+	c.pending[i].sent = gen
+	c.pending[i].attempts++
+}
+
+// forget drops f for good, numbered or in the outbox, it runs on the write loop.
+func (c *Client) forget(f *gnetrw.Frame) {
+	seq, _ := strconv.ParseUint(f.Header.Get(gnetrw.HeaderSeq), 10, 64)
+	if seq != 0 {
+		c.ackMu.Lock()
+		defer c.ackMu.Unlock()
+		if i := c.pendingIndex(seq); i >= 0 {
+			c.removePending(i, i+1)
+			return
+		}
+	}
+	c.delivered(f)
+}
+
+// unacked returns the messages written on a previous connection and not acknowledged,
+// in order, to send again on connection gen. It runs when the write loop starts.
+func (c *Client) unacked(gen uint64) []*gnetrw.Frame {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+	var frames []*gnetrw.Frame
+	keep := c.pending[:0]
+	for _, p := range c.pending {
+		switch {
+		case p.sent == 0 || p.sent == gen:
+			// still in the write queue
+		case !c.ackOK && p.attempts > 0:
+			c.logger.Warn("drop unacknowledged message, server does not acknowledge", gnetrw.HeaderSeq, p.seq)
+			c.delivered(p.f)
+			continue
+		case p.attempts >= DefaultMaxAttempts:
+			c.logger.Warn("drop unacknowledged message", gnetrw.HeaderSeq, p.seq, "attempts", p.attempts)
+			c.delivered(p.f)
+			continue
+		default:
+			frames = append(frames, p.f)
+		}
+		keep = append(keep, p)
+	}
+	clear(c.pending[len(keep):])
+	c.pending = keep
+	c.metrics.Unacked.Set(int64(len(c.pending)))
+	c.metrics.Retransmits.Add(int64(len(frames)))
+	c.ackSignal()
+	return frames
+}
+
+// acked forgets the messages up to seq, it runs on the read loop.
+func (c *Client) acked(seq uint64) {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+	n := sort.Search(len(c.pending), func(i int) bool { return c.pending[i].seq > seq })
+	c.removePending(0, n)
+}
+
+// removePending must be called with ackMu held.
+func (c *Client) removePending(i, j int) {
+	if i == j {
+		return
+	}
+	for _, p := range c.pending[i:j] {
+		c.delivered(p.f)
+	}
+	n := copy(c.pending[i:], c.pending[j:])
+	clear(c.pending[i+n:])
+	c.pending = c.pending[:i+n]
+	c.metrics.Unacked.Set(int64(len(c.pending)))
+	c.ackSignal()
+}
+
+// pendingIndex must be called with ackMu held.
+func (c *Client) pendingIndex(seq uint64) int {
+	i := sort.Search(len(c.pending), func(i int) bool { return c.pending[i].seq >= seq })
+	if i < len(c.pending) && c.pending[i].seq == seq {
+		return i
+	}
+	return -1
+}
+
+// ackSignal wakes WaitAcked, it must be called with ackMu held.
+func (c *Client) ackSignal() {
+	if c.ackChanged != nil {
+		close(c.ackChanged)
+		c.ackChanged = nil
+	}
+}
+
+// Unacked returns the number of messages waiting for an acknowledgement.
+func (c *Client) Unacked() int {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+	return len(c.pending)
+}
+
+// WaitAcked waits until every message written so far is acknowledged or dropped.
+func (c *Client) WaitAcked(ctx context.Context) error {
+	for {
+		c.ackMu.Lock()
+		if len(c.pending) == 0 {
+			c.ackMu.Unlock()
+			return nil
+		}
+		if c.ackChanged == nil {
+			c.ackChanged = make(chan struct{})
+		}
+		changed := c.ackChanged
+		c.ackMu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.quit:
+			return ErrClientClosed
+		}
+	}
+}
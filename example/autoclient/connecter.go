@@ -2,188 +2,794 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"golang.org/x/exp/rand"
+	"unixsocket/pkg/gnetrw"
+	"unixsocket/pkg/metrics"
+	"unixsocket/pkg/outbox"
+	"unixsocket/pkg/reconnect"
 )
 
 type Client struct {
 	mu        sync.Mutex
 	writer    io.Writer
+	onMessage func(f *gnetrw.Frame)
 	conn      net.Conn
-	writeChan chan []byte
+	writeChan chan *gnetrw.Frame
+	muxChan   chan muxFrame
+	quit      chan struct{} // closed by Close
 	closed    atomic.Int32
+	gen       atomic.Uint64 // incremented on every connection
+	streamID  atomic.Uint64
+
+	backoff reconnect.BackoffPolicy
+	clock   reconnect.Clock
+	state   *reconnect.Monitor
+
+	waitWrite   bool
+	waitTimeout time.Duration
+
+	hello     *gnetrw.Hello
+	framed    bool        // gnetrw frames on the wire, raw bytes otherwise
+	headers   atomic.Bool // the server negotiated gnetrw.HeaderVersion
+	compress  []gnetrw.Compression
+	threshold int
+	// compressor is set by handshake before writeLoop starts
+	compressor gnetrw.Compressor
+	logger     gnetrw.Logger
+	metrics    *gnetrw.ClientMetrics
+
+	tracer     gnetrw.Tracer
+	propagator gnetrw.Propagator
+
+	muxConfig *gnetrw.MuxConfig
+	muxOK     bool            // the server negotiated gnetrw.CapabilityMux, set by handshake
+	session   *gnetrw.Session // of the current connection, guarded by mu
+
+	flow        bool
+	creditOK    bool         // the server negotiated gnetrw.CapabilityCredit, set by handshake
+	credit      atomic.Int64 // bytes the server granted and were not sent yet
+	creditReady chan struct{}
+
+	maxUnacked int
+	ackOK      bool // the server negotiated gnetrw.CapabilityAck, set by handshake
+	ackMu      sync.Mutex
+	seq        uint64            // last message number given
+	pending    []*pendingMessage // by number
+	ackChanged chan struct{}     // closed when pending changes, see WaitAcked
+
+	outbox      *outbox.Outbox
+	outboxMu    sync.Mutex
+	outboxIDs   map[*gnetrw.Frame]uint64 // of the records in the write queue
+	outboxQueue []*outboxRecord          // by id, not committed yet
+	outboxRetry *gnetrw.Frame            // failed to write, sent first on the next connection
+}
+
+// muxFrame is a logical stream frame of the connection gen, dropped on the later ones.
+type muxFrame struct {
+	gen uint64
+	f   *gnetrw.Frame
+}
+
+var (
+	ErrClientClosed      = errors.New("client closed")
+	ErrWriteQueueFull    = errors.New("write channel is full")
+	ErrStreamInterrupted = errors.New("connection lost during stream")
+	ErrNotConnected      = errors.New("not connected")
+	// ErrUnsendable wraps why a queued frame cannot be compressed or packed, it is
+	// dropped rather than written again on every connection.
+	ErrUnsendable = errors.New("frame cannot be sent")
+)
+
+// handshakeTimeout bounds the wait for the server's welcome.
+const handshakeTimeout = 5 * time.Second
+
+type Option func(c *Client)
+
+// WithBackoff sets the policy used between connection attempts.
+func WithBackoff(p reconnect.BackoffPolicy) Option {
+	return func(c *Client) { c.backoff = p }
+}
+
+// WithClock replaces the clock used to wait between connection attempts.
+func WithClock(clock reconnect.Clock) Option {
+	return func(c *Client) { c.clock = clock }
+}
+
+// WithWriteWait makes Write wait for the connection to be open instead of queueing
+// while disconnected. A timeout of 0 waits until the client is closed.
+func WithWriteWait(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.waitWrite = true
+		c.waitTimeout = timeout
+	}
+}
+
+// WithHello makes the client run the handshake with hello on every connection
+// before any message is sent. Messages are then gnetrw frames, without WithHello or
+// WithMessageHandler the client writes and reads raw bytes, as example/server and
+// example/echoserver do.
+func WithHello(hello gnetrw.Hello) Option {
+	return func(c *Client) { c.hello = &hello }
+}
+
+// WithLogger sets the client logger, gnetrw.DefaultLogger is used otherwise.
+func WithLogger(l gnetrw.Logger) Option {
+	return func(c *Client) { c.logger = l }
+}
+
+// WithMetrics reports the client measurements to m, see gnetrw.ClientMetrics.
+func WithMetrics(m metrics.Metrics) Option {
+	return func(c *Client) { c.metrics = gnetrw.NewClientMetrics(m, "unixsocket_autoclient") }
 }
 
-func NewClient() *Client {
+// WithTracing starts a span with t around every write and, once the server
+// negotiated frame headers, sends the trace context p injects with the message.
+// nil p uses gnetrw.TraceContext.
+func WithTracing(t gnetrw.Tracer, p gnetrw.Propagator) Option {
+	return func(c *Client) {
+		c.tracer = t
+		c.propagator = p
+	}
+}
+
+// WithCompression announces algs, in order of preference, in the hello. Once the server
+// agrees, payloads of at least threshold bytes are compressed, 0 uses gnetrw.DefaultCompressThreshold.
+// It needs WithHello.
+func WithCompression(threshold int, algs ...gnetrw.Compression) Option {
+	return func(c *Client) {
+		c.compress = algs
+		c.threshold = threshold
+	}
+}
+
+// WithMessageHandler hands every frame received from the server to fn, header
+// included, instead of writing its payload to the writer given to Connect.
+// f is only valid until fn returns. The client speaks gnetrw frames even without WithHello.
+func WithMessageHandler(fn func(f *gnetrw.Frame)) Option {
+	return func(c *Client) { c.onMessage = fn }
+}
+
+// WithMux announces gnetrw.CapabilityMux in the hello so that logical streams can be
+// opened once the server agrees, see OpenStream. It needs WithHello.
+func WithMux(cfg gnetrw.MuxConfig) Option {
+	return func(c *Client) { c.muxConfig = &cfg }
+}
+
+// WithFlowControl announces gnetrw.CapabilityCredit in the hello. Once the server agrees,
+// frames are only written while it granted credit, the others wait in the write queue,
+// so Write fails with ErrWriteQueueFull and SendFrame blocks when the server falls behind.
+// It needs WithHello.
+func WithFlowControl() Option {
+	return func(c *Client) { c.flow = true }
+}
+
+func NewClient(opts ...Option) *Client {
 	cli := Client{
-		writeChan: make(chan []byte, 100),
+		writeChan:   make(chan *gnetrw.Frame, 100),
+		muxChan:     make(chan muxFrame, 100),
+		creditReady: make(chan struct{}, 1),
+		quit:        make(chan struct{}),
+		backoff:     reconnect.DefaultBackoff(),
+		clock:       reconnect.SystemClock,
+		logger:      gnetrw.DefaultLogger(),
+		tracer:      gnetrw.NopTracer,
+	}
+	for _, opt := range opts {
+		opt(&cli)
+	}
+	if cli.propagator == nil {
+		cli.propagator = gnetrw.TraceContext{}
+	}
+	if cli.metrics == nil {
+		cli.metrics = gnetrw.NewClientMetrics(metrics.Nop, "")
+	}
+	cli.framed = cli.hello != nil || cli.onMessage != nil
+	if cli.hello != nil && len(cli.compress) > 0 {
+		cli.hello.Capabilities = append(slices.Clip(cli.hello.Capabilities), gnetrw.CompressionCapabilities(cli.compress...)...)
+	}
+	if cli.hello != nil && cli.flow {
+		cli.hello.Capabilities = append(slices.Clip(cli.hello.Capabilities), gnetrw.CapabilityCredit)
+	}
+	if cli.hello != nil && cli.maxUnacked > 0 {
+		cli.hello.Capabilities = append(slices.Clip(cli.hello.Capabilities), gnetrw.CapabilityAck)
+		switch {
+		case cli.outbox != nil:
+			// the numbers are the ids of the records, see queueOutbox
+			if cli.hello.ClientID == "" {
+				cli.hello.ClientID = cli.outbox.ID()
+			}
+			cli.hello.Epoch = cli.outbox.ID()
+		case cli.hello.ClientID == "":
+			cli.hello.ClientID = newClientID()
+			fallthrough
+		default:
+			cli.hello.Epoch = newClientID()
+		}
+	}
+	if cli.hello != nil && cli.muxConfig != nil {
+		cli.hello.Capabilities = append(slices.Clip(cli.hello.Capabilities), gnetrw.CapabilityMux)
+	}
+	cli.state = reconnect.NewMonitor(cli.clock)
+	if cli.outbox != nil {
+		go cli.pump()
 	}
 	return &cli
 }
 
+// State returns the current connection state.
+func (c *Client) State() reconnect.State {
+	return c.state.State()
+}
+
+// Subscribe calls fn on every connection state transition. fn must not block.
+func (c *Client) Subscribe(fn func(reconnect.Transition)) (cancel func()) {
+	return c.state.Subscribe(fn)
+}
+
+// Watch delivers connection state transitions on a channel.
+func (c *Client) Watch(size int) (<-chan reconnect.Transition, func()) {
+	return c.state.Watch(size)
+}
+
+// WaitReady blocks until the connection is open, ctx ends or the client stops reconnecting.
+func (c *Client) WaitReady(ctx context.Context) error {
+	return c.state.WaitReady(ctx)
+}
+
 func (c *Client) Connect(ctx context.Context, addr string, w io.Writer) error {
-	defer func() { log.Print("client connect closed") }()
+	defer func() { c.logger.Debug("client connect closed", gnetrw.KeyAddr, addr) }()
 	c.writer = w
+	// handshakes failed in a row, the backoff is only reset once one succeeds
+	failures := 0
 
 	for {
 		if c.closed.Load() == 1 {
-			return errors.New("client closed")
+			return ErrClientClosed
 		}
 
-		conn, err := c.autoConnect(ctx, addr)
+		conn, attempt, err := c.autoConnect(ctx, addr)
 		if err != nil {
-			if ctx.Err() != nil {
-				return ctx.Err()
+			c.state.Set(reconnect.StateClosed, attempt, err)
+			c.state.Stop(err)
+			c.logger.Error("reconnect failed", gnetrw.KeyAddr, addr, gnetrw.KeyErr, err)
+			return err
+		}
+
+		if err = c.handshake(conn); err != nil {
+			conn.Close()
+			c.state.Set(reconnect.StateClosed, attempt, err)
+			if errors.Is(err, gnetrw.ErrHandshakeRejected) && !errors.Is(err, gnetrw.ErrRetryLater) {
+				c.state.Stop(err)
+				c.logger.Error("handshake rejected", gnetrw.KeyAddr, addr, gnetrw.KeyErr, err)
+				return err
+			}
+			failures++
+			delay, ok := c.backoff.Next(failures)
+			if !ok {
+				err = fmt.Errorf("%w after %d handshakes: %v", reconnect.ErrAttemptsExhausted, failures, err)
+				c.state.Stop(err)
+				c.logger.Error("handshake failed, giving up", gnetrw.KeyAddr, addr, gnetrw.KeyErr, err)
+				return err
+			}
+			c.logger.Warn("handshake failed", gnetrw.KeyAddr, addr, "attempt", failures, "retry", delay, gnetrw.KeyErr, err)
+			if err := reconnect.Sleep(ctx, c.clock, delay); err != nil {
+				c.state.Stop(err)
+				return err
 			}
-			log.Printf("Reconnect failed: %v, retrying...", err)
 			continue
 		}
+		failures = 0
+		c.backoff.Reset()
 
-		log.Printf("Connected to %s", addr)
+		c.logger.Info("connected", gnetrw.KeyAddr, addr, "attempt", attempt)
+		gen := c.gen.Add(1)
+		session, stopMux := c.newSession(gen)
 		c.mu.Lock()
 		c.conn = conn
+		c.session = session
 		c.mu.Unlock()
+		c.state.Set(reconnect.StateOpen, attempt, nil)
+		c.metrics.Connected.Set(1)
 
 		// open read and write loop
+		var readErr error
 		stopChan := make(chan struct{})
-		go c.readLoop(ctx, conn, stopChan)
-		c.writeLoop(ctx, conn, stopChan)
+		go func() {
+			defer close(stopChan)
+			readErr = c.readLoop(ctx, conn, session)
+		}()
+		writeErr := c.writeLoop(ctx, conn, gen, stopChan)
+		<-stopChan
 
 		// close read and write loop
+		stopMux()
 		c.mu.Lock()
 		c.conn = nil
-		log.Printf("Disconnected to %s", addr)
+		c.session = nil
+		c.logger.Info("disconnected", gnetrw.KeyAddr, addr)
 		c.mu.Unlock()
+		if writeErr == nil {
+			writeErr = readErr
+		}
+		c.metrics.Connected.Set(0)
+		c.state.Set(reconnect.StateClosed, 0, writeErr)
 	}
 }
 
-func randomJitter(baseDelay time.Duration) time.Duration {
-	jitter := time.Duration(rand.Int63n(int64(baseDelay / 2)))
-	return baseDelay + jitter
-}
-
-func (c *Client) autoConnect(ctx context.Context, addr string) (net.Conn, error) {
+func (c *Client) autoConnect(ctx context.Context, addr string) (net.Conn, int, error) {
 	dialer := &net.Dialer{Timeout: 1 * time.Second}
-	baseDelay := time.Second
-	maxDelay := 20 * time.Second
 
 	for attempt := 1; ; attempt++ {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		default:
-			conn, err := dialer.DialContext(ctx, "unix", addr)
-			if err == nil {
-				return conn, nil
-			}
-			log.Printf("Connection failed, retrying in %v: %v", baseDelay, err)
+		if ctx.Err() != nil {
+			return nil, attempt, ctx.Err()
+		}
+		c.state.Set(reconnect.StateConnecting, attempt, nil)
+		c.metrics.ReconnectAttempts.Add(1)
+		conn, err := dialer.DialContext(ctx, "unix", addr)
+		if err == nil {
+			return conn, attempt, nil
+		}
+		if ctx.Err() != nil {
+			return nil, attempt, ctx.Err()
+		}
 
-			delay := randomJitter(baseDelay)
-			timer := time.NewTimer(delay)
-			select {
-			case <-ctx.Done():
-				timer.Stop()
-				return nil, ctx.Err()
-			case <-timer.C:
-			}
-			// 增加延迟时间
-			baseDelay *= 2
-			if baseDelay > maxDelay {
-				baseDelay = maxDelay
-			}
+		delay, ok := c.backoff.Next(attempt)
+		if !ok {
+			return nil, attempt, fmt.Errorf("%w after %d attempts: %v", reconnect.ErrAttemptsExhausted, attempt, err)
+		}
+		c.logger.Warn("connection failed", gnetrw.KeyAddr, addr, "attempt", attempt, "retry", delay, gnetrw.KeyErr, err)
+		if err := reconnect.Sleep(ctx, c.clock, delay); err != nil {
+			return nil, attempt, err
 		}
 	}
 }
 
-func (c *Client) readLoop(ctx context.Context, conn net.Conn, stopChan chan<- struct{}) {
-	defer close(stopChan)
+func (c *Client) handshake(conn net.Conn) error {
+	if c.hello == nil {
+		return nil
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	w, err := gnetrw.Handshake(conn, *c.hello)
+	if err != nil {
+		return err
+	}
+	c.headers.Store(w.Version >= gnetrw.HeaderVersion)
+	c.muxOK = c.muxConfig != nil && slices.Contains(w.Capabilities, gnetrw.CapabilityMux)
+	// the server grants the first credit right after the welcome
+	c.creditOK = c.flow && slices.Contains(w.Capabilities, gnetrw.CapabilityCredit)
+	c.credit.Store(0)
+	c.ackOK = c.maxUnacked > 0 && slices.Contains(w.Capabilities, gnetrw.CapabilityAck)
+	c.compressor = gnetrw.NegotiatedCompressor(w, c.threshold)
+	c.logger.Info("handshake accepted", "version", w.Version, "capabilities", w.Capabilities,
+		"compression", c.compressor.Compression)
+	return nil
+}
+
+func (c *Client) readLoop(ctx context.Context, conn net.Conn, session *gnetrw.Session) error {
 	defer conn.Close()
+	if !c.framed {
+		return c.readRaw(ctx, conn)
+	}
 	reader := bufio.NewReader(conn)
 
-	var cache bytes.Buffer // 动态缓冲区
-	buf := make([]byte, 4096)
 	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			// 读取数据并写入 writer
-			n, err := reader.Read(buf)
-			if n > 0 {
-				cache.Write(buf[:n]) // 追加数据到缓冲区
-
-				// 写入 writer
-				if _, writeErr := c.writer.Write(cache.Bytes()); writeErr != nil {
-					log.Printf("Write error: %v", writeErr)
-					return
-				}
-
-				cache.Reset() // 清空缓冲区
+		// 每次读取一个完整的帧并写入 writer
+		f, err := gnetrw.ReadMessage(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				c.logger.Info("server closed the connection")
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
+			c.logger.Warn("read frame", gnetrw.KeyErr, err)
+			return err
+		}
 
+		msg := f.Payload
+		c.metrics.FrameIn(len(msg))
+		if seq := gnetrw.AckOf(f); seq > 0 {
+			c.acked(seq)
+			continue
+		}
+		if f.Flags&gnetrw.FlagCredit != 0 {
+			n, err := gnetrw.ParseCredit(f)
 			if err != nil {
-				if errors.Is(err, io.EOF) {
-					log.Println("Server closed the connection")
-					return
-				}
-				log.Printf("Read error: %v", err)
-
-				// 如果是临时错误，可以延迟重试
-				if ne, ok := err.(net.Error); ok && ne.Temporary() {
-					time.Sleep(50 * time.Millisecond)
-					continue
-				}
+				c.logger.Warn("credit frame", gnetrw.KeyErr, err)
+				return err
+			}
+			c.credit.Add(int64(n))
+			select {
+			case c.creditReady <- struct{}{}:
+			default:
+			}
+			continue
+		}
+		if f.Flags&gnetrw.FlagMux != 0 {
+			if session == nil {
+				c.logger.Warn("dropping stream frame, not negotiated", gnetrw.KeyLen, len(msg))
+				continue
+			}
+			if err := session.HandleFrame(f); err != nil {
+				c.logger.Warn("stream frame", gnetrw.KeyErr, err)
+				return err
+			}
+			continue
+		}
+		if c.onMessage != nil {
+			c.onMessage(f)
+			continue
+		}
+		if _, err := c.writer.Write(msg); err != nil {
+			c.logger.Warn("write message", gnetrw.KeyLen, len(msg), gnetrw.KeyErr, err)
+			return err
+		}
+	}
+}
 
-				// 非临时错误，退出
-				return
+// readRaw writes what the server sends to the writer as it arrives, without frames.
+func (c *Client) readRaw(ctx context.Context, conn net.Conn) error {
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if _, werr := c.writer.Write(buf[:n]); werr != nil {
+				c.logger.Warn("write message", gnetrw.KeyLen, n, gnetrw.KeyErr, werr)
+				return werr
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				c.logger.Info("server closed the connection")
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
+			c.logger.Warn("read", gnetrw.KeyErr, err)
+			return err
 		}
 	}
 }
 
-func (c *Client) writeLoop(ctx context.Context, conn net.Conn, stopChan <-chan struct{}) {
+func (c *Client) writeLoop(ctx context.Context, conn net.Conn, gen uint64, stopChan <-chan struct{}) error {
 	defer conn.Close()
 	writer := bufio.NewWriter(conn)
+	stalled := false
+	// sent before the queued messages, whose numbers are higher
+	resend := c.unacked(gen)
+	if f := c.takeOutboxRetry(); f != nil {
+		resend = append([]*gnetrw.Frame{f}, resend...)
+	}
 
 	for {
+		if len(resend) > 0 && (!c.creditOK || c.credit.Load() > 0) {
+			f := resend[0]
+			resend = resend[1:]
+			if err := c.writeQueued(writer, f, gen); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// without credit the frames wait in their queues, they survive a reconnection
+		in, mux := c.writeChan, c.muxChan
+		if len(resend) > 0 {
+			in, mux = nil, nil
+		}
+		if c.creditOK && c.credit.Load() <= 0 {
+			in, mux = nil, nil
+			if !stalled {
+				stalled = true
+				c.metrics.CreditStalls.Add(1)
+				c.logger.Debug("write loop waiting for credit", gnetrw.KeyLen, len(c.writeChan))
+			}
+		} else {
+			stalled = false
+		}
+
 		select {
+		case <-c.creditReady:
 		case <-ctx.Done():
-			log.Println("Write loop exiting due to context cancellation")
-			return
+			c.logger.Debug("write loop exiting due to context cancellation")
+			return ctx.Err()
 		case <-stopChan:
-			log.Println("Write loop exiting: stop signal received")
-			return
-		case data := <-c.writeChan:
-			_, err := writer.Write(data)
-			if err != nil {
-				log.Printf("Write error: %v", err)
-				return
+			c.logger.Debug("write loop exiting, stop signal received")
+			return nil
+		case <-c.quit:
+			c.logger.Debug("write loop exiting, client closed")
+			return nil
+		case m := <-mux:
+			if m.gen != gen {
+				// its stream died with the previous connection
+				continue
+			}
+			if err := c.writeFrame(writer, m.f); err != nil {
+				return err
 			}
-			writer.Flush()
+		case f := <-in:
+			c.metrics.WriteQueue.Set(int64(len(c.writeChan)))
+			if !c.headers.Load() && f.Flags&gnetrw.FlagStream != 0 {
+				// SendFrame frames are not numbered nor kept in the outbox, the stream
+				// was cut with the connection it started on
+				c.logger.Debug("dropping stream chunk, not negotiated", gnetrw.KeyLen, len(f.Payload))
+				continue
+			}
+			if !c.headers.Load() && len(f.Header) > 0 {
+				// the server predates frame headers
+				c.logger.Debug("dropping frame header, not negotiated", gnetrw.KeyLen, len(f.Payload))
+				f.Header = nil
+			}
+			if err := c.writeQueued(writer, f, gen); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeQueued writes a message of the write queue on connection gen. A numbered message
+// is marked sent once written, else written again on the next connection. Without
+// acknowledgements its record in the outbox is committed once written, or written again
+// on the next connection. A message that cannot be packed is dropped.
+func (c *Client) writeQueued(writer *bufio.Writer, f *gnetrw.Frame, gen uint64) error {
+	err := c.writeFrame(writer, f)
+	if errors.Is(err, ErrUnsendable) {
+		c.logger.Error("drop message", gnetrw.KeyLen, len(f.Payload), gnetrw.KeyErr, err)
+		c.forget(f)
+		return nil
+	}
+	if c.maxUnacked > 0 {
+		c.markSent(f, gen, err == nil)
+		return err
+	}
+	if err != nil {
+		c.retryOutbox(f)
+		return err
+	}
+	c.delivered(f)
+	return nil
+}
+
+// writeFrame compresses, writes and flushes f. Failing to compress or pack f is an
+// ErrUnsendable error, the connection is still usable.
+// Without frames only the payload is written.
+func (c *Client) writeFrame(writer *bufio.Writer, f *gnetrw.Frame) error {
+	data, size := f.Payload, len(f.Payload)
+	if c.framed {
+		cf, err := c.compressor.Compress(f)
+		if err != nil {
+			return fmt.Errorf("%w: compress, %w", ErrUnsendable, err)
 		}
+		if data, err = gnetrw.PackFrame(cf); err != nil {
+			return fmt.Errorf("%w: pack, %w", ErrUnsendable, err)
+		}
+		size = len(data) - 4
+	}
+	_, err := writer.Write(data)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		c.logger.Warn("write frame", gnetrw.KeyLen, size, gnetrw.KeyErr, err)
+		return err
+	}
+	c.metrics.FrameOut(size)
+	if c.creditOK {
+		c.credit.Add(-int64(size))
 	}
+	return nil
 }
 
 func (c *Client) Write(data []byte) (n int, err error) {
+	return c.WriteContext(context.Background(), data)
+}
+
+// WriteContext queues data as one frame, the span in ctx is propagated to the server.
+func (c *Client) WriteContext(ctx context.Context, data []byte) (n int, err error) {
+	return c.WriteMessage(ctx, nil, data)
+}
+
+// WriteMessage queues data as one frame with the metadata in h. The header, trace
+// context included, is dropped if the server does not negotiate gnetrw.HeaderVersion.
+func (c *Client) WriteMessage(ctx context.Context, h gnetrw.Header, data []byte) (n int, err error) {
 	if c.closed.Load() == 1 {
-		return 0, errors.New("client closed")
+		return 0, ErrClientClosed
+	}
+	if c.waitWrite {
+		waitCtx := ctx
+		if c.waitTimeout > 0 {
+			var cancel context.CancelFunc
+			waitCtx, cancel = context.WithTimeout(ctx, c.waitTimeout)
+			defer cancel()
+		}
+		if err := c.WaitReady(waitCtx); err != nil {
+			return 0, fmt.Errorf("wait ready: %w", err)
+		}
+	}
+
+	ctx, span := c.tracer.Start(ctx, "gnetrw.send", gnetrw.SpanKindClient)
+	defer func() {
+		if err != nil {
+			span.SetError(err)
+		}
+		span.End()
+	}()
+
+	if len(data) == 0 && len(h) == 0 {
+		return 0, gnetrw.ErrEmptyFrame
+	}
+	if len(data) > gnetrw.MaxFrameSize {
+		return 0, gnetrw.ErrFrameTooLarge
+	}
+	// callers such as bufio.Writer reuse data once Write returns
+	f := &gnetrw.Frame{Payload: make([]byte, len(data))}
+	copy(f.Payload, data)
+	// the header is dropped by writeLoop if the server does not negotiate it
+	f.Header = h.Clone()
+	if f.Header == nil {
+		f.Header = gnetrw.Header{}
+	}
+	c.propagator.Inject(ctx, f.Header)
+	if len(f.Header) == 0 {
+		f.Header = nil
 	}
 
+	if c.outbox != nil {
+		if err := c.storeOutbox(f); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	if c.maxUnacked > 0 {
+		if err := c.queueAcked(f, 0); err != nil {
+			return 0, err
+		}
+		c.metrics.WriteQueue.Set(int64(len(c.writeChan)))
+		return len(data), nil
+	}
 	select {
-	case c.writeChan <- data:
+	case c.writeChan <- f:
+		c.metrics.WriteQueue.Set(int64(len(c.writeChan)))
 		return len(data), nil
 	default:
-		return 0, errors.New("write channel is full")
+		return 0, ErrWriteQueueFull
+	}
+}
+
+// SendFrame queues f as is, waiting while the write queue is full. It implements
+// gnetrw.FrameSender.
+func (c *Client) SendFrame(ctx context.Context, f *gnetrw.Frame) error {
+	if c.closed.Load() == 1 {
+		return ErrClientClosed
+	}
+	select {
+	case c.writeChan <- f:
+		c.metrics.WriteQueue.Set(int64(len(c.writeChan)))
+		return nil
+	case <-c.quit:
+		return ErrClientClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SendStream sends the content of r as one message with header h, in chunks, so it is
+// never held whole in memory on either side. It waits for the connection and for room
+// in the write queue. The server needs gnetrw.HeaderVersion and a stream handler.
+// When the connection is lost meanwhile it fails with ErrStreamInterrupted, the server
+// drops the part it received.
+func (c *Client) SendStream(ctx context.Context, h gnetrw.Header, r io.Reader) (n int64, err error) {
+	if err := c.WaitReady(ctx); err != nil {
+		return 0, fmt.Errorf("wait ready: %w", err)
+	}
+	if !c.headers.Load() {
+		return 0, gnetrw.ErrHeaderNotSupported
+	}
+
+	ctx, span := c.tracer.Start(ctx, "gnetrw.send_stream", gnetrw.SpanKindClient)
+	defer func() {
+		if err != nil {
+			span.SetError(err)
+		}
+		span.End()
+	}()
+	h = h.Clone()
+	if h == nil {
+		h = gnetrw.Header{}
+	}
+	c.propagator.Inject(ctx, h)
+	if len(h) == 0 {
+		h = nil
+	}
+	s := &streamSender{c: c, gen: c.gen.Load()}
+	return gnetrw.SendStream(ctx, s, c.streamID.Add(1), h, r, 0)
+}
+
+// streamSender fails once the connection a stream started on is gone.
+type streamSender struct {
+	c   *Client
+	gen uint64
+}
+
+func (s *streamSender) SendFrame(ctx context.Context, f *gnetrw.Frame) error {
+	if s.c.gen.Load() != s.gen {
+		return ErrStreamInterrupted
+	}
+	return s.c.SendFrame(ctx, f)
+}
+
+// newSession creates the logical stream session of connection gen, nil when the
+// server did not negotiate gnetrw.CapabilityMux. stop closes it.
+func (c *Client) newSession(gen uint64) (*gnetrw.Session, func()) {
+	if !c.muxOK {
+		return nil, func() {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := gnetrw.NewSession(func(f *gnetrw.Frame) error {
+		select {
+		case c.muxChan <- muxFrame{gen: gen, f: f}:
+			return nil
+		case <-ctx.Done():
+			return ErrStreamInterrupted
+		case <-c.quit:
+			return ErrClientClosed
+		}
+	}, true, *c.muxConfig)
+	return s, func() {
+		cancel()
+		s.Close()
+	}
+}
+
+// currentSession waits for the connection and returns its session.
+func (c *Client) currentSession(ctx context.Context) (*gnetrw.Session, error) {
+	if c.muxConfig == nil {
+		return nil, gnetrw.ErrMuxNotSupported
+	}
+	if err := c.WaitReady(ctx); err != nil {
+		return nil, fmt.Errorf("wait ready: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil, ErrNotConnected
+	}
+	if c.session == nil {
+		return nil, gnetrw.ErrMuxNotSupported
+	}
+	return c.session, nil
+}
+
+// OpenStream opens a logical stream, a net.Conn of its own over the connection. It waits
+// for the connection, the server needs gnetrw.WithMux. The stream fails with
+// gnetrw.ErrConnClosed when the connection is lost, streams do not survive reconnects.
+func (c *Client) OpenStream(ctx context.Context) (*gnetrw.Stream, error) {
+	s, err := c.currentSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.Open()
+}
+
+// AcceptStream waits for a logical stream opened by the server on the current connection.
+func (c *Client) AcceptStream(ctx context.Context) (*gnetrw.Stream, error) {
+	s, err := c.currentSession(ctx)
+	if err != nil {
+		return nil, err
 	}
+	return s.AcceptStream(ctx)
 }
 
 func (c *Client) Close() {
@@ -197,6 +803,7 @@ func (c *Client) Close() {
 		c.conn = nil
 	}
 	c.mu.Unlock()
-	close(c.writeChan)
-	log.Println("Client closed")
+	close(c.quit)
+	c.state.Stop(nil)
+	c.logger.Info("client closed")
 }
@@ -7,7 +7,14 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
+
+	"unixsocket/pkg/gnetrw"
+	"unixsocket/pkg/outbox"
+	"unixsocket/pkg/reconnect"
 )
 
 type ServerMessage struct{}
@@ -19,7 +26,30 @@ func (s *ServerMessage) Write(p []byte) (n int, err error) {
 
 func main() {
 	socketPath := "/tmp/codesocket.tmp"
-	client := NewClient()
+	// the messages not sent yet are kept there across restarts
+	ob, err := outbox.Open(filepath.Join(os.TempDir(), "autoclient-outbox"), outbox.Options{
+		OnCorrupt: func(err error) { log.Printf("damaged outbox: %v", err) },
+	})
+	if err != nil {
+		log.Fatalf("failed open outbox, error: %v", err)
+	}
+	defer ob.Close()
+	if n := ob.Stats().Records; n > 0 {
+		log.Printf("%d messages of a previous run are waiting in the outbox", n)
+	}
+	client := NewClient(
+		WithHello(gnetrw.Hello{Version: gnetrw.ProtocolVersion, Name: "autoclient"}),
+		WithCompression(0, gnetrw.CompressZstd, gnetrw.CompressGzip),
+		WithTracing(&gnetrw.SimpleTracer{}, nil),
+		WithMessageHandler(printMessage),
+		WithMux(gnetrw.MuxConfig{}),
+		WithFlowControl(),
+		WithAckedDelivery(1000),
+		WithOutbox(ob),
+	)
+	defer client.Subscribe(func(t reconnect.Transition) {
+		log.Printf("connection %s -> %s (attempt %d, err %v)", t.From, t.To, t.Attempt, t.Err)
+	})()
 
 	svrMsg := ServerMessage{}
 
@@ -40,10 +70,65 @@ func main() {
 	log.Print("close auto connect client")
 }
 
-func readIOStd(_ context.Context, w io.Writer) {
+// printMessage prints the frames of the server, with their topic for published messages.
+func printMessage(f *gnetrw.Frame) {
+	switch f.Header.Get(gnetrw.HeaderType) {
+	case gnetrw.TypeMessage:
+		fmt.Printf("[%s] %s\n", f.Header.Get(gnetrw.HeaderTopic), f.Payload)
+	case gnetrw.TypeError:
+		fmt.Println("Server error:", gnetrw.DecodeError(f))
+	default:
+		fmt.Print("Server:", string(f.Payload))
+	}
+}
+
+func sendFile(ctx context.Context, c *Client, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("failed open %s, error: %v", path, err)
+		return
+	}
+	defer f.Close()
+	n, err := c.SendStream(ctx, gnetrw.Header{"name": filepath.Base(path)}, f)
+	if err != nil {
+		log.Printf("failed send %s after %d bytes, error: %v", path, n, err)
+		return
+	}
+	log.Printf("sent %s, %d bytes", path, n)
+}
+
+// echoStream writes text on a new logical stream and prints what the server echoes
+// until it closes the stream.
+func echoStream(ctx context.Context, c *Client, text string) {
+	st, err := c.OpenStream(ctx)
+	if err != nil {
+		log.Printf("failed open stream, error: %v", err)
+		return
+	}
+	defer st.Close()
+	if _, err = io.WriteString(st, text+"\n"); err == nil {
+		err = st.CloseWrite()
+	}
+	if err != nil {
+		log.Printf("failed write stream %d, error: %v", st.ID(), err)
+		return
+	}
+	st.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := io.ReadAll(st)
+	if err != nil {
+		log.Printf("failed read stream %d, error: %v", st.ID(), err)
+		return
+	}
+	fmt.Printf("[stream %d] %s", st.ID(), reply)
+}
+
+// readIOStd sends the lines read from stdin, "/sub pattern", "/unsub pattern" and
+// "/pub topic text" use the broker of frameserver, "/send path" streams a file and
+// "/mux text" echoes text over a logical stream.
+func readIOStd(ctx context.Context, c *Client) {
 	defer func() { log.Print("read IO std closed") }()
 	reader := bufio.NewReader(os.Stdin)
-	writer := bufio.NewWriter(w)
+	writer := bufio.NewWriter(c)
 
 	for {
 		log.Print("Enter message: ")
@@ -56,6 +141,29 @@ func readIOStd(_ context.Context, w io.Writer) {
 			log.Print("close of command")
 			return
 		}
+		if cmd, arg, ok := strings.Cut(strings.TrimSpace(msg), " "); ok {
+			switch cmd {
+			case "/sub":
+				err = gnetrw.Subscribe(ctx, c, arg)
+			case "/unsub":
+				err = gnetrw.Unsubscribe(ctx, c, arg)
+			case "/pub":
+				topic, text, _ := strings.Cut(arg, " ")
+				err = gnetrw.Publish(ctx, c, topic, []byte(text))
+			case "/send":
+				go sendFile(ctx, c, arg)
+			case "/mux":
+				go echoStream(ctx, c, arg)
+			default:
+				ok = false
+			}
+			if ok {
+				if err != nil {
+					log.Printf("failed %s %s, error: %v", cmd, arg, err)
+				}
+				continue
+			}
+		}
 
 		_, err = writer.WriteString(msg)
 		if err == nil {
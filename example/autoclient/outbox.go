@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"unixsocket/pkg/gnetrw"
+	"unixsocket/pkg/outbox"
+)
+
+// outboxRetry is how long the outbox waits for room in a full write queue.
+const outboxRetry = 10 * time.Millisecond
+
+// outboxRecord is a record of the outbox moved to the write queue.
+type outboxRecord struct {
+	id   uint64
+	done bool // written, or acknowledged with WithAckedDelivery
+}
+
+// WithOutbox keeps the messages of Write and WriteMessage in ob until they are written,
+// or acknowledged with WithAckedDelivery, instead of the write queue alone. Those not
+// sent when the process stops are sent first, in order, by the next client opening the
+// same directory. Writing fails with outbox.ErrFull once ob reaches its size cap.
+// A message written but not acknowledged before a restart is sent again, the server
+// recognizes it when Hello.ClientID and Hello.Epoch are those of ob, see WithAckedDelivery.
+// ob is not closed by Close.
+func WithOutbox(ob *outbox.Outbox) Option {
+	return func(c *Client) {
+		c.outbox = ob
+		c.outboxIDs = make(map[*gnetrw.Frame]uint64)
+	}
+}
+
+// storeOutbox appends f to the outbox, the pump queues it.
+func (c *Client) storeOutbox(f *gnetrw.Frame) error {
+	buf, err := gnetrw.PackFrame(f)
+	if err != nil {
+		return err
+	}
+	if _, err := c.outbox.Append(buf); err != nil {
+		return err
+	}
+	c.metrics.Outbox.Set(int64(c.outbox.Stats().Records))
+	return nil
+}
+
+// pump moves the records of the outbox to the write queue, in order, until Close.
+func (c *Client) pump() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-c.quit
+		cancel()
+	}()
+	for {
+		id, data, err := c.outbox.Next(ctx)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, outbox.ErrClosed) {
+				c.logger.Error("read outbox", gnetrw.KeyErr, err)
+			}
+			return
+		}
+		f, err := gnetrw.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			c.logger.Warn("drop outbox record", "id", id, gnetrw.KeyErr, err)
+			bad := &gnetrw.Frame{}
+			c.trackOutbox(bad, id)
+			c.delivered(bad)
+			continue
+		}
+		c.trackOutbox(f, id)
+		if err := c.queueOutbox(ctx, f, id); err != nil {
+			return
+		}
+	}
+}
+
+// queueOutbox queues record id like WriteMessage, waiting while the queue is full.
+// With acknowledgements its number is id+1, the same after a restart.
+func (c *Client) queueOutbox(ctx context.Context, f *gnetrw.Frame, id uint64) error {
+	if c.maxUnacked == 0 {
+		return c.SendFrame(ctx, f)
+	}
+	for {
+		err := c.queueAcked(f, id+1)
+		if err == nil {
+			c.metrics.WriteQueue.Set(int64(len(c.writeChan)))
+			return nil
+		}
+		if !errors.Is(err, ErrTooManyUnacked) && !errors.Is(err, ErrWriteQueueFull) {
+			return err
+		}
+		timer := time.NewTimer(outboxRetry)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Client) trackOutbox(f *gnetrw.Frame, id uint64) {
+	c.outboxMu.Lock()
+	defer c.outboxMu.Unlock()
+	c.outboxIDs[f] = id
+	c.outboxQueue = append(c.outboxQueue, &outboxRecord{id: id})
+}
+
+// retryOutbox keeps f to write it first on the next connection when it is a record of
+// the outbox, see writeQueued.
+func (c *Client) retryOutbox(f *gnetrw.Frame) {
+	if c.outbox == nil {
+		return
+	}
+	c.outboxMu.Lock()
+	defer c.outboxMu.Unlock()
+	if _, ok := c.outboxIDs[f]; ok {
+		c.outboxRetry = f
+	}
+}
+
+func (c *Client) takeOutboxRetry() *gnetrw.Frame {
+	if c.outbox == nil {
+		return nil
+	}
+	c.outboxMu.Lock()
+	defer c.outboxMu.Unlock()
+	f := c.outboxRetry
+	c.outboxRetry = nil
+	return f
+}
+
+// delivered commits f in the outbox, with the records before it that are delivered too.
+// Records are committed in order, one sent again after a reconnection holds back the
+// later ones. Without acknowledgements a record is delivered once written and flushed to
+// the socket.
+func (c *Client) delivered(f *gnetrw.Frame) {
+	if c.outbox == nil {
+		return
+	}
+	c.outboxMu.Lock()
+	defer c.outboxMu.Unlock()
+	id, ok := c.outboxIDs[f]
+	if !ok {
+		return
+	}
+	delete(c.outboxIDs, f)
+	q := c.outboxQueue
+	if i := sort.Search(len(q), func(i int) bool { return q[i].id >= id }); i < len(q) && q[i].id == id {
+		q[i].done = true
+	}
+
+	n := 0
+	for n < len(q) && q[n].done {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	if err := c.outbox.Commit(q[n-1].id); err != nil {
+		c.logger.Warn("commit outbox", "id", q[n-1].id, gnetrw.KeyErr, err)
+	}
+	c.outboxQueue = q[n:]
+	c.metrics.Outbox.Set(int64(c.outbox.Stats().Records))
+}
@@ -4,6 +4,7 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -11,6 +12,8 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -19,7 +22,10 @@ import (
 	"unsafe"
 
 	"github.com/panjf2000/gnet/v2"
-	"golang.org/x/exp/rand"
+
+	"unixsocket/pkg/gnetrw"
+	"unixsocket/pkg/metrics"
+	"unixsocket/pkg/reconnect"
 )
 
 type clientEvents struct {
@@ -27,37 +33,327 @@ type clientEvents struct {
 	client *gnet.Client
 	mu     sync.Mutex
 	conn   gnet.Conn
-	status atomic.Int32
+	state  *reconnect.Monitor
 
 	// reconnect
 	ctx         context.Context
 	addr        string
 	reconnectWG sync.WaitGroup
+	backoff     reconnect.BackoffPolicy
+	clock       reconnect.Clock
+
+	waitWrite   bool
+	waitTimeout time.Duration
+
+	hello    *gnetrw.Hello
+	attempt  atomic.Int32 // attempt that dialed the current connection
+	failures atomic.Int32 // handshakes failed in a row, the backoff is reset once one succeeds
+	headers  atomic.Bool  // the server negotiated gnetrw.HeaderVersion
+	logger   gnetrw.Logger
+	metrics  *gnetrw.ClientMetrics
+
+	compress   []gnetrw.Compression
+	threshold  int
+	compressor atomic.Pointer[gnetrw.Compressor] // negotiated on the current connection
+
+	tracer     gnetrw.Tracer
+	propagator gnetrw.Propagator
+
+	resume   bool
+	resumeMu sync.Mutex
+	session  string // token given by the server, see gnetrw.CapabilityResume
+	received uint64 // highest message number received on it
 }
 
-const (
-	state_Closed int32 = iota
-	state_Opened
-	state_Connecting
-)
+// connContext is kept in the gnet connection context.
+type connContext struct {
+	part     *gnetrw.PartData
+	welcome  *gnetrw.Welcome
+	closeErr error
+}
+
+// handshakeTimeout bounds the wait for the server's welcome.
+const handshakeTimeout = 5 * time.Second
+
+type Option func(ev *clientEvents)
+
+// WithBackoff sets the policy used between connection attempts.
+func WithBackoff(p reconnect.BackoffPolicy) Option {
+	return func(ev *clientEvents) { ev.backoff = p }
+}
+
+// WithClock replaces the clock used to wait between connection attempts.
+func WithClock(clock reconnect.Clock) Option {
+	return func(ev *clientEvents) { ev.clock = clock }
+}
+
+// WithWriteWait makes Write wait for the connection to be open instead of failing.
+// A timeout of 0 waits until the client stops reconnecting.
+func WithWriteWait(timeout time.Duration) Option {
+	return func(ev *clientEvents) {
+		ev.waitWrite = true
+		ev.waitTimeout = timeout
+	}
+}
+
+// WithHello makes the client run the handshake with hello on every connection.
+// The connection only counts as open once the server accepted it. Messages are then
+// gnetrw frames, without WithHello the client writes and reads raw bytes, as
+// example/server and example/echoserver do.
+func WithHello(hello gnetrw.Hello) Option {
+	return func(ev *clientEvents) { ev.hello = &hello }
+}
+
+// WithLogger sets the client logger, gnetrw.DefaultLogger is used otherwise.
+func WithLogger(l gnetrw.Logger) Option {
+	return func(ev *clientEvents) { ev.logger = l }
+}
+
+// WithMetrics reports the client measurements to m, see gnetrw.ClientMetrics.
+// The write queue is owned by gnet and is not measured.
+func WithMetrics(m metrics.Metrics) Option {
+	return func(ev *clientEvents) { ev.metrics = gnetrw.NewClientMetrics(m, "unixsocket_clientgnet") }
+}
+
+// WithTracing starts a span with t around every write and, once the server
+// negotiated frame headers, sends the trace context p injects with the message.
+// nil p uses gnetrw.TraceContext.
+func WithTracing(t gnetrw.Tracer, p gnetrw.Propagator) Option {
+	return func(ev *clientEvents) {
+		ev.tracer = t
+		ev.propagator = p
+	}
+}
+
+// WithCompression announces algs, in order of preference, in the hello. Once the server
+// agrees, payloads of at least threshold bytes are compressed, 0 uses gnetrw.DefaultCompressThreshold.
+// It needs WithHello.
+func WithCompression(threshold int, algs ...gnetrw.Compression) Option {
+	return func(ev *clientEvents) {
+		ev.compress = algs
+		ev.threshold = threshold
+	}
+}
+
+// WithResumption announces gnetrw.CapabilityResume in the hello. Once the server agrees,
+// reconnecting resumes the session of the previous connection, its state is kept by the
+// server and the messages sent meanwhile are received. It needs WithHello.
+func WithResumption() Option {
+	return func(ev *clientEvents) { ev.resume = true }
+}
+
+func newClientEvents(opts ...Option) *clientEvents {
+	ev := &clientEvents{
+		// 1s doubling up to 20s, jitter up to 100%
+		backoff: &reconnect.Exponential{Base: time.Second, Max: 20 * time.Second, Jitter: 1},
+		clock:   reconnect.SystemClock,
+		logger:  gnetrw.DefaultLogger(),
+		tracer:  gnetrw.NopTracer,
+	}
+	for _, opt := range opts {
+		opt(ev)
+	}
+	if ev.propagator == nil {
+		ev.propagator = gnetrw.TraceContext{}
+	}
+	if ev.metrics == nil {
+		ev.metrics = gnetrw.NewClientMetrics(metrics.Nop, "")
+	}
+	if ev.hello != nil && len(ev.compress) > 0 {
+		ev.hello.Capabilities = append(slices.Clip(ev.hello.Capabilities), gnetrw.CompressionCapabilities(ev.compress...)...)
+	}
+	if ev.hello != nil && ev.resume {
+		ev.hello.Capabilities = append(slices.Clip(ev.hello.Capabilities), gnetrw.CapabilityResume)
+	}
+	ev.compressor.Store(&gnetrw.Compressor{})
+	ev.state = reconnect.NewMonitor(ev.clock)
+	ev.state.Subscribe(func(t reconnect.Transition) {
+		if t.To == reconnect.StateOpen {
+			ev.metrics.Connected.Set(1)
+		} else if t.From == reconnect.StateOpen {
+			ev.metrics.Connected.Set(0)
+		}
+	})
+	return ev
+}
+
+// State returns the current connection state.
+func (ev *clientEvents) State() reconnect.State {
+	return ev.state.State()
+}
+
+// WaitReady blocks until the connection is open, ctx ends or the client stops reconnecting.
+func (ev *clientEvents) WaitReady(ctx context.Context) error {
+	return ev.state.WaitReady(ctx)
+}
+
+// Subscribe calls fn on every connection state transition. fn must not block.
+func (ev *clientEvents) Subscribe(fn func(reconnect.Transition)) (cancel func()) {
+	return ev.state.Subscribe(fn)
+}
+
+// Watch delivers connection state transitions on a channel.
+func (ev *clientEvents) Watch(size int) (<-chan reconnect.Transition, func()) {
+	return ev.state.Watch(size)
+}
 
 func (ev *clientEvents) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
-	log.Println("open connection")
-	c.Write([]byte("hello world"))
+	ev.logger.Debug("open connection", gnetrw.KeyAddr, ev.addr)
+	cc := &connContext{}
+	c.SetContext(cc)
+	if ev.hello == nil {
+		return
+	}
+
+	hello := *ev.hello
+	if ev.resume {
+		ev.resumeMu.Lock()
+		hello.Session, hello.Received = ev.session, ev.received
+		ev.resumeMu.Unlock()
+	}
+	out, err := hello.HelloFrame()
+	if err != nil {
+		ev.logger.Error("encode hello", gnetrw.KeyErr, err)
+		return nil, gnet.Close
+	}
+	time.AfterFunc(handshakeTimeout, func() {
+		if ev.State() != reconnect.StateOpen {
+			c.Close()
+		}
+	})
 	return
 }
 
-func (ev *clientEvents) OnClose(gnet.Conn, error) gnet.Action {
-	log.Println("connection closed")
-	ev.setConnect(nil)
+func (ev *clientEvents) OnClose(c gnet.Conn, err error) gnet.Action {
+	if cc := contextOf(c); cc != nil {
+		err = gnetrw.CloseReason(c, cc.part, cc.closeErr, err)
+		if ev.hello != nil && cc.welcome == nil {
+			// rejected, timed out or asked to retry later, reconnect waits
+			ev.failures.Add(1)
+		}
+	}
+	ev.logger.Info("connection closed", gnetrw.KeyAddr, ev.addr, gnetrw.KeyErr, err)
+	ev.setConnect(nil, 0, err)
 	ev.tryConnect()
 	return gnet.None
 }
 
 func (ev *clientEvents) OnTraffic(c gnet.Conn) (action gnet.Action) {
-	d, _ := c.Next(-1)
-	log.Println("res: ", B2S(d))
-	return
+	if ev.hello == nil {
+		d, _ := c.Next(-1)
+		log.Println("res: ", B2S(d))
+		return gnet.None
+	}
+	return gnetrw.TrafficData(ev, c)
+}
+
+// FrameMetrics returns the frame instruments, gnetrw.TrafficData reports through them.
+func (ev *clientEvents) FrameMetrics() *gnetrw.FrameMetrics {
+	return ev.metrics.FrameMetrics
+}
+
+func contextOf(c gnet.Conn) *connContext {
+	cc, _ := c.Context().(*connContext)
+	return cc
+}
+
+func (ev *clientEvents) GetPartData(c gnet.Conn) *gnetrw.PartData {
+	return contextOf(c).part
+}
+
+func (ev *clientEvents) AddPartData(c gnet.Conn, datalen int) *gnetrw.PartData {
+	cc := contextOf(c)
+	cc.part = &gnetrw.PartData{DataLen: datalen}
+	return cc.part
+}
+
+func (ev *clientEvents) RemovePartData(c gnet.Conn) {
+	contextOf(c).part = nil
+}
+
+// OnError records why TrafficData closes c, see gnetrw.ErrorHandler.
+func (ev *clientEvents) OnError(c gnet.Conn, err error) {
+	contextOf(c).closeErr = err
+}
+
+func (ev *clientEvents) DispatchData(c gnet.Conn, msg []byte) error {
+	cc := contextOf(c)
+	if ev.hello != nil && cc.welcome == nil {
+		w, err := gnetrw.ParseWelcome(msg)
+		if err != nil {
+			if errors.Is(err, gnetrw.ErrHandshakeRejected) && !errors.Is(err, gnetrw.ErrRetryLater) {
+				ev.state.Stop(err)
+			}
+			return err
+		}
+		ev.logger.Info("handshake accepted", gnetrw.KeyAddr, ev.addr, "version", w.Version, "capabilities", w.Capabilities)
+		cc.welcome = w
+		ev.failures.Store(0)
+		ev.backoff.Reset()
+		ev.resumed(w)
+		ev.headers.Store(w.Version >= gnetrw.HeaderVersion)
+		cp := gnetrw.NegotiatedCompressor(w, ev.threshold)
+		ev.compressor.Store(&cp)
+		ev.state.Set(reconnect.StateOpen, int(ev.attempt.Load()), nil)
+		return nil
+	}
+
+	log.Println("res: ", B2S(msg))
+	return nil
+}
+
+// resumed records the session the server gave in w.
+func (ev *clientEvents) resumed(w *gnetrw.Welcome) {
+	if !ev.resume {
+		return
+	}
+	ev.resumeMu.Lock()
+	defer ev.resumeMu.Unlock()
+	switch {
+	case w.Resumed:
+		ev.logger.Info("session resumed", gnetrw.KeyAddr, ev.addr, "received", ev.received)
+	case ev.session != "" && w.Session != "":
+		ev.logger.Warn("session not resumed, the server lost its state", gnetrw.KeyAddr, ev.addr)
+		fallthrough
+	default:
+		ev.received = 0
+	}
+	ev.session = w.Session
+}
+
+// duplicate reports whether f, numbered by a server resuming sessions, was already
+// received. The server sends again what follows Hello.Received, in order.
+func (ev *clientEvents) duplicate(f *gnetrw.Frame) bool {
+	seq, err := strconv.ParseUint(f.Header.Get(gnetrw.HeaderSeq), 10, 64)
+	if err != nil {
+		return false
+	}
+	ev.resumeMu.Lock()
+	defer ev.resumeMu.Unlock()
+	if ev.session == "" {
+		return false
+	}
+	if seq <= ev.received {
+		return true
+	}
+	if seq > ev.received+1 {
+		ev.logger.Warn("messages missed", "from", ev.received+1, "to", seq-1)
+	}
+	ev.received = seq
+	return false
+}
+
+// DispatchFrame logs the metadata headers of a frame before its payload, see gnetrw.FrameDispatch.
+func (ev *clientEvents) DispatchFrame(c gnet.Conn, f *gnetrw.Frame) error {
+	if cc := contextOf(c); ev.hello == nil || cc.welcome != nil {
+		if ev.resume && ev.duplicate(f) {
+			return nil
+		}
+		for _, k := range f.Header.Keys() {
+			log.Printf("header %s: %s", k, f.Header.Get(k))
+		}
+	}
+	return ev.DispatchData(c, f.Payload)
 }
 
 func (ev *clientEvents) Connect(ctx context.Context, addr string) error {
@@ -72,13 +368,8 @@ func (ev *clientEvents) Connect(ctx context.Context, addr string) error {
 	return nil
 }
 
-func randomJitter(baseDelay time.Duration) time.Duration {
-	jitter := time.Duration(rand.Int63n(int64(baseDelay)))
-	return baseDelay + jitter
-}
-
 func (ev *clientEvents) tryConnect() {
-	if ev.status.Load() == state_Closed {
+	if ev.state.State() == reconnect.StateClosed {
 		ev.reconnectWG.Add(1)
 		go func() {
 			defer ev.reconnectWG.Done()
@@ -87,7 +378,7 @@ func (ev *clientEvents) tryConnect() {
 	}
 }
 
-func (ev *clientEvents) setConnect(c gnet.Conn) {
+func (ev *clientEvents) setConnect(c gnet.Conn, attempt int, err error) {
 	ev.mu.Lock()
 	defer ev.mu.Unlock()
 
@@ -95,78 +386,184 @@ func (ev *clientEvents) setConnect(c gnet.Conn) {
 		return
 	}
 	if ev.conn != nil {
-		log.Println("close previous connection")
+		ev.logger.Debug("close previous connection")
 		ev.conn.Close()
 	}
 	ev.conn = c
 	if ev.conn == nil {
-		log.Println("update connect status : Closed")
-		ev.status.Swap(state_Closed)
+		ev.logger.Debug("update connect status", "status", "Closed")
+		ev.state.Set(reconnect.StateClosed, attempt, err)
+	} else if ev.hello == nil {
+		ev.logger.Debug("update connect status", "status", "Opened")
+		ev.state.Set(reconnect.StateOpen, attempt, nil)
 	} else {
-		log.Println("update connect status : Opened")
-		ev.status.Swap(state_Opened)
+		// opened once the server accepts the handshake, see DispatchData
+		ev.logger.Debug("update connect status", "status", "Handshaking")
 	}
 }
 
 // reconnect
 func (ev *clientEvents) reconnect(ctx context.Context, addr string) {
-	if ev.status.Load() != state_Closed {
+	if !ev.state.CompareAndSet(reconnect.StateClosed, reconnect.StateConnecting, 1, nil) {
 		return
 	}
-	ev.status.Swap(state_Connecting)
+	var (
+		attempt   int
+		lastErr   error
+		connected bool
+	)
 	defer func() {
-		if ev.status.Load() == state_Connecting {
-			ev.status.Swap(state_Closed)
+		if !connected {
+			ev.state.CompareAndSet(reconnect.StateConnecting, reconnect.StateClosed, attempt, lastErr)
 		}
 	}()
 
 	network, address := parseAddr(addr)
 	if network == "" {
-		log.Printf("unable to connect, invalid addr %s ", addr)
+		lastErr = fmt.Errorf("invalid addr %s", addr)
+		ev.logger.Error("unable to connect", gnetrw.KeyErr, lastErr)
 		return
 	}
 
-	baseDelay := time.Second
-	maxDelay := 20 * time.Second
-	for attempt := 1; ; attempt++ {
+	if failures := int(ev.failures.Load()); failures > 0 {
+		delay, ok := ev.backoff.Next(failures)
+		if !ok {
+			lastErr = fmt.Errorf("%w after %d handshakes", reconnect.ErrAttemptsExhausted, failures)
+			ev.logger.Error("handshake failed, giving up", gnetrw.KeyAddr, addr, gnetrw.KeyErr, lastErr)
+			ev.state.Stop(lastErr)
+			return
+		}
+		ev.logger.Warn("handshake failed", gnetrw.KeyAddr, addr, "attempt", failures, "retry", delay)
+		if err := reconnect.Sleep(ctx, ev.clock, delay); err != nil {
+			lastErr = err
+			ev.state.Stop(err)
+			return
+		}
+	}
+
+	for attempt = 1; ; attempt++ {
+		ev.attempt.Store(int32(attempt))
+		ev.metrics.ReconnectAttempts.Add(1)
 		conn, err := ev.client.Dial(network, address)
 		if err == nil {
-			ev.setConnect(conn)
+			connected = true
+			if ev.hello == nil {
+				// with a handshake only once the server accepts it, see DispatchData
+				ev.backoff.Reset()
+			}
+			ev.setConnect(conn, attempt, nil)
 			return
 		}
-		log.Printf("attempt #%d failed, retrying in %v: %v", attempt, baseDelay, err)
+		lastErr = err
 
-		delay := randomJitter(baseDelay)
-		timer := time.NewTimer(delay)
-		select {
-		case <-ctx.Done():
-			timer.Stop()
-			log.Println("context canceled of wait, stopping reconnect.")
+		delay, ok := ev.backoff.Next(attempt)
+		if !ok {
+			ev.logger.Error("connection failed, giving up", gnetrw.KeyAddr, addr, "attempt", attempt, gnetrw.KeyErr, err)
+			ev.state.Stop(fmt.Errorf("%w after %d attempts: %v", reconnect.ErrAttemptsExhausted, attempt, err))
 			return
-		case <-timer.C:
 		}
-		// add delay
-		baseDelay *= 2
-		if baseDelay > maxDelay {
-			baseDelay = maxDelay
+		ev.logger.Warn("connection failed", gnetrw.KeyAddr, addr, "attempt", attempt, "retry", delay, gnetrw.KeyErr, err)
+		if err := reconnect.Sleep(ctx, ev.clock, delay); err != nil {
+			lastErr = err
+			ev.logger.Info("context canceled of wait, stopping reconnect")
+			ev.state.Stop(err)
+			return
 		}
 	}
 }
 
 func (ev *clientEvents) Write(data []byte) (n int, err error) {
-	if ev.status.Load() != state_Opened {
-		return 0, errors.New("client closed, status?")
+	return ev.WriteContext(context.Background(), data)
+}
+
+// WriteContext sends data as one frame, the span in ctx is propagated to the server.
+func (ev *clientEvents) WriteContext(ctx context.Context, data []byte) (n int, err error) {
+	return ev.WriteMessage(ctx, nil, data)
+}
+
+// WriteMessage sends data as one frame with the metadata in h. It fails with
+// gnetrw.ErrHeaderNotSupported when h is not empty and the server did not negotiate headers.
+func (ev *clientEvents) WriteMessage(ctx context.Context, h gnetrw.Header, data []byte) (n int, err error) {
+	if ev.waitWrite {
+		waitCtx := ctx
+		if ev.waitTimeout > 0 {
+			var cancel context.CancelFunc
+			waitCtx, cancel = context.WithTimeout(ctx, ev.waitTimeout)
+			defer cancel()
+		}
+		if err := ev.WaitReady(waitCtx); err != nil {
+			return 0, fmt.Errorf("wait ready: %w", err)
+		}
+	}
+	if state := ev.state.State(); state != reconnect.StateOpen {
+		return 0, fmt.Errorf("%w, status %s", gnetrw.ErrConnClosed, state)
 	}
+
+	ctx, span := ev.tracer.Start(ctx, "gnetrw.send", gnetrw.SpanKindClient)
+	defer func() {
+		if err != nil {
+			span.SetError(err)
+		}
+		span.End()
+	}()
+
 	ev.mu.Lock()
 	defer ev.mu.Unlock()
 	if ev.conn == nil {
-		return 0, errors.New("client closed, conn is empty?")
+		return 0, gnetrw.ErrConnClosed
+	}
+	f := &gnetrw.Frame{Payload: data}
+	if ev.headers.Load() {
+		f.Header = h.Clone()
+		if f.Header == nil {
+			f.Header = gnetrw.Header{}
+		}
+		ev.propagator.Inject(ctx, f.Header)
+		if len(f.Header) == 0 {
+			f.Header = nil
+		}
+	} else if len(h) > 0 {
+		return 0, gnetrw.ErrHeaderNotSupported
+	}
+	if ev.hello == nil {
+		// raw bytes, AsyncWrite keeps the buffer until it is written
+		if err = ev.conn.AsyncWrite(bytes.Clone(data), nil); err != nil {
+			return 0, err
+		}
+		ev.metrics.FrameOut(len(data))
+		return len(data), nil
 	}
-	return ev.conn.Write(data)
+	if f, err = ev.compressor.Load().Compress(f); err != nil {
+		return 0, err
+	}
+	// Write is called outside the event loop, gnet only allows AsyncWrite here.
+	frame, err := gnetrw.PackFrame(f)
+	if err != nil {
+		return 0, err
+	}
+	if err = ev.conn.AsyncWrite(frame, nil); err != nil {
+		return 0, err
+	}
+	ev.metrics.FrameOut(len(frame) - 4)
+	return len(data), nil
+}
+
+// Close stops reconnecting and closes the current connection.
+func (ev *clientEvents) Close() {
+	ev.state.Stop(nil)
+	ev.setConnect(nil, 0, nil)
 }
 
 func main() {
-	clientEV := &clientEvents{}
+	clientEV := newClientEvents(
+		WithWriteWait(5*time.Second),
+		WithHello(gnetrw.Hello{Version: gnetrw.ProtocolVersion, Name: "clientgnet"}),
+		WithCompression(0, gnetrw.CompressSnappy),
+		WithResumption(),
+	)
+	defer clientEV.Subscribe(func(t reconnect.Transition) {
+		log.Printf("connection %s -> %s (attempt %d, err %v)", t.From, t.To, t.Attempt, t.Err)
+	})()
 	client, _ := gnet.NewClient(
 		clientEV,
 		gnet.WithLockOSThread(true),
@@ -202,7 +599,7 @@ func main() {
 	}
 
 	wg.Wait()
-	clientEV.setConnect(nil)
+	clientEV.Close()
 	clientEV.reconnectWG.Wait()
 }
 
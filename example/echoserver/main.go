@@ -1,22 +1,61 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"flag"
 	"log"
-	"net/http"
-
-	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/panjf2000/gnet/v2"
+
+	"unixsocket/pkg/admission"
+	"unixsocket/pkg/diag"
+	"unixsocket/pkg/metrics"
 )
 
 type echoServer struct {
 	*gnet.BuiltinEventEngine
 	address string
+	eng     gnet.Engine
+	conns   sync.Map // gnet.Conn -> connInfo
+	admit   *admission.Controller[gnet.Conn]
+
+	active   metrics.Gauge
+	accepted metrics.Counter
+	closed   metrics.Counter
+	bytesIn  metrics.Counter
+	bytesOut metrics.Counter
+	rejected metrics.Counter
+	evicted  metrics.Counter
+}
+
+type connInfo struct {
+	Addr  string    `json:"addr"`
+	Since time.Time `json:"since"`
+}
+
+func newEchoServer(address string, m metrics.Metrics, limits admission.Limits) *echoServer {
+	m = metrics.OrNop(m)
+	return &echoServer{
+		address:  address,
+		admit:    admission.New[gnet.Conn](limits),
+		active:   m.Gauge("unixsocket_echo_connections_active", "Connections currently open."),
+		accepted: m.Counter("unixsocket_echo_connections_accepted_total", "Connections accepted."),
+		closed:   m.Counter("unixsocket_echo_connections_closed_total", "Connections closed."),
+		bytesIn:  m.Counter("unixsocket_echo_bytes_in_total", "Bytes received."),
+		bytesOut: m.Counter("unixsocket_echo_bytes_out_total", "Bytes sent."),
+		rejected: m.Counter("unixsocket_echo_connections_rejected_total", "Connections refused by the admission limits."),
+		evicted:  m.Counter("unixsocket_echo_connections_evicted_total", "Idle connections closed above the soft limit."),
+	}
 }
 
 // OnBoot is triggered when the server starts.
 func (es *echoServer) OnBoot(eng gnet.Engine) gnet.Action {
+	es.eng = eng
 	log.Printf("Echo server is listening on %s\n", es.address)
 	return gnet.None
 }
@@ -29,15 +68,60 @@ func (es *echoServer) OnShutdown(eng gnet.Engine) {
 // OnOpen is triggered when a new connection is opened.
 func (es *echoServer) OnOpen(conn gnet.Conn) ([]byte, gnet.Action) {
 	log.Printf("New connection from %s\n", conn.RemoteAddr().String())
+	uid, _ := admission.PeerUID(conn.Fd())
+	entry, err := es.admit.Admit(conn, uid, time.Now())
+	if err != nil {
+		log.Printf("Reject connection from %s: %v\n", conn.RemoteAddr().String(), err)
+		es.rejected.Add(1)
+		return []byte("rejected: " + err.Error() + "\n"), gnet.Close
+	}
+	conn.SetContext(entry)
+	es.evict()
+	es.conns.Store(conn, connInfo{Addr: conn.RemoteAddr().String(), Since: time.Now()})
+	es.accepted.Add(1)
+	es.active.Add(1)
 	return nil, gnet.None
 }
 
+// OnTick evicts the idle connections above the soft limit every second.
+func (es *echoServer) OnTick() (time.Duration, gnet.Action) {
+	es.evict()
+	return time.Second, gnet.None
+}
+
+// evict closes the connections idle the longest above the soft limit.
+func (es *echoServer) evict() {
+	for _, victim := range es.admit.Evict(time.Now()) {
+		log.Printf("Evict idle connection from %s\n", victim.RemoteAddr().String())
+		es.evicted.Add(1)
+		victim.Close()
+	}
+}
+
 // OnClose is triggered when a connection is closed.
 func (es *echoServer) OnClose(conn gnet.Conn, err error) gnet.Action {
+	if conn.Context() == nil {
+		// rejected in OnOpen
+		return gnet.None
+	}
 	log.Printf("Connection from %s closed\n", conn.RemoteAddr().String())
+	es.admit.Release(conn)
+	es.conns.Delete(conn)
+	es.closed.Add(1)
+	es.active.Add(-1)
 	return gnet.None
 }
 
+// Connections lists the open connections.
+func (es *echoServer) Connections() []connInfo {
+	var list []connInfo
+	es.conns.Range(func(_, v any) bool {
+		list = append(list, v.(connInfo))
+		return true
+	})
+	return list
+}
+
 var (
 	echotag = []byte("echo:")
 )
@@ -46,6 +130,8 @@ var (
 func (es *echoServer) OnTraffic(conn gnet.Conn) gnet.Action {
 	// Read incoming data
 	buffer, _ := conn.Next(-1)
+	es.bytesIn.Add(int64(len(buffer)))
+	conn.Context().(*admission.Entry).Touch(time.Now())
 
 	// Log received data
 	log.Printf("Received data: %s", string(buffer))
@@ -54,23 +140,53 @@ func (es *echoServer) OnTraffic(conn gnet.Conn) gnet.Action {
 	sendBuf := make([]byte, len(buffer)+len(echotag))
 	copy(sendBuf, echotag)
 	copy(sendBuf[len(echotag):], buffer)
-	conn.Write(sendBuf)
+	if n, err := conn.Write(sendBuf); err == nil {
+		es.bytesOut.Add(int64(n))
+	}
 
 	// Return no action to continue the connection
 	return gnet.None
 }
 
 func main() {
-	fmt.Println("run pprof", ":8801")
-	go http.ListenAndServe(":8801", nil)
+	diagAddr := flag.String("diag", "", `diagnostics address, "127.0.0.1:8801" or "unix:///tmp/echoserver-diag.sock", disabled when empty`)
+	var limits admission.Limits
+	flag.IntVar(&limits.Max, "max-conns", 0, "refuse connections above this number, unlimited when 0")
+	flag.IntVar(&limits.PerUID, "max-conns-per-uid", 0, "refuse connections of a peer uid above this number, unlimited when 0")
+	flag.IntVar(&limits.Soft, "soft-conns", 0, "evict the connections idle the longest above this number, disabled when 0")
+	flag.DurationVar(&limits.IdleAfter, "idle-after", admission.DefaultIdleAfter, "quiet time before a connection can be evicted")
+	flag.Parse()
+
+	reg := metrics.NewRegistry()
 
 	// Address to bind the server
 	address := "unix:///tmp/codesocket.tmp"
-	server := &echoServer{address: address}
+	server := newEchoServer(address, reg, limits)
+
+	if *diagAddr != "" {
+		d := diag.New(*diagAddr,
+			diag.WithMetrics(reg),
+			diag.WithConnections(func() any { return server.Connections() }),
+		)
+		if err := d.Start(); err != nil {
+			log.Fatalf("Failed to start diagnostics: %v\n", err)
+		}
+		defer d.Shutdown(context.Background())
+		log.Printf("Diagnostics listening on %s\n", *diagAddr)
+	}
+
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		<-sigs
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.eng.Stop(ctx)
+	}()
 
 	// Start the server
-	err := gnet.Run(server, address, gnet.WithMulticore(true), gnet.WithReusePort(true))
+	err := gnet.Run(server, address, gnet.WithMulticore(true), gnet.WithReusePort(true), gnet.WithTicker(true))
 	if err != nil {
-		log.Fatalf("Failed to start server: %v\n", err)
+		log.Printf("Failed to start server: %v\n", err)
 	}
 }
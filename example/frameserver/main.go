@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+	"github.com/panjf2000/gnet/v2"
+
+	"unixsocket/pkg/admission"
+	"unixsocket/pkg/diag"
+	"unixsocket/pkg/gnetrw"
+	"unixsocket/pkg/metrics"
+)
+
+var (
+	echotag = []byte("echo:")
+)
+
+// echo sends every frame back to the client prefixed with echotag, along with its
+// metadata headers.
+func echo(_ context.Context, c *gnetrw.Conn, f *gnetrw.Frame) error {
+	msg := f.Payload
+	log.Printf("Received data: %s", string(msg))
+
+	header := f.Header.Clone()
+	header.Del(gnetrw.HeaderTraceParent)
+	header.Del(gnetrw.HeaderTraceState)
+	header.Del(gnetrw.HeaderBaggage)
+	for _, k := range header.Keys() {
+		log.Printf("  %s: %s", k, header.Get(k))
+	}
+
+	sendBuf := make([]byte, len(msg)+len(echotag))
+	copy(sendBuf, echotag)
+	copy(sendBuf[len(echotag):], msg)
+	_, err := c.WriteMessage(header, sendBuf)
+	return err
+}
+
+// digest reads a streamed message as it arrives and answers with its size and sha256,
+// the message is never held whole in memory.
+func digest(_ context.Context, c *gnetrw.Conn, h gnetrw.Header, r io.Reader) error {
+	sum := sha256.New()
+	n, err := io.Copy(sum, r)
+	if err != nil {
+		log.Printf("stream %q failed after %d bytes: %v", h.Get("name"), n, err)
+		return nil
+	}
+	log.Printf("stream %q received, %d bytes", h.Get("name"), n)
+	_, err = c.AsyncWriteMessage(nil, []byte(fmt.Sprintf("stream %q: %d bytes, sha256 %x\n", h.Get("name"), n, sum.Sum(nil))))
+	return err
+}
+
+// echoStream copies a logical stream back to the client, upper-cased, until the client
+// stops writing.
+func echoStream(_ context.Context, c *gnetrw.Conn, st *gnetrw.Stream) error {
+	r := bufio.NewReader(st)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if _, werr := st.Write(bytes.ToUpper(line)); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			log.Printf("stream %d of %s done", st.ID(), c.RemoteAddr())
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// echoRequest and echoReply are the "echo" JSON messages.
+type echoRequest struct {
+	Text string `json:"text"`
+}
+
+type echoReply struct {
+	Text string    `json:"text"`
+	At   time.Time `json:"at"`
+}
+
+func main() {
+	diagAddr := flag.String("diag", "", `diagnostics address, "127.0.0.1:8802" or "unix:///tmp/frameserver-diag.sock", disabled when empty`)
+	workers := flag.Int("workers", 0, "run handlers on a pool of that many goroutines, on the event loop when 0")
+	rate := flag.Float64("rate", 0, "frames per second allowed to each connection, unlimited when 0")
+	notify := flag.Duration("notify", 0, "broadcast a notice to every client at this interval, disabled when 0")
+	resume := flag.Duration("resume-window", gnetrw.DefaultResumeWindow, "keep the session of a disconnected client this long, disabled when 0")
+	var flow gnetrw.FlowControl
+	flag.IntVar(&flow.Window, "credit-window", 0, "bytes a client may send before they are handled, flow control is disabled when 0")
+	flag.IntVar(&flow.HighWater, "high-water", gnetrw.DefaultHighWater, "stop reading a connection with this many outbound bytes buffered, with -credit-window")
+	subBuffer := flag.Int("sub-buffer", gnetrw.DefaultSubscriberBuffer, "bytes a subscriber may have pending before it is disconnected")
+	var limits admission.Limits
+	flag.IntVar(&limits.Max, "max-conns", 0, "refuse connections above this number, unlimited when 0")
+	flag.IntVar(&limits.PerUID, "max-conns-per-uid", 0, "refuse connections of a peer uid above this number, unlimited when 0")
+	flag.IntVar(&limits.Soft, "soft-conns", 0, "evict the connections idle the longest above this number, disabled when 0")
+	flag.DurationVar(&limits.IdleAfter, "idle-after", admission.DefaultIdleAfter, "quiet time before a connection can be evicted")
+	flag.Parse()
+
+	reg := metrics.NewRegistry()
+
+	address := "unix:///tmp/codesocket.tmp"
+	router := gnetrw.NewRouter()
+	router.Use(gnetrw.Recovery(gnetrw.DefaultLogger()), gnetrw.Logging(gnetrw.DefaultLogger()))
+	router.HandleFunc("", echo)
+	gnetrw.RegisterJSON(router, "echo", func(_ context.Context, req *echoRequest) (*echoReply, error) {
+		return &echoReply{Text: req.Text, At: time.Now()}, nil
+	})
+	broker := gnetrw.NewBroker(gnetrw.WithBrokerMetrics(reg), gnetrw.WithSubscriberBuffer(*subBuffer))
+	broker.Register(router)
+
+	opts := []gnetrw.Option{
+		gnetrw.WithMetrics(reg),
+		gnetrw.WithPanicPolicy(gnetrw.PanicReply),
+		gnetrw.WithStreamHandler(digest, 0),
+		gnetrw.WithMux(echoStream, gnetrw.MuxConfig{}),
+		gnetrw.WithAckedDelivery(0),
+		gnetrw.WithCompression(0, gnetrw.CompressZstd, gnetrw.CompressSnappy, gnetrw.CompressGzip),
+		gnetrw.WithTracing(&gnetrw.SimpleTracer{OnEnd: func(span gnetrw.FinishedSpan) {
+			log.Printf("span %s trace=%x parent=%x took %v", span.Name, span.Context.TraceID, span.ParentID, span.End.Sub(span.Start))
+		}}, nil),
+		gnetrw.WithHandshake(gnetrw.HandshakeConfig{
+			Accept: func(c *gnetrw.Conn, hello *gnetrw.Hello) error {
+				log.Printf("client %q connected with protocol v%d", hello.Name, hello.Version)
+				c.SetTag("client", hello.Name)
+				return nil
+			},
+		}),
+	}
+	if limits.Max > 0 || limits.PerUID > 0 || limits.Soft > 0 {
+		opts = append(opts, gnetrw.WithAdmission(limits))
+	}
+	if *rate > 0 {
+		opts = append(opts, gnetrw.WithRateLimit(gnetrw.RateLimits{
+			PerConn: gnetrw.Rate{Frames: *rate},
+			Action:  gnetrw.RateReply,
+		}))
+	}
+	if flow.Window > 0 {
+		opts = append(opts, gnetrw.WithFlowControl(flow))
+	}
+	if *resume > 0 {
+		opts = append(opts, gnetrw.WithSessionResumption(*resume, 0))
+	}
+	if *workers > 0 {
+		pool, err := ants.NewPool(*workers, ants.WithNonblocking(true))
+		if err != nil {
+			log.Fatalf("Failed to create worker pool: %v\n", err)
+		}
+		defer pool.Release()
+		opts = append(opts, gnetrw.WithWorkerPool(pool, 0))
+	}
+	server := gnetrw.NewServer(address, router.Handle, opts...)
+
+	if *diagAddr != "" {
+		d := diag.New(*diagAddr,
+			diag.WithMetrics(reg),
+			diag.WithConnections(func() any { return server.Connections() }),
+		)
+		if err := d.Start(); err != nil {
+			log.Fatalf("Failed to start diagnostics: %v\n", err)
+		}
+		defer d.Shutdown(context.Background())
+		log.Printf("Diagnostics listening on %s\n", *diagAddr)
+	}
+
+	if *notify > 0 {
+		go func() {
+			for now := range time.Tick(*notify) {
+				n, err := server.Broadcast(nil, []byte("notice: server time "+now.Format(time.TimeOnly)+"\n"))
+				if err != nil {
+					log.Printf("Failed to broadcast notice: %v\n", err)
+				}
+				log.Printf("notice sent to %d clients", n)
+			}
+		}()
+	}
+
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		<-sigs
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Stop(ctx)
+	}()
+
+	err := server.Run(gnet.WithMulticore(true), gnet.WithReusePort(true))
+	if err != nil {
+		log.Printf("Failed to start server: %v\n", err)
+	}
+}
@@ -2,17 +2,39 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"net"
-	"net/http"
-	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"unixsocket/pkg/admission"
+	"unixsocket/pkg/diag"
 )
 
-func main() {
+type connInfo struct {
+	Addr  string    `json:"addr"`
+	Since time.Time `json:"since"`
+}
 
-	fmt.Println("run pprof", ":8801")
-	go http.ListenAndServe(":8801", nil)
+var conns sync.Map // net.Conn -> connInfo
+
+var admit *admission.Controller[net.Conn]
+
+func main() {
+	diagAddr := flag.String("diag", "", `diagnostics address, "127.0.0.1:8801" or "unix:///tmp/server-diag.sock", disabled when empty`)
+	var limits admission.Limits
+	flag.IntVar(&limits.Max, "max-conns", 0, "refuse connections above this number, unlimited when 0")
+	flag.IntVar(&limits.PerUID, "max-conns-per-uid", 0, "refuse connections of a peer uid above this number, unlimited when 0")
+	flag.IntVar(&limits.Soft, "soft-conns", 0, "evict the connections idle the longest above this number, disabled when 0")
+	flag.DurationVar(&limits.IdleAfter, "idle-after", admission.DefaultIdleAfter, "quiet time before a connection can be evicted")
+	flag.Parse()
+	admit = admission.New[net.Conn](limits)
 
 	socketPath := "/tmp/codesocket.tmp"
 
@@ -30,21 +52,80 @@ func main() {
 	}
 	defer listener.Close()
 
+	if *diagAddr != "" {
+		d := diag.New(*diagAddr, diag.WithConnections(func() any {
+			var list []connInfo
+			conns.Range(func(_, v any) bool {
+				list = append(list, v.(connInfo))
+				return true
+			})
+			return list
+		}))
+		if err := d.Start(); err != nil {
+			fmt.Printf("Failed to start diagnostics: %v\n", err)
+			return
+		}
+		defer d.Shutdown(context.Background())
+		fmt.Printf("Diagnostics listening on %s\n", *diagAddr)
+	}
+
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		<-sigs
+		listener.Close()
+	}()
+
+	// 定时驱逐空闲连接, 不只在新连接到来时
+	go func() {
+		for range time.Tick(time.Second) {
+			evict()
+		}
+	}()
+
 	fmt.Printf("Server listening on %s\n", socketPath)
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				fmt.Println("Server closed")
+				return
+			}
 			fmt.Printf("Failed to accept connection: %v\n", err)
 			continue
 		}
 
-		go handleConnection(conn)
+		uid := -1
+		if sc, ok := conn.(syscall.Conn); ok {
+			uid = admission.ConnUID(sc)
+		}
+		entry, err := admit.Admit(conn, uid, time.Now())
+		if err != nil {
+			fmt.Printf("Reject connection: %v\n", err)
+			fmt.Fprintf(conn, "Rejected: %v\n", err)
+			conn.Close()
+			continue
+		}
+		evict()
+
+		go handleConnection(conn, entry)
+	}
+}
+
+// evict closes the connections idle the longest above the soft limit.
+func evict() {
+	for _, victim := range admit.Evict(time.Now()) {
+		fmt.Println("Evict idle connection")
+		victim.Close()
 	}
 }
 
-func handleConnection(conn net.Conn) {
+func handleConnection(conn net.Conn, entry *admission.Entry) {
 	defer conn.Close()
+	defer admit.Release(conn)
+	conns.Store(conn, connInfo{Addr: conn.RemoteAddr().String(), Since: time.Now()})
+	defer conns.Delete(conn)
 
 	fmt.Println("Client connected")
 	reader := bufio.NewReader(conn)
@@ -59,6 +140,7 @@ func handleConnection(conn net.Conn) {
 		}
 
 		fmt.Printf("Received: %s", message)
+		entry.Touch(time.Now())
 
 		// 向客户端发送数据
 		response := fmt.Sprintf("Echo: %s", message)
@@ -3,17 +3,19 @@ module unixsocket
 go 1.23.2
 
 require (
+	github.com/klauspost/compress v1.17.11
+	github.com/panjf2000/ants/v2 v2.10.0
 	github.com/panjf2000/gnet/v2 v2.6.3
 	golang.org/x/exp v0.0.0-20241217172543-b2144cdd0a67
+	golang.org/x/sys v0.25.0
+	google.golang.org/protobuf v1.35.2
 )
 
 require (
-	github.com/panjf2000/ants/v2 v2.10.0 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/multierr v1.6.0 // indirect
 	go.uber.org/zap v1.21.0 // indirect
 	golang.org/x/sync v0.10.0 // indirect
-	golang.org/x/sys v0.25.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
 )
@@ -0,0 +1,154 @@
+// Package admission caps the connections a server accepts, in total and per peer uid,
+// and picks the idle connections to evict above a soft limit.
+package admission
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrTooManyConns  = errors.New("too many connections")
+	ErrTooManyForUID = errors.New("too many connections for uid")
+)
+
+// DefaultIdleAfter is how long a connection must be quiet to be evicted.
+const DefaultIdleAfter = time.Minute
+
+// Limits of a Controller, zero values disable a limit.
+type Limits struct {
+	Max       int           // open connections, new ones are rejected above it
+	PerUID    int           // open connections of one peer uid
+	Soft      int           // above it the oldest idle connections are evicted
+	IdleAfter time.Duration // quiet time before a connection counts as idle, 0 uses DefaultIdleAfter
+}
+
+// Entry is an admitted connection.
+type Entry struct {
+	UID     int // -1 when unknown
+	Since   time.Time
+	active  atomic.Int64 // unix nanoseconds of the last activity
+	evicted bool         // returned by Evict, guarded by Controller.mu
+}
+
+// Touch records activity on the connection, it is safe for concurrent use.
+func (e *Entry) Touch(now time.Time) { e.active.Store(now.UnixNano()) }
+
+// LastActive returns the time of the last activity.
+func (e *Entry) LastActive() time.Time { return time.Unix(0, e.active.Load()) }
+
+// Controller tracks the connections of a server keyed by K. It is safe for concurrent use.
+type Controller[K comparable] struct {
+	limits  Limits
+	mu      sync.Mutex
+	conns   map[K]*Entry
+	uids    map[int]int
+	evicted int // entries returned by Evict and not released yet
+}
+
+func New[K comparable](l Limits) *Controller[K] {
+	if l.IdleAfter <= 0 {
+		l.IdleAfter = DefaultIdleAfter
+	}
+	return &Controller[K]{limits: l, conns: make(map[K]*Entry), uids: make(map[int]int)}
+}
+
+// Admit registers k for a peer uid, -1 when unknown. The error explains a refusal and
+// can be sent to the peer.
+func (c *Controller[K]) Admit(k K, uid int, now time.Time) (*Entry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.limits.Max > 0 && len(c.conns) >= c.limits.Max {
+		return nil, fmt.Errorf("%w, limit %d", ErrTooManyConns, c.limits.Max)
+	}
+	if uid >= 0 && c.limits.PerUID > 0 && c.uids[uid] >= c.limits.PerUID {
+		return nil, fmt.Errorf("%w %d, limit %d", ErrTooManyForUID, uid, c.limits.PerUID)
+	}
+	e := &Entry{UID: uid, Since: now}
+	e.Touch(now)
+	c.conns[k] = e
+	if uid >= 0 {
+		c.uids[uid]++
+	}
+	return e, nil
+}
+
+// Release forgets k, it is a no-op for keys that were not admitted.
+func (c *Controller[K]) Release(k K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.conns[k]
+	if !ok {
+		return
+	}
+	delete(c.conns, k)
+	if e.evicted {
+		c.evicted--
+	}
+	if e.UID >= 0 {
+		if c.uids[e.UID]--; c.uids[e.UID] <= 0 {
+			delete(c.uids, e.UID)
+		}
+	}
+}
+
+// Len returns the number of admitted connections.
+func (c *Controller[K]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.conns)
+}
+
+// Evict returns the connections to close to get back to the soft limit, the ones idle
+// the longest first. Only idle connections are picked, so fewer may be returned.
+// The caller closes them and calls Release as usual, until then they count as gone and
+// are not returned again.
+func (c *Controller[K]) Evict(now time.Time) []K {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	over := len(c.conns) - c.evicted - c.limits.Soft
+	if c.limits.Soft <= 0 || over <= 0 {
+		return nil
+	}
+
+	type idle struct {
+		k  K
+		at int64
+	}
+	var list []idle
+	deadline := now.Add(-c.limits.IdleAfter).UnixNano()
+	for k, e := range c.conns {
+		if at := e.active.Load(); at <= deadline && !e.evicted {
+			list = append(list, idle{k, at})
+		}
+	}
+	slices.SortFunc(list, func(a, b idle) int { return cmp.Compare(a.at, b.at) })
+	keys := make([]K, 0, min(over, len(list)))
+	for _, v := range list[:min(over, len(list))] {
+		c.conns[v.k].evicted = true
+		c.evicted++
+		keys = append(keys, v.k)
+	}
+	return keys
+}
+
+// ConnUID returns the peer uid of a connection such as *net.UnixConn, -1 when unknown.
+func ConnUID(c syscall.Conn) int {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return -1
+	}
+	uid := -1
+	_ = raw.Control(func(fd uintptr) {
+		if id, err := PeerUID(int(fd)); err == nil {
+			uid = id
+		}
+	})
+	return uid
+}
@@ -0,0 +1,86 @@
+package admission
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAdmit(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := New[string](Limits{Max: 3, PerUID: 2})
+	for _, k := range []string{"a", "b"} {
+		if _, err := c.Admit(k, 7, now); err != nil {
+			t.Fatalf("Admit(%s) = %v", k, err)
+		}
+	}
+	if _, err := c.Admit("c", 7, now); !errors.Is(err, ErrTooManyForUID) {
+		t.Fatalf("third conn of uid 7: err = %v, want ErrTooManyForUID", err)
+	}
+	if _, err := c.Admit("c", -1, now); err != nil {
+		t.Fatalf("unknown uid: err = %v", err)
+	}
+	if _, err := c.Admit("d", 8, now); !errors.Is(err, ErrTooManyConns) {
+		t.Fatalf("fourth conn: err = %v, want ErrTooManyConns", err)
+	}
+	if c.Len() != 3 {
+		t.Fatalf("Len = %d, want 3", c.Len())
+	}
+
+	c.Release("a")
+	c.Release("a")
+	c.Release("unknown")
+	if c.Len() != 2 {
+		t.Fatalf("Len after release = %d, want 2", c.Len())
+	}
+	if _, err := c.Admit("d", 7, now); err != nil {
+		t.Fatalf("uid 7 after release: err = %v", err)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := New[string](Limits{Soft: 2, IdleAfter: time.Minute})
+	// a idle the longest, c not idle yet
+	for k, quiet := range map[string]time.Duration{"a": 3 * time.Minute, "b": 2 * time.Minute, "c": time.Second, "d": time.Hour / 2} {
+		e, err := c.Admit(k, -1, now.Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Touch(now.Add(-quiet))
+	}
+
+	if got := c.Evict(now); !slices.Equal(got, []string{"d", "a"}) {
+		t.Fatalf("Evict = %q, want [d a]", got)
+	}
+	if got := c.Evict(now); len(got) != 0 {
+		t.Fatalf("Evict again = %q, the evicted ones count as gone", got)
+	}
+	c.Release("d")
+	c.Release("a")
+	if got := c.Evict(now); len(got) != 0 {
+		t.Fatalf("Evict at the soft limit = %q", got)
+	}
+
+	if _, err := c.Admit("e", -1, now); err != nil {
+		t.Fatal(err)
+	}
+	// only b is idle
+	if got := c.Evict(now); !slices.Equal(got, []string{"b"}) {
+		t.Fatalf("Evict above the soft limit = %q, want [b]", got)
+	}
+}
+
+func TestEvictDisabled(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := New[int](Limits{})
+	for i := range 10 {
+		if _, err := c.Admit(i, -1, now.Add(-time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := c.Evict(now); len(got) != 0 {
+		t.Fatalf("Evict without a soft limit = %v", got)
+	}
+}
@@ -0,0 +1,12 @@
+package admission
+
+import "golang.org/x/sys/unix"
+
+// PeerUID returns the uid of the process at the other end of a unix socket.
+func PeerUID(fd int) (int, error) {
+	cred, err := unix.GetsockoptUcred(fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return -1, err
+	}
+	return int(cred.Uid), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package admission
+
+import "errors"
+
+// PeerUID is only available on linux, other systems report an unknown uid.
+func PeerUID(fd int) (int, error) {
+	return -1, errors.ErrUnsupported
+}
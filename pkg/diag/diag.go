@@ -0,0 +1,158 @@
+// Package diag is the opt-in diagnostics HTTP server of the examples:
+// pprof, metrics, the live connection list and health checks.
+package diag
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+	"time"
+
+	"unixsocket/pkg/metrics"
+)
+
+// Server serves the diagnostics endpoints:
+//
+//	/debug/pprof/       runtime profiles
+//	/metrics            Prometheus text format, with WithMetrics
+//	/debug/connections  live connection list as JSON, with WithConnections
+//	/healthz            liveness, always "ok" while serving
+//	/readyz             runs every check added with WithCheck
+type Server struct {
+	addr        string
+	mux         *http.ServeMux
+	srv         *http.Server
+	socketPath  string
+	connections func() any
+	checks      []check
+}
+
+type check struct {
+	name string
+	fn   func() error
+}
+
+type Option func(s *Server)
+
+// WithMetrics serves reg on /metrics.
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(s *Server) { s.mux.Handle("/metrics", reg.Handler()) }
+}
+
+// WithConnections serves the JSON encoding of list() on /debug/connections.
+func WithConnections(list func() any) Option {
+	return func(s *Server) { s.connections = list }
+}
+
+// WithCheck adds a readiness check, /readyz fails while fn returns an error.
+func WithCheck(name string, fn func() error) Option {
+	return func(s *Server) { s.checks = append(s.checks, check{name: name, fn: fn}) }
+}
+
+// New returns a diagnostics server for addr, either "host:port" or a Unix socket
+// path written "unix:///path/to/socket". Binding "127.0.0.1" keeps pprof off other hosts.
+func New(addr string, opts ...Option) *Server {
+	s := &Server{addr: addr, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	s.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	s.mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	s.mux.HandleFunc("/readyz", s.serveReady)
+	s.mux.HandleFunc("/debug/connections", s.serveConnections)
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.srv = &http.Server{Handler: s.mux, ReadHeaderTimeout: 5 * time.Second}
+	return s
+}
+
+// Handle registers an extra handler on the diagnostics mux.
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+// Start listens on the configured address and serves in the background.
+func (s *Server) Start() error {
+	network, address := "tcp", s.addr
+	if path, ok := strings.CutPrefix(s.addr, "unix://"); ok {
+		network, address = "unix", path
+		// 清理旧的 Unix Socket 文件，路径来自参数，其他文件不动
+		if err := removeSocket(path); err != nil {
+			return err
+		}
+		s.socketPath = path
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("diagnostics listen %s, %w", s.addr, err)
+	}
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(os.Stderr, "diagnostics server %s stopped, %v\n", s.addr, err)
+		}
+	}()
+	return nil
+}
+
+// removeSocket removes the socket file a previous run left at path.
+func removeSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("diagnostics listen %s, the file exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+// Shutdown stops serving, waiting for active requests until ctx ends.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.srv.Shutdown(ctx)
+	if s.socketPath != "" {
+		os.Remove(s.socketPath)
+	}
+	return err
+}
+
+func (s *Server) serveReady(w http.ResponseWriter, _ *http.Request) {
+	failed := false
+	var b strings.Builder
+	for _, c := range s.checks {
+		if err := c.fn(); err != nil {
+			failed = true
+			fmt.Fprintf(&b, "%s: %v\n", c.name, err)
+			continue
+		}
+		fmt.Fprintf(&b, "%s: ok\n", c.name)
+	}
+	if failed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprint(w, b.String())
+}
+
+func (s *Server) serveConnections(w http.ResponseWriter, r *http.Request) {
+	if s.connections == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(s.connections())
+}
@@ -0,0 +1,169 @@
+package gnetrw
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Acknowledged delivery. The client numbers its messages in HeaderSeq, from 1 and in
+// the order it sends them, and keeps them until the server acknowledges them. The
+// server answers a header-only frame with HeaderAck once the handler returned nil, and
+// an acknowledgement covers the lower numbers too. After a reconnection the client sends
+// the messages still unacknowledged again, the server skips those it already handled
+// for the same Hello.ClientID. A client numbering from 1 again, after a restart, sends
+// another Hello.Epoch, so that the server forgets the numbers it handled.
+const (
+	HeaderSeq = "seq"
+	HeaderAck = "ack"
+
+	// CapabilityAck is announced in the handshake by the peers using acknowledged delivery.
+	CapabilityAck = "ack"
+)
+
+// DefaultAckRetention is how long the server remembers the last message handled for a
+// client id after its last connection closed.
+const DefaultAckRetention = 10 * time.Minute
+
+// ackState is what the server knows of the messages of one client id.
+type ackState struct {
+	last  atomic.Uint64 // highest number handled
+	epoch string        // Hello.Epoch of last, guarded by Server.ackMu
+	conns int           // connections using it, guarded by Server.ackMu
+	idle  time.Time     // since the last connection closed, guarded by Server.ackMu
+}
+
+// advance records seq as handled and returns the highest number handled.
+func (a *ackState) advance(seq uint64) uint64 {
+	for {
+		last := a.last.Load()
+		if seq <= last || a.last.CompareAndSwap(last, seq) {
+			return max(last, seq)
+		}
+	}
+}
+
+// WithAckedDelivery acknowledges the numbered messages of the clients announcing
+// CapabilityAck, see HeaderSeq. Duplicates are recognized for retention after the last
+// connection of a client id closed, 0 uses DefaultAckRetention. A handler error closes
+// the connection without acknowledging the message, so the client sends it again.
+// Numbered messages over the rate limits are delayed like RateDelay rather than dropped,
+// the acknowledgement of the next ones would cover them.
+func WithAckedDelivery(retention time.Duration) Option {
+	return func(s *Server) {
+		if retention <= 0 {
+			retention = DefaultAckRetention
+		}
+		s.ackRetention = retention
+		s.acks = make(map[string]*ackState)
+	}
+}
+
+// attachAck gives c the state of its client id after the handshake, on the event loop.
+// Clients without id are only deduplicated within the connection.
+func (s *Server) attachAck(c *Conn) {
+	if s.acks == nil || !c.HasCapability(CapabilityAck) {
+		return
+	}
+	id := c.hello.ClientID
+	if id == "" {
+		c.ack = &ackState{}
+		return
+	}
+
+	now := time.Now()
+	s.ackMu.Lock()
+	defer s.ackMu.Unlock()
+	for k, a := range s.acks {
+		if a.conns == 0 && now.Sub(a.idle) > s.ackRetention {
+			delete(s.acks, k)
+		}
+	}
+	a := s.acks[id]
+	if a == nil {
+		a = &ackState{epoch: c.hello.Epoch}
+		s.acks[id] = a
+	}
+	if a.epoch != c.hello.Epoch {
+		s.logger.Info("client numbering restarted", KeyAddr, addrOf(c), KeyClient, c.hello.Name, "last", a.last.Load())
+		a.epoch = c.hello.Epoch
+		a.last.Store(0)
+	}
+	a.conns++
+	c.ack = a
+}
+
+// detachAck starts the retention of the state of c, in OnClose.
+func (s *Server) detachAck(c *Conn) {
+	if c.ack == nil || c.hello.ClientID == "" {
+		return
+	}
+	s.ackMu.Lock()
+	defer s.ackMu.Unlock()
+	if c.ack.conns--; c.ack.conns == 0 {
+		c.ack.idle = time.Now()
+	}
+}
+
+// seqOf returns the number of f, 0 when it has none.
+func seqOf(f *Frame) (uint64, error) {
+	v := f.Header.Get(HeaderSeq)
+	if v == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || seq == 0 {
+		return 0, fmt.Errorf("%w: bad %s %q", ErrMalformedHeader, HeaderSeq, v)
+	}
+	return seq, nil
+}
+
+// duplicate reports whether f was already handled, and acknowledges it again.
+func (s *Server) duplicate(c *Conn, f *Frame) (bool, error) {
+	seq, err := seqOf(f)
+	if err != nil || seq == 0 {
+		return false, err
+	}
+	last := c.ack.last.Load()
+	if seq > last {
+		return false, nil
+	}
+	s.metrics.DuplicateFrames.Add(1)
+	s.logger.Debug("skip duplicate", KeyAddr, addrOf(c), HeaderSeq, seq, "last", last)
+	return true, s.sendAck(c, last)
+}
+
+// acknowledge tells the client that f was handled, it is safe to call from any goroutine.
+func (s *Server) acknowledge(c *Conn, f *Frame) error {
+	if c.ack == nil {
+		return nil
+	}
+	seq, err := seqOf(f)
+	if err != nil || seq == 0 {
+		return err
+	}
+	s.metrics.AckedFrames.Add(1)
+	return s.sendAck(c, c.ack.advance(seq))
+}
+
+func (s *Server) sendAck(c *Conn, seq uint64) error {
+	buf, err := PackFrame(&Frame{Header: Header{HeaderAck: strconv.FormatUint(seq, 10)}})
+	if err != nil {
+		return err
+	}
+	if err := c.AsyncWrite(buf, nil); err != nil {
+		return ErrConnClosed
+	}
+	return nil
+}
+
+// AckOf returns the number acknowledged by a frame from the server, 0 when f is not
+// an acknowledgement.
+func AckOf(f *Frame) uint64 {
+	if len(f.Payload) > 0 {
+		return 0
+	}
+	seq, _ := strconv.ParseUint(f.Header.Get(HeaderAck), 10, 64)
+	return seq
+}
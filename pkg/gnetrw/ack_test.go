@@ -0,0 +1,116 @@
+package gnetrw
+
+import (
+	"strconv"
+	"testing"
+)
+
+func numbered(seq uint64) *Frame {
+	return &Frame{Header: Header{HeaderSeq: strconv.FormatUint(seq, 10)}, Payload: []byte("m")}
+}
+
+func TestAckStateAdvance(t *testing.T) {
+	tests := []struct {
+		seqs []uint64
+		want uint64
+	}{
+		{[]uint64{1}, 1},
+		{[]uint64{1, 2, 3}, 3},
+		{[]uint64{3, 1, 2}, 3},
+		{[]uint64{5, 5}, 5},
+		{[]uint64{2, 10, 4}, 10},
+	}
+	for _, tt := range tests {
+		var a ackState
+		var got uint64
+		for _, seq := range tt.seqs {
+			got = a.advance(seq)
+		}
+		if got != tt.want || a.last.Load() != tt.want {
+			t.Errorf("advance %v = %d, last %d, want %d", tt.seqs, got, a.last.Load(), tt.want)
+		}
+	}
+}
+
+func TestSeqOf(t *testing.T) {
+	tests := []struct {
+		value string
+		want  uint64
+		ok    bool
+	}{
+		{"", 0, true},
+		{"1", 1, true},
+		{"18446744073709551615", 1<<64 - 1, true},
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"x", 0, false},
+	}
+	for _, tt := range tests {
+		f := &Frame{Header: Header{}}
+		if tt.value != "" {
+			f.Header.Set(HeaderSeq, tt.value)
+		}
+		got, err := seqOf(f)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("seqOf(%q) = %d, %v, want %d, ok %v", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	s := NewServer("", nil, WithLogger(Discard), WithHandshake(HandshakeConfig{}), WithAckedDelivery(0))
+	tests := []struct {
+		name  string
+		hello Hello
+		epoch string   // of the next connection, the client restarted when it changes
+		seqs  []uint64 // handled before the connection closes
+		sent  []uint64 // sent on the next connection
+		dups  []bool
+	}{
+		{"in order", Hello{ClientID: "a", Epoch: "1"}, "1", []uint64{1, 2}, []uint64{3, 4}, []bool{false, false}},
+		{"resent", Hello{ClientID: "b", Epoch: "1"}, "1", []uint64{1, 2, 3}, []uint64{2, 3, 4}, []bool{true, true, false}},
+		{"new epoch", Hello{ClientID: "c", Epoch: "1"}, "2", []uint64{1, 2, 3}, []uint64{1, 2}, []bool{false, false}},
+		{"no client id", Hello{}, "", []uint64{1, 2}, []uint64{1, 2}, []bool{false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello := tt.hello
+			c, _ := newTestConn(s, &hello, CapabilityAck)
+			s.attachAck(c)
+			for _, seq := range tt.seqs {
+				if err := s.acknowledge(c, numbered(seq)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.detachAck(c)
+
+			next := tt.hello
+			next.Epoch = tt.epoch
+			c, fc := newTestConn(s, &next, CapabilityAck)
+			s.attachAck(c)
+			defer s.detachAck(c)
+			for i, seq := range tt.sent {
+				dup, err := s.duplicate(c, numbered(seq))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if dup != tt.dups[i] {
+					t.Errorf("duplicate(%d) = %v, want %v", seq, dup, tt.dups[i])
+				}
+				if !dup {
+					if err := s.acknowledge(c, numbered(seq)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			// every message is acknowledged, duplicates with the highest number handled
+			frames := fc.frames(t)
+			if len(frames) != len(tt.sent) {
+				t.Fatalf("%d acknowledgements, want %d", len(frames), len(tt.sent))
+			}
+			if ack := AckOf(frames[len(frames)-1]); ack != tt.sent[len(tt.sent)-1] {
+				t.Errorf("last acknowledgement %d, want %d", ack, tt.sent[len(tt.sent)-1])
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package gnetrw
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+
+	"unixsocket/pkg/admission"
+)
+
+// reject opens a connection refused by the admission limits and decodes its answer.
+func reject(t *testing.T, s *Server) (*fakeConn, *Frame) {
+	t.Helper()
+	fc := &fakeConn{}
+	out, action := s.OnOpen(fc)
+	if action != gnet.Close {
+		t.Fatalf("OnOpen = %v, want Close", action)
+	}
+	if connOf(fc).mux != nil {
+		t.Fatal("rejected connection has a mux session")
+	}
+	f, err := ReadMessage(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("reject frame: %v", err)
+	}
+	return fc, f
+}
+
+func TestAdmissionReject(t *testing.T) {
+	mux := WithMux(func(ctx context.Context, c *Conn, st *Stream) error { return nil }, MuxConfig{})
+
+	t.Run("without handshake", func(t *testing.T) {
+		s := NewServer("", nil, WithAdmission(admission.Limits{Max: 1}), mux)
+		openConn(t, s)
+		_, f := reject(t, s)
+		e := DecodeError(f)
+		if e == nil || e.Code != CodeUnavailable || e.Message == "" {
+			t.Fatalf("reject frame = %+v, want a CodeUnavailable error with a reason", e)
+		}
+		if !errors.Is(e, ErrRetryLater) {
+			t.Fatalf("%v does not match ErrRetryLater", e)
+		}
+	})
+
+	t.Run("with handshake", func(t *testing.T) {
+		s := NewServer("", nil, WithAdmission(admission.Limits{Max: 1}), WithHandshake(HandshakeConfig{}), mux)
+		openConn(t, s)
+		_, f := reject(t, s)
+		w, err := ParseWelcome(f.Payload)
+		if !errors.Is(err, ErrRetryLater) || w.Reason == "" {
+			t.Fatalf("ParseWelcome = %+v, %v, want a retry with a reason", w, err)
+		}
+	})
+}
+
+func TestAdmissionEvictOnTick(t *testing.T) {
+	s := NewServer("", nil, WithAdmission(admission.Limits{Soft: 1, IdleAfter: time.Minute}))
+	idle, idleFc := openConn(t, s)
+	_, busyFc := openConn(t, s)
+	if idleFc.isClosed() || busyFc.isClosed() {
+		t.Fatal("connection evicted before being idle")
+	}
+
+	idle.entry.Touch(time.Now().Add(-time.Hour))
+	if delay, action := s.OnTick(); delay != evictInterval || action != gnet.None {
+		t.Fatalf("OnTick = %v, %v", delay, action)
+	}
+	if !idleFc.isClosed() || busyFc.isClosed() {
+		t.Fatalf("after a tick: idle closed %v, busy closed %v", idleFc.isClosed(), busyFc.isClosed())
+	}
+	if cause := idle.cause.Load(); cause == nil || *cause != ErrEvicted {
+		t.Fatalf("close reason = %v, want ErrEvicted", cause)
+	}
+
+	// picked once, it is not closed again before OnClose releases it
+	idleFc.closed = false
+	s.OnTick()
+	if idleFc.isClosed() {
+		t.Fatal("evicted connection closed twice")
+	}
+}
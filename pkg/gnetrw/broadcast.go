@@ -0,0 +1,168 @@
+package gnetrw
+
+import (
+	"errors"
+	"maps"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// SetTag labels c with key=value, for SendWhere and the connection list.
+// Tags are safe to use from any goroutine.
+func (c *Conn) SetTag(key, value string) {
+	c.tagMu.Lock()
+	defer c.tagMu.Unlock()
+	if c.tags == nil {
+		c.tags = make(map[string]string)
+	}
+	c.tags[key] = value
+}
+
+// Tag returns the value of a tag set with SetTag, "" when unset.
+func (c *Conn) Tag(key string) string {
+	c.tagMu.RLock()
+	defer c.tagMu.RUnlock()
+	return c.tags[key]
+}
+
+// DelTag removes a tag.
+func (c *Conn) DelTag(key string) {
+	c.tagMu.Lock()
+	defer c.tagMu.Unlock()
+	delete(c.tags, key)
+}
+
+// Tags returns a copy of the tags of c, nil when it has none.
+func (c *Conn) Tags() map[string]string {
+	c.tagMu.RLock()
+	defer c.tagMu.RUnlock()
+	if len(c.tags) == 0 {
+		return nil
+	}
+	return maps.Clone(c.tags)
+}
+
+// HasTag selects the connections tagged key=value, see SendWhere.
+func HasTag(key, value string) func(c *Conn) bool {
+	return func(c *Conn) bool { return c.Tag(key) == value }
+}
+
+// Broadcast sends payload with header h to every connection that completed the
+// handshake, see SendWhere.
+func (s *Server) Broadcast(h Header, payload []byte) (int, error) {
+	return s.SendWhere(nil, h, payload)
+}
+
+// SendTo sends payload with header h to the connection with the given ID, see Conn.ID.
+// It fails with ErrConnClosed when there is no such connection ready for frames, and
+// with ErrHeaderNotSupported when h is not empty and the peer cannot read headers.
+func (s *Server) SendTo(id uint64, h Header, payload []byte) error {
+	s.mu.RLock()
+	c := s.conns[id]
+	ready := c != nil && s.ready(c)
+	s.mu.RUnlock()
+	if !ready {
+		return ErrConnClosed
+	}
+	if len(h) > 0 && !c.SupportsHeaders() {
+		return ErrHeaderNotSupported
+	}
+	if c.session != nil {
+		_, err := c.session.write(c, h, payload)
+		return err
+	}
+	return s.asyncWrite(c, newFramePacker(&Frame{Header: h, Payload: payload}))
+}
+
+// SendWhere sends payload with header h to the connections match returns true for,
+// all of them when match is nil, and returns how many it was queued for.
+// Connections still in the handshake are skipped, and so are the peers that cannot read
+// headers when h is not empty. It is safe to call from any goroutine, the frames are
+// written with AsyncWrite.
+func (s *Server) SendWhere(match func(c *Conn) bool, h Header, payload []byte) (int, error) {
+	s.mu.RLock()
+	targets := make([]*Conn, 0, len(s.conns))
+	for _, c := range s.conns {
+		if s.ready(c) {
+			targets = append(targets, c)
+		}
+	}
+	s.mu.RUnlock()
+
+	p := newFramePacker(&Frame{Header: h, Payload: payload})
+	sent := 0
+	for _, c := range targets {
+		if match != nil && !match(c) {
+			continue
+		}
+		if len(h) > 0 && !c.SupportsHeaders() {
+			continue
+		}
+		write := func() error { return s.asyncWrite(c, p) }
+		if c.session != nil {
+			// numbered for each client, so packed for each
+			write = func() error {
+				_, err := c.session.write(c, h, payload)
+				return err
+			}
+		}
+		if err := write(); err != nil {
+			if errors.Is(err, ErrConnClosed) {
+				continue
+			}
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// ready reports whether c may receive frames, it must be called with s.mu held.
+func (s *Server) ready(c *Conn) bool {
+	return s.handshake == nil || c.welcome != nil
+}
+
+func (s *Server) asyncWrite(c *Conn, p *framePacker) error {
+	buf, err := p.pack(c)
+	if err != nil {
+		return err
+	}
+	err = c.AsyncWrite(buf, func(_ gnet.Conn, err error) error {
+		if err == nil {
+			s.metrics.FrameOut(len(buf) - 4)
+		}
+		return nil
+	})
+	if err != nil {
+		return ErrConnClosed
+	}
+	return nil
+}
+
+// framePacker packs a frame sent to many connections once per negotiated compression.
+type framePacker struct {
+	f    *Frame
+	bufs map[Compressor][]byte
+}
+
+func newFramePacker(f *Frame) *framePacker {
+	return &framePacker{f: f, bufs: make(map[Compressor][]byte, 1)}
+}
+
+// pack returns the frame encoded for c, the buffer is shared and must not be modified.
+func (p *framePacker) pack(c *Conn) ([]byte, error) {
+	comp := c.Compressor()
+	if buf, ok := p.bufs[comp]; ok {
+		return buf, nil
+	}
+	f, err := comp.Compress(p.f)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := PackFrame(f)
+	if err != nil {
+		return nil, err
+	}
+	p.bufs[comp] = buf
+	return buf, nil
+}
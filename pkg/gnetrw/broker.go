@@ -0,0 +1,363 @@
+package gnetrw
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/panjf2000/gnet/v2"
+
+	"unixsocket/pkg/metrics"
+)
+
+// Message types of the publish/subscribe protocol, the topic is in HeaderTopic.
+const (
+	TypeSubscribe   = "subscribe"   // client -> server, the topic is a pattern
+	TypeUnsubscribe = "unsubscribe" // client -> server, the same pattern as subscribed
+	TypePublish     = "publish"     // client -> server
+	TypeMessage     = "message"     // server -> subscribers, a published payload
+)
+
+// DefaultSubscriberBuffer is the number of bytes a subscriber may have waiting to be
+// written before it is disconnected as a slow consumer.
+const DefaultSubscriberBuffer = 4 << 20
+
+// Broker fans published messages out to the connections subscribed to their topic.
+// It is safe for concurrent use, messages are written with AsyncWrite.
+//
+// Topics are dot-separated, such as "orders.eu.created". In subscription patterns
+// "*" matches exactly one segment and a trailing ">" one or more, so "orders.*.created"
+// and "orders.>" both match the topic above.
+type Broker struct {
+	buffer  int
+	logger  Logger
+	metrics *BrokerMetrics
+
+	mu    sync.RWMutex
+	exact map[string]map[*subscriber]struct{}
+	wild  map[string]map[*subscriber]struct{}
+	subs  map[*Conn]*subscriber
+}
+
+type subscriber struct {
+	conn     *Conn
+	patterns map[string]struct{} // guarded by Broker.mu
+	queued   atomic.Int64        // bytes handed to AsyncWrite, not yet on the event loop
+	slow     atomic.Bool
+}
+
+type BrokerOption func(b *Broker)
+
+// WithSubscriberBuffer sets the bytes a subscriber may have waiting, besides the
+// message being sent, before it is disconnected with ErrSlowConsumer.
+// 0 uses DefaultSubscriberBuffer.
+func WithSubscriberBuffer(n int) BrokerOption {
+	return func(b *Broker) { b.buffer = n }
+}
+
+// WithBrokerLogger sets the broker logger, DefaultLogger is used otherwise.
+func WithBrokerLogger(l Logger) BrokerOption {
+	return func(b *Broker) { b.logger = l }
+}
+
+// WithBrokerMetrics reports the broker measurements to m, see BrokerMetrics.
+func WithBrokerMetrics(m metrics.Metrics) BrokerOption {
+	return func(b *Broker) { b.metrics = NewBrokerMetrics(m, "unixsocket_broker") }
+}
+
+func NewBroker(opts ...BrokerOption) *Broker {
+	b := &Broker{
+		exact: make(map[string]map[*subscriber]struct{}),
+		wild:  make(map[string]map[*subscriber]struct{}),
+		subs:  make(map[*Conn]*subscriber),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.buffer <= 0 {
+		b.buffer = DefaultSubscriberBuffer
+	}
+	if b.logger == nil {
+		b.logger = DefaultLogger()
+	}
+	if b.metrics == nil {
+		b.metrics = NewBrokerMetrics(metrics.Nop, "")
+	}
+	return b
+}
+
+// Register routes the subscribe, unsubscribe and publish frames of r to b, mw run
+// inside the router middlewares. A bad topic is answered with a CodeBadRequest error frame.
+// The subscriptions of a connection are removed when it closes.
+func (b *Broker) Register(r *Router, mw ...Middleware) {
+	r.HandleFunc(TypeSubscribe, func(_ context.Context, c *Conn, f *Frame) error {
+		return badRequest(b.Subscribe(c, f.Header.Get(HeaderTopic)))
+	}, mw...)
+	r.HandleFunc(TypeUnsubscribe, func(_ context.Context, c *Conn, f *Frame) error {
+		return badRequest(b.Unsubscribe(c, f.Header.Get(HeaderTopic)))
+	}, mw...)
+	r.HandleFunc(TypePublish, func(_ context.Context, c *Conn, f *Frame) error {
+		_, err := b.Publish(f.Header.Get(HeaderTopic), f.Header, f.Payload)
+		return badRequest(err)
+	}, mw...)
+}
+
+func badRequest(err error) error {
+	if errors.Is(err, ErrBadTopic) {
+		return &RouteError{Code: CodeBadRequest, Message: err.Error()}
+	}
+	return err
+}
+
+// Subscribe delivers the messages of the topics matching pattern to c, until it
+// unsubscribes or closes. Subscribing twice to the same pattern is a no-op.
+func (b *Broker) Subscribe(c *Conn, pattern string) error {
+	if err := checkTopic(pattern, true); err != nil {
+		return err
+	}
+	if !c.SupportsHeaders() {
+		return ErrHeaderNotSupported
+	}
+	if b.subscribe(c, pattern) {
+		// outside b.mu, Remove runs right away when c is already closed
+		c.whenClosed(b, func() { b.Remove(c) })
+	}
+	return nil
+}
+
+// subscribe adds pattern to the subscriptions of c, reporting whether it is its first.
+func (b *Broker) subscribe(c *Conn, pattern string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.subs[c]
+	first := s == nil
+	if first {
+		s = &subscriber{conn: c, patterns: make(map[string]struct{})}
+		b.subs[c] = s
+	}
+	if _, ok := s.patterns[pattern]; ok {
+		return first
+	}
+	s.patterns[pattern] = struct{}{}
+	index := b.indexOf(pattern)
+	set := index[pattern]
+	if set == nil {
+		set = make(map[*subscriber]struct{})
+		index[pattern] = set
+	}
+	set[s] = struct{}{}
+	b.metrics.Subscriptions.Add(1)
+	b.logger.Debug("subscribed", KeyAddr, addrOf(c), KeyTopic, pattern)
+	return first
+}
+
+// Unsubscribe cancels a pattern passed to Subscribe, unknown patterns are ignored.
+func (b *Broker) Unsubscribe(c *Conn, pattern string) error {
+	if err := checkTopic(pattern, true); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s := b.subs[c]; s != nil {
+		b.unsubscribe(s, pattern)
+		if len(s.patterns) == 0 {
+			delete(b.subs, c)
+		}
+	}
+	return nil
+}
+
+// Remove cancels every subscription of c. It runs when c closes, and when its writes fail.
+func (b *Broker) Remove(c *Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.subs[c]
+	if s == nil {
+		return
+	}
+	for pattern := range s.patterns {
+		b.unsubscribe(s, pattern)
+	}
+	delete(b.subs, c)
+}
+
+// unsubscribe must be called with b.mu held.
+func (b *Broker) unsubscribe(s *subscriber, pattern string) {
+	if _, ok := s.patterns[pattern]; !ok {
+		return
+	}
+	delete(s.patterns, pattern)
+	index := b.indexOf(pattern)
+	delete(index[pattern], s)
+	if len(index[pattern]) == 0 {
+		delete(index, pattern)
+	}
+	b.metrics.Subscriptions.Add(-1)
+	b.logger.Debug("unsubscribed", KeyAddr, addrOf(s.conn), KeyTopic, pattern)
+}
+
+func (b *Broker) indexOf(pattern string) map[string]map[*subscriber]struct{} {
+	if strings.ContainsAny(pattern, "*>") {
+		return b.wild
+	}
+	return b.exact
+}
+
+// Publish sends payload to the subscribers of topic as a TypeMessage frame carrying the
+// other entries of h, and returns how many it was handed to. It is safe to call from
+// any goroutine.
+func (b *Broker) Publish(topic string, h Header, payload []byte) (int, error) {
+	if err := checkTopic(topic, false); err != nil {
+		return 0, err
+	}
+
+	b.mu.RLock()
+	targets := make([]*subscriber, 0, len(b.exact[topic]))
+	for s := range b.exact[topic] {
+		targets = append(targets, s)
+	}
+	wild := false
+	for pattern, set := range b.wild {
+		if matchTopic(pattern, topic) {
+			wild = true
+			for s := range set {
+				targets = append(targets, s)
+			}
+		}
+	}
+	b.mu.RUnlock()
+	b.metrics.Published.Add(1)
+	if wild {
+		// a connection may match several patterns
+		slices.SortFunc(targets, func(a, b *subscriber) int { return cmp.Compare(a.conn.id, b.conn.id) })
+		targets = slices.Compact(targets)
+	}
+
+	h = h.Clone()
+	if h == nil {
+		h = Header{}
+	}
+	h.Set(HeaderType, TypeMessage)
+	h.Set(HeaderTopic, topic)
+	p := newFramePacker(&Frame{Header: h, Payload: payload})
+	delivered := 0
+	for _, s := range targets {
+		buf, err := p.pack(s.conn)
+		if err != nil {
+			return delivered, err
+		}
+		if b.deliver(s, buf) {
+			delivered++
+		}
+	}
+	b.metrics.Delivered.Add(int64(delivered))
+	return delivered, nil
+}
+
+// deliver queues buf for s and disconnects it when its backlog is over the buffer limit.
+func (b *Broker) deliver(s *subscriber, buf []byte) bool {
+	if s.slow.Load() {
+		return false
+	}
+	n := int64(len(buf))
+	if queued := s.queued.Add(n) - n; queued > int64(b.buffer) {
+		s.queued.Add(-n)
+		b.disconnectSlow(s, queued)
+		return false
+	}
+	err := s.conn.AsyncWrite(buf, func(c gnet.Conn, err error) error {
+		// on the event loop, so the outbound buffer can be read
+		s.queued.Add(-n)
+		if err != nil {
+			b.Remove(s.conn)
+			return nil
+		}
+		s.conn.srv.metrics.FrameOut(len(buf) - 4)
+		if pending := int64(c.OutboundBuffered()) - n + s.queued.Load(); pending > int64(b.buffer) {
+			b.disconnectSlow(s, pending)
+		}
+		return nil
+	})
+	if err != nil {
+		s.queued.Add(-n)
+		b.Remove(s.conn)
+		return false
+	}
+	return true
+}
+
+func (b *Broker) disconnectSlow(s *subscriber, pending int64) {
+	if !s.slow.CompareAndSwap(false, true) {
+		return
+	}
+	b.metrics.SlowConsumers.Add(1)
+	b.logger.Warn("disconnect slow consumer", KeyAddr, addrOf(s.conn), "pending", pending, "limit", b.buffer)
+	b.Remove(s.conn)
+	_ = s.conn.CloseWithError(fmt.Errorf("%w: %d bytes pending", ErrSlowConsumer, pending))
+}
+
+// checkTopic validates a published topic, or a subscription pattern when wild is set.
+func checkTopic(topic string, wild bool) error {
+	if topic == "" {
+		return fmt.Errorf("%w: empty topic", ErrBadTopic)
+	}
+	segments := strings.Split(topic, ".")
+	for i, seg := range segments {
+		switch {
+		case seg == "":
+			return fmt.Errorf("%w: empty segment in %q", ErrBadTopic, topic)
+		case seg == "*" || seg == ">":
+			if !wild {
+				return fmt.Errorf("%w: wildcard in published topic %q", ErrBadTopic, topic)
+			}
+			if seg == ">" && i != len(segments)-1 {
+				return fmt.Errorf("%w: \">\" must be the last segment of %q", ErrBadTopic, topic)
+			}
+		case strings.ContainsAny(seg, "*>"):
+			return fmt.Errorf("%w: wildcard inside segment %q", ErrBadTopic, seg)
+		}
+	}
+	return nil
+}
+
+// matchTopic reports whether a valid topic matches pattern.
+func matchTopic(pattern, topic string) bool {
+	for {
+		p, prest, pmore := strings.Cut(pattern, ".")
+		if p == ">" {
+			return true
+		}
+		t, trest, tmore := strings.Cut(topic, ".")
+		if p != "*" && p != t {
+			return false
+		}
+		if !pmore || !tmore {
+			return pmore == tmore
+		}
+		pattern, topic = prest, trest
+	}
+}
+
+// Subscribe asks the server to deliver the messages of the topics matching pattern,
+// they arrive as TypeMessage frames with their topic in HeaderTopic.
+func Subscribe(ctx context.Context, w MessageWriter, pattern string) error {
+	_, err := w.WriteMessage(ctx, Header{HeaderType: TypeSubscribe, HeaderTopic: pattern}, nil)
+	return err
+}
+
+// Unsubscribe cancels a pattern passed to Subscribe.
+func Unsubscribe(ctx context.Context, w MessageWriter, pattern string) error {
+	_, err := w.WriteMessage(ctx, Header{HeaderType: TypeUnsubscribe, HeaderTopic: pattern}, nil)
+	return err
+}
+
+// Publish sends payload to the subscribers of topic.
+func Publish(ctx context.Context, w MessageWriter, topic string, payload []byte) error {
+	_, err := w.WriteMessage(ctx, Header{HeaderType: TypePublish, HeaderTopic: topic}, payload)
+	return err
+}
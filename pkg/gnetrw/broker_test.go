@@ -0,0 +1,159 @@
+package gnetrw
+
+import (
+	"errors"
+	"testing"
+)
+
+// subscribe sends the frames subscribing fc to patterns.
+func subscribe(t *testing.T, s *Server, fc *fakeConn, typ string, patterns ...string) {
+	t.Helper()
+	for _, p := range patterns {
+		traffic(t, s, fc, &Frame{Header: Header{HeaderType: typ, HeaderTopic: p}})
+	}
+}
+
+func (b *Broker) subscribers() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs)
+}
+
+func TestBrokerPublish(t *testing.T) {
+	r := NewRouter()
+	b := NewBroker(WithBrokerLogger(Discard))
+	b.Register(r)
+	s := NewServer("", r.Handle, WithLogger(Discard))
+	_, fc1 := openConn(t, s)
+	_, fc2 := openConn(t, s)
+	subscribe(t, s, fc1, TypeSubscribe, "orders.*", "orders.>", "orders.*")
+	subscribe(t, s, fc2, TypeSubscribe, "orders.eu")
+
+	if n, err := b.Publish("orders.eu", Header{"k": "v"}, []byte("x")); n != 2 || err != nil {
+		t.Fatalf("Publish = %d, %v, want 2", n, err)
+	}
+	got := fc1.frames(t)
+	if len(got) != 1 {
+		t.Fatalf("subscriber of two matching patterns got %d frames, want 1", len(got))
+	}
+	if f := got[0]; f.Header.Get(HeaderType) != TypeMessage || f.Header.Get(HeaderTopic) != "orders.eu" ||
+		f.Header.Get("k") != "v" || string(f.Payload) != "x" {
+		t.Fatalf("message = %v %q", f.Header, f.Payload)
+	}
+	if got := fc2.frames(t); len(got) != 1 {
+		t.Fatalf("exact subscriber got %d frames, want 1", len(got))
+	}
+
+	subscribe(t, s, fc1, TypeUnsubscribe, "orders.*")
+	if n, _ := b.Publish("orders.us", nil, nil); n != 1 {
+		t.Fatalf("after unsubscribing one pattern: delivered %d, want 1", n)
+	}
+	subscribe(t, s, fc1, TypeUnsubscribe, "orders.>")
+	if n, _ := b.Publish("orders.us", nil, nil); n != 0 {
+		t.Fatalf("after unsubscribing all: delivered %d, want 0", n)
+	}
+
+	subscribe(t, s, fc1, TypeSubscribe, "orders..")
+	if e := DecodeError(fc1.frames(t)[1]); e == nil || e.Code != CodeBadRequest {
+		t.Fatalf("bad pattern answered with %v, want CodeBadRequest", e)
+	}
+	if _, err := b.Publish("orders.*", nil, nil); !errors.Is(err, ErrBadTopic) {
+		t.Fatalf("Publish to a pattern: err = %v, want ErrBadTopic", err)
+	}
+}
+
+func TestBrokerRemovesClosed(t *testing.T) {
+	r := NewRouter()
+	b := NewBroker(WithBrokerLogger(Discard))
+	b.Register(r)
+	s := NewServer("", r.Handle, WithLogger(Discard))
+	c1, fc1 := openConn(t, s)
+	_, fc2 := openConn(t, s)
+	subscribe(t, s, fc1, TypeSubscribe, "a", "b")
+	// subscribed again after unsubscribing everything, the close hook is not added twice
+	subscribe(t, s, fc1, TypeUnsubscribe, "a", "b")
+	subscribe(t, s, fc1, TypeSubscribe, "a")
+	subscribe(t, s, fc2, TypeSubscribe, "a")
+	if len(c1.onClosed) != 1 {
+		t.Fatalf("%d close hooks, want 1", len(c1.onClosed))
+	}
+
+	s.OnClose(fc1, nil)
+	if n := b.subscribers(); n != 1 {
+		t.Fatalf("%d subscribers after a close, want 1", n)
+	}
+	if n, _ := b.Publish("a", nil, nil); n != 1 {
+		t.Fatalf("delivered %d, want 1", n)
+	}
+
+	// a subscription handled after the close, by a worker for instance
+	if err := b.Subscribe(c1, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.subscribers(); n != 1 {
+		t.Fatalf("closed connection subscribed, %d subscribers", n)
+	}
+}
+
+func TestCheckTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		wild  bool
+		ok    bool
+	}{
+		{"orders", false, true},
+		{"orders.eu.created", false, true},
+		{"orders.*", true, true},
+		{"orders.>", true, true},
+		{"*.eu.>", true, true},
+		{">", true, true},
+		{"", true, false},
+		{"orders..created", true, false},
+		{".orders", true, false},
+		{"orders.", true, false},
+		{"orders.*", false, false},
+		{"orders.>", false, false},
+		{"orders.>.eu", true, false},
+		{"orders.eu*", true, false},
+		{"orders.>x", true, false},
+	}
+	for _, tt := range tests {
+		err := checkTopic(tt.topic, tt.wild)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkTopic(%q, %v) = %v, want ok %v", tt.topic, tt.wild, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrBadTopic) {
+			t.Errorf("checkTopic(%q, %v) = %v, want ErrBadTopic", tt.topic, tt.wild, err)
+		}
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"orders", "orders", true},
+		{"orders", "order", false},
+		{"orders", "orders.eu", false},
+		{"orders.eu", "orders", false},
+		{"orders.*", "orders.eu", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.eu.created", false},
+		{"*.created", "orders.created", true},
+		{"*.*", "orders.eu", true},
+		{"orders.>", "orders.eu", true},
+		{"orders.>", "orders.eu.created", true},
+		{"orders.>", "orders", false},
+		{">", "orders.eu.created", true},
+		{"orders.*.created", "orders.eu.created", true},
+		{"orders.*.created", "orders.eu.deleted", false},
+		{"orders.*.>", "orders.eu.created.today", true},
+	}
+	for _, tt := range tests {
+		if got := matchTopic(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("matchTopic(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package gnetrw
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Header keys of typed messages. A connection can carry several message kinds,
+// HeaderType tells them apart and HeaderContentType names the codec of the payload.
+const (
+	HeaderType        = "type"
+	HeaderContentType = "content-type"
+)
+
+// Codec encodes and decodes messages of type T.
+type Codec[T any] interface {
+	ContentType() string
+	Marshal(v *T) ([]byte, error)
+	Unmarshal(data []byte, v *T) error
+}
+
+// JSONCodec encodes T with encoding/json.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) ContentType() string { return "application/json" }
+
+func (JSONCodec[T]) Marshal(v *T) ([]byte, error) { return json.Marshal(v) }
+
+func (JSONCodec[T]) Unmarshal(data []byte, v *T) error { return json.Unmarshal(data, v) }
+
+// GobCodec encodes T with encoding/gob. Every message is a self-contained gob
+// stream, type information included.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) ContentType() string { return "application/x-gob" }
+
+func (GobCodec[T]) Marshal(v *T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[T]) Unmarshal(data []byte, v *T) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// protoMessage is satisfied by the pointer to a generated protobuf message.
+type protoMessage[T any] interface {
+	*T
+	proto.Message
+}
+
+// ProtoCodec encodes generated protobuf messages, for example ProtoCodec[pb.Ping, *pb.Ping].
+type ProtoCodec[T any, P protoMessage[T]] struct{}
+
+func (ProtoCodec[T, P]) ContentType() string { return "application/x-protobuf" }
+
+func (ProtoCodec[T, P]) Marshal(v *T) ([]byte, error) { return proto.Marshal(P(v)) }
+
+func (ProtoCodec[T, P]) Unmarshal(data []byte, v *T) error { return proto.Unmarshal(data, P(v)) }
+
+// Encode packs v as a frame of message type typ.
+func Encode[T any](typ string, codec Codec[T], v *T) (*Frame, error) {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("encode %s: %w", typ, err)
+	}
+	return &Frame{
+		Header:  Header{HeaderType: typ, HeaderContentType: codec.ContentType()},
+		Payload: data,
+	}, nil
+}
+
+// Decode unmarshals the payload of f with codec. It fails with ErrContentType when
+// f names another content type.
+func Decode[T any](f *Frame, codec Codec[T]) (*T, error) {
+	if ct := f.Header.Get(HeaderContentType); ct != "" && ct != codec.ContentType() {
+		return nil, fmt.Errorf("%w: got %s, want %s", ErrContentType, ct, codec.ContentType())
+	}
+	v := new(T)
+	if err := codec.Unmarshal(f.Payload, v); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", f.Header.Get(HeaderType), err)
+	}
+	return v, nil
+}
+
+// MessageWriter sends a payload together with its header, both clients implement it.
+type MessageWriter interface {
+	WriteMessage(ctx context.Context, h Header, payload []byte) (int, error)
+}
+
+// Send writes v as a message of type typ. The peer must have negotiated HeaderVersion.
+func Send[T any](ctx context.Context, w MessageWriter, typ string, codec Codec[T], v *T) error {
+	f, err := Encode(typ, codec, v)
+	if err != nil {
+		return err
+	}
+	_, err = w.WriteMessage(ctx, f.Header, f.Payload)
+	return err
+}
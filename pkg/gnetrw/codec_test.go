@@ -0,0 +1,121 @@
+package gnetrw
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type point struct {
+	X, Y int
+	Name string
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	in := &point{X: 1, Y: -2, Name: "p"}
+	tests := []struct {
+		name  string
+		codec Codec[point]
+	}{
+		{"json", JSONCodec[point]{}},
+		{"gob", GobCodec[point]{}},
+	}
+	for _, tt := range tests {
+		f, err := Encode("point", tt.codec, in)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if f.Header.Get(HeaderType) != "point" || f.Header.Get(HeaderContentType) != tt.codec.ContentType() {
+			t.Errorf("%s: header %v", tt.name, f.Header)
+		}
+		out, err := Decode(f, tt.codec)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if *out != *in {
+			t.Errorf("%s: decoded %+v, want %+v", tt.name, out, in)
+		}
+	}
+}
+
+func TestProtoCodec(t *testing.T) {
+	codec := ProtoCodec[wrapperspb.StringValue, *wrapperspb.StringValue]{}
+	f, err := Encode("name", codec, wrapperspb.String("gnet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := Decode(f, codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.GetValue() != "gnet" {
+		t.Errorf("decoded %q", out.GetValue())
+	}
+}
+
+func TestDecodeContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		want        error
+	}{
+		{"same", "application/json", nil},
+		{"missing", "", nil},
+		{"other", "application/x-gob", ErrContentType},
+	}
+	for _, tt := range tests {
+		f := &Frame{Header: Header{HeaderType: "point"}, Payload: []byte(`{"X":1}`)}
+		if tt.contentType != "" {
+			f.Header.Set(HeaderContentType, tt.contentType)
+		}
+		if _, err := Decode(f, JSONCodec[point]{}); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Decode = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	r := NewRouter()
+	RegisterJSON(r, "move", func(ctx context.Context, p *point) (*point, error) {
+		if p.Name == "" {
+			return nil, nil // no reply
+		}
+		return &point{X: p.X + 1, Y: p.Y + 1, Name: p.Name}, nil
+	})
+	s := NewServer("", r.Handle, WithLogger(Discard))
+
+	tests := []struct {
+		name  string
+		in    point
+		reply *point
+	}{
+		{"reply", point{X: 1, Name: "a"}, &point{X: 2, Y: 1, Name: "a"}},
+		{"no reply", point{X: 1}, nil},
+	}
+	for _, tt := range tests {
+		c, fc := newTestConn(s, &Hello{})
+		f, err := Encode("move", JSONCodec[point]{}, &tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Handle(context.Background(), c, f); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		frames := fc.frames(t)
+		if tt.reply == nil {
+			if len(frames) != 0 {
+				t.Errorf("%s: %d frames written", tt.name, len(frames))
+			}
+			continue
+		}
+		if len(frames) != 1 || frames[0].Header.Get(HeaderType) != "move" {
+			t.Fatalf("%s: wrote %v", tt.name, frames)
+		}
+		out, err := Decode(frames[0], JSONCodec[point]{})
+		if err != nil || *out != *tt.reply {
+			t.Errorf("%s: reply %+v, %v, want %+v", tt.name, out, err, tt.reply)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package gnetrw
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// Compression identifies the codec of a compressed payload. It is kept in the low
+// bits of the frame flags, the header block is never compressed.
+type Compression byte
+
+const (
+	CompressNone Compression = iota
+	CompressGzip
+	CompressZstd
+	CompressSnappy
+
+	flagCompressMask byte = 0x0f
+)
+
+// DefaultCompressThreshold is the payload size below which frames are sent raw.
+const DefaultCompressThreshold = 1024
+
+// compressPrefix starts the handshake capabilities announcing a compression.
+const compressPrefix = "compress/"
+
+var compressionNames = [...]string{
+	CompressNone:   "none",
+	CompressGzip:   "gzip",
+	CompressZstd:   "zstd",
+	CompressSnappy: "snappy",
+}
+
+func (c Compression) String() string {
+	if int(c) < len(compressionNames) {
+		return compressionNames[c]
+	}
+	return fmt.Sprintf("compression(%d)", byte(c))
+}
+
+// Capability returns the handshake capability announcing c, for example "compress/zstd".
+func (c Compression) Capability() string { return compressPrefix + c.String() }
+
+// CompressionCapabilities returns the capabilities announcing algs, in order of preference.
+func CompressionCapabilities(algs ...Compression) []string {
+	caps := make([]string, 0, len(algs))
+	for _, alg := range algs {
+		if alg != CompressNone {
+			caps = append(caps, alg.Capability())
+		}
+	}
+	return caps
+}
+
+// CompressionOf returns the first compression announced in capabilities, the one
+// both sides use after the handshake. It is CompressNone when there is none.
+func CompressionOf(capabilities []string) Compression {
+	for _, capability := range capabilities {
+		name, ok := strings.CutPrefix(capability, compressPrefix)
+		if !ok {
+			continue
+		}
+		for i, n := range compressionNames {
+			if i != int(CompressNone) && n == name {
+				return Compression(i)
+			}
+		}
+	}
+	return CompressNone
+}
+
+// Compressor compresses the payload of outgoing frames of at least Threshold bytes.
+// The zero value sends every frame raw.
+type Compressor struct {
+	Compression Compression
+	Threshold   int // 0 uses DefaultCompressThreshold
+}
+
+// NegotiatedCompressor returns the compressor agreed in w, frames stay raw unless the
+// peer speaks HeaderVersion since compression is marked in the frame flags.
+func NegotiatedCompressor(w *Welcome, threshold int) Compressor {
+	if w == nil || w.Version < HeaderVersion {
+		return Compressor{}
+	}
+	return Compressor{Compression: CompressionOf(w.Capabilities), Threshold: threshold}
+}
+
+// Compress returns f with its payload compressed, or f itself when the payload is
+// under the threshold or does not shrink. f is not modified.
+func (cp Compressor) Compress(f *Frame) (*Frame, error) {
+	threshold := cp.Threshold
+	if threshold <= 0 {
+		threshold = DefaultCompressThreshold
+	}
+	if cp.Compression == CompressNone || len(f.Payload) < threshold || f.Flags&flagCompressMask != 0 {
+		return f, nil
+	}
+	if len(f.Payload) > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	data, err := compress(cp.Compression, f.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) >= len(f.Payload) {
+		return f, nil
+	}
+	return &Frame{Flags: f.Flags | byte(cp.Compression), Header: f.Header, Payload: data}, nil
+}
+
+func compress(c Compression, src []byte) ([]byte, error) {
+	switch c {
+	case CompressGzip:
+		var buf bytes.Buffer
+		zw := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(zw)
+		zw.Reset(&buf)
+		if _, err := zw.Write(src); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressZstd:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(src, nil), nil
+	case CompressSnappy:
+		return s2.EncodeSnappy(nil, src), nil
+	}
+	return nil, fmt.Errorf("%w: %v", ErrUnknownCompression, c)
+}
+
+// decompress restores a payload compressed with c, refusing results over MaxFrameSize.
+func decompress(c Compression, src []byte) ([]byte, error) {
+	switch c {
+	case CompressGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorruptPayload, err)
+		}
+		data, err := io.ReadAll(io.LimitReader(zr, MaxFrameSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorruptPayload, err)
+		}
+		if len(data) > MaxFrameSize {
+			return nil, ErrFrameTooLarge
+		}
+		return data, nil
+	case CompressZstd:
+		_, dec, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		data, err := dec.DecodeAll(src, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorruptPayload, err)
+		}
+		return data, nil
+	case CompressSnappy:
+		n, err := s2.DecodedLen(src)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorruptPayload, err)
+		}
+		if n > MaxFrameSize {
+			return nil, ErrFrameTooLarge
+		}
+		data, err := s2.Decode(nil, src)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorruptPayload, err)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("%w: %v", ErrUnknownCompression, c)
+}
+
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+	zstdErr  error
+)
+
+// zstdCodec returns the shared encoder and decoder, their EncodeAll and DecodeAll are
+// safe for concurrent use.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		if zstdEnc, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDec, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(MaxFrameSize))
+	})
+	return zstdEnc, zstdDec, zstdErr
+}
+
+// compressorOf returns the compressor negotiated for conn, through the optional
+// Compressor method of conn itself or else of its context.
+func compressorOf(conn gnet.Conn) Compressor {
+	type compressed interface{ Compressor() Compressor }
+	if c, ok := conn.(compressed); ok {
+		return c.Compressor()
+	}
+	if c, ok := conn.Context().(compressed); ok {
+		return c.Compressor()
+	}
+	return Compressor{}
+}
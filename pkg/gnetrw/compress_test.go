@@ -0,0 +1,129 @@
+package gnetrw
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestCompressor(t *testing.T) {
+	text := bytes.Repeat([]byte("compressible "), 100)
+	noise := make([]byte, 2048)
+	_, _ = rand.Read(noise)
+	tests := []struct {
+		name  string
+		cp    Compressor
+		frame *Frame
+		raw   bool // the frame is sent as is
+	}{
+		{"none", Compressor{}, &Frame{Payload: text}, true},
+		{"gzip", Compressor{Compression: CompressGzip}, &Frame{Payload: text}, false},
+		{"zstd", Compressor{Compression: CompressZstd}, &Frame{Payload: text}, false},
+		{"snappy", Compressor{Compression: CompressSnappy}, &Frame{Payload: text}, false},
+		{"header kept", Compressor{Compression: CompressZstd}, &Frame{Header: Header{"type": "echo"}, Payload: text}, false},
+		{"under threshold", Compressor{Compression: CompressZstd, Threshold: 2000}, &Frame{Payload: text}, true},
+		{"default threshold", Compressor{Compression: CompressZstd}, &Frame{Payload: text[:DefaultCompressThreshold-1]}, true},
+		{"does not shrink", Compressor{Compression: CompressZstd}, &Frame{Payload: noise}, true},
+		{"already compressed", Compressor{Compression: CompressZstd}, &Frame{Flags: byte(CompressGzip), Payload: text}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := tt.cp.Compress(tt.frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (f == tt.frame) != tt.raw {
+				t.Fatalf("sent raw %v, want %v", f == tt.frame, tt.raw)
+			}
+			if tt.raw {
+				return
+			}
+			if Compression(f.Flags&flagCompressMask) != tt.cp.Compression || len(f.Payload) >= len(tt.frame.Payload) {
+				t.Errorf("flags %#x, %d bytes of %d", f.Flags, len(f.Payload), len(tt.frame.Payload))
+			}
+			// the peer gets the original frame back
+			buf, err := PackFrame(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			flags, _ := splitPrefix(buf[:4])
+			got, err := DecodeFrame(flags, buf[4:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertFrame(t, got, tt.frame)
+		})
+	}
+}
+
+func TestCompressorTooLarge(t *testing.T) {
+	cp := Compressor{Compression: CompressZstd}
+	if _, err := cp.Compress(&Frame{Payload: make([]byte, MaxFrameSize+1)}); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Compress = %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestDecodeCompressed(t *testing.T) {
+	payload := bytes.Repeat([]byte("compressible "), 100)
+	for _, c := range []Compression{CompressGzip, CompressZstd, CompressSnappy} {
+		t.Run(c.String(), func(t *testing.T) {
+			data, err := compress(c, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := &Frame{Flags: byte(c), Header: Header{"type": "echo"}, Payload: data}
+			buf, err := PackFrame(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			flags, _ := splitPrefix(buf[:4])
+			got, err := DecodeFrame(flags, buf[4:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertFrame(t, got, &Frame{Header: f.Header, Payload: payload})
+
+			// a damaged payload is reported, not handed to the handler
+			if _, err := DecodeFrame(flags, buf[4:len(buf)-4]); !errors.Is(err, ErrCorruptPayload) {
+				t.Errorf("truncated payload: %v, want ErrCorruptPayload", err)
+			}
+		})
+	}
+}
+
+func TestDecodeUnknownCompression(t *testing.T) {
+	if _, err := DecodeFrame(0x0f, []byte("data")); !errors.Is(err, ErrUnknownCompression) {
+		t.Errorf("DecodeFrame = %v, want ErrUnknownCompression", err)
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		name    string
+		offered []Compression // by the server
+		hello   Hello
+		want    Compression
+	}{
+		{"client order", []Compression{CompressZstd, CompressGzip},
+			Hello{Version: ProtocolVersion, Capabilities: CompressionCapabilities(CompressGzip, CompressZstd)}, CompressGzip},
+		{"common one", []Compression{CompressZstd},
+			Hello{Version: ProtocolVersion, Capabilities: CompressionCapabilities(CompressSnappy, CompressZstd)}, CompressZstd},
+		{"none in common", []Compression{CompressZstd},
+			Hello{Version: ProtocolVersion, Capabilities: CompressionCapabilities(CompressSnappy)}, CompressNone},
+		{"not announced", []Compression{CompressZstd}, Hello{Version: ProtocolVersion}, CompressNone},
+		// compression is marked in the flags, which version 1 peers do not read
+		{"version 1", []Compression{CompressZstd},
+			Hello{Version: 1, Capabilities: CompressionCapabilities(CompressZstd)}, CompressNone},
+	}
+	for _, tt := range tests {
+		s := NewServer("", nil, WithLogger(Discard), WithHandshake(HandshakeConfig{}), WithCompression(0, tt.offered...))
+		w, err := s.handshake.negotiate(nil, &tt.hello)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := NegotiatedCompressor(w, 0).Compression; got != tt.want {
+			t.Errorf("%s: compression %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
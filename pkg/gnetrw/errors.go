@@ -0,0 +1,121 @@
+package gnetrw
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// MaxFrameSize is the largest frame payload accepted or sent.
+const MaxFrameSize = 10 << 20
+
+// The stable error set of the package, match them with errors.Is.
+var (
+	ErrFrameTooLarge      = errors.New("frame exceeds 10M limit")
+	ErrShortHeader        = errors.New("connection closed inside a frame header")
+	ErrTruncatedFrame     = errors.New("connection closed inside a frame")
+	ErrHandler            = errors.New("frame handler failed")
+	ErrPeerClosed         = errors.New("peer closed connection")
+	ErrEmptyFrame         = errors.New("empty frame")
+	ErrConnClosed         = errors.New("connection closed")
+	ErrMalformedHeader    = errors.New("malformed frame header block")
+	ErrHeaderNotSupported = errors.New("peer does not support frame headers")
+	ErrUnknownCompression = errors.New("unknown frame compression")
+	ErrCorruptPayload     = errors.New("corrupt compressed frame payload")
+	ErrContentType        = errors.New("unexpected message content type")
+	ErrUnknownType        = errors.New("no handler for message type")
+	ErrPanic              = errors.New("panic while handling traffic")
+	ErrRateLimited        = errors.New("rate limit exceeded")
+	ErrInboundOverflow    = errors.New("too much data buffered while reading is paused")
+	ErrEvicted            = errors.New("idle connection evicted")
+	ErrBadTopic           = errors.New("invalid topic")
+	ErrSlowConsumer       = errors.New("slow consumer")
+	ErrStreamAborted      = errors.New("stream aborted by sender")
+	ErrStreamTruncated    = errors.New("connection closed inside a stream")
+	ErrTooManyStreams     = errors.New("too many open streams")
+	ErrStreamReset        = errors.New("stream reset")
+	ErrMuxNotSupported    = errors.New("peer does not support stream multiplexing")
+	ErrSessionExpired     = errors.New("client session expired")
+	ErrSessionResumed     = errors.New("client session resumed on another connection")
+)
+
+// FrameError describes why reading, decoding or dispatching a frame failed.
+type FrameError struct {
+	Op   string // "read", "decode" or "dispatch"
+	Addr string
+	Len  int // frame length when known
+	Err  error
+}
+
+func (e *FrameError) Error() string {
+	if e.Addr == "" {
+		return fmt.Sprintf("%s frame: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s frame from %s: %v", e.Op, e.Addr, e.Err)
+}
+
+func (e *FrameError) Unwrap() error { return e.Err }
+
+// PanicError is a panic recovered by TrafficData, it matches ErrPanic.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string { return fmt.Sprintf("panic: %v", e.Value) }
+
+func (e *PanicError) Is(target error) bool { return target == ErrPanic }
+
+// Unwrap returns the panic value when it is an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// PanicHandler may be implemented by a DataDispatch to decide what follows a panic
+// while dispatching f. A nil result keeps the connection open, otherwise it is closed.
+// Without it the connection is closed.
+type PanicHandler interface {
+	HandlePanic(conn gnet.Conn, f *Frame, p *PanicError) error
+}
+
+// ErrorHandler may be implemented by a DataDispatch to be told why TrafficData
+// is about to close a connection.
+type ErrorHandler interface {
+	OnError(conn gnet.Conn, err error)
+}
+
+func reportError(svr DataDispatch, conn gnet.Conn, err error) {
+	if h, ok := svr.(ErrorHandler); ok {
+		h.OnError(conn, err)
+	}
+}
+
+// peerClosed builds the close reason of a connection the peer shut down,
+// with partial marking a frame left incomplete.
+func peerClosed(partialHeader, partialFrame bool) error {
+	switch {
+	case partialHeader:
+		return fmt.Errorf("%w: %w", ErrPeerClosed, ErrShortHeader)
+	case partialFrame:
+		return fmt.Errorf("%w: %w", ErrPeerClosed, ErrTruncatedFrame)
+	}
+	return fmt.Errorf("%w: %w", ErrPeerClosed, io.EOF)
+}
+
+// CloseReason explains why conn is closing from inside gnet's OnClose.
+// recorded is the error reported through ErrorHandler, if any, part the frame
+// being reassembled and err the error gnet passed to OnClose.
+// It returns nil for a connection closed locally without error.
+func CloseReason(conn gnet.Conn, part *PartData, recorded, err error) error {
+	if recorded != nil {
+		return recorded
+	}
+	if errors.Is(err, io.EOF) {
+		buffered := conn.InboundBuffered()
+		return peerClosed(part == nil && buffered > 0 && buffered < 4, part != nil || buffered >= 4)
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package gnetrw
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// FlagCredit marks a flow control frame, its payload is the uvarint number of bytes the
+// receiver grants to the sender.
+//
+//	flags(FlagCredit) length | uvarint(bytes)
+//
+// Once CapabilityCredit is negotiated the client starts without credit. The server
+// grants the window right after the welcome, then gives back the length of the frames
+// it handled, prefix excluded. The client writes while its credit is positive, so one
+// frame may overdraw it.
+const FlagCredit byte = 0x10
+
+// CapabilityCredit is announced in the handshake by the clients that honor credits.
+const CapabilityCredit = "credit"
+
+const (
+	// DefaultCreditWindow is the number of bytes a client may send before they are handled.
+	DefaultCreditWindow = 1 << 20
+	// DefaultHighWater is the number of outbound bytes buffered by gnet above which a
+	// connection is not read.
+	DefaultHighWater = 4 << 20
+
+	// flowPollInterval is how often a connection paused by the high watermark checks
+	// whether its outbound buffer drained, gnet has no event for it.
+	flowPollInterval = 10 * time.Millisecond
+)
+
+// FlowControl configures WithFlowControl, zero values use the defaults.
+type FlowControl struct {
+	Window    int // bytes of credit a client may have, DefaultCreditWindow by default
+	HighWater int // outbound bytes that pause reading, DefaultHighWater by default
+	LowWater  int // outbound bytes that resume reading, HighWater/2 by default
+}
+
+// WithFlowControl bounds what a connection costs the server in both directions.
+// Clients announcing CapabilityCredit only send what the server granted, see FlagCredit,
+// and credit is given back once the handler returned, so slow handlers slow the client down.
+// A connection whose outbound buffer grows over HighWater, because the client does not
+// read its replies, is not read until the buffer is down to LowWater. Frames written
+// without reading, such as broadcasts, are not bounded by the watermarks.
+func WithFlowControl(fc FlowControl) Option {
+	return func(s *Server) {
+		if fc.Window <= 0 {
+			fc.Window = DefaultCreditWindow
+		}
+		if fc.HighWater <= 0 {
+			fc.HighWater = DefaultHighWater
+		}
+		if fc.LowWater <= 0 || fc.LowWater > fc.HighWater {
+			fc.LowWater = fc.HighWater / 2
+		}
+		s.flow = &fc
+	}
+}
+
+// CreditFrame grants n bytes to the peer.
+func CreditFrame(n int) *Frame {
+	return &Frame{Flags: FlagCredit, Payload: binary.AppendUvarint(nil, uint64(n))}
+}
+
+// ParseCredit returns the bytes granted by a frame with FlagCredit.
+func ParseCredit(f *Frame) (int, error) {
+	n, k := binary.Uvarint(f.Payload)
+	if k <= 0 || n > 1<<40 {
+		return 0, fmt.Errorf("%w: malformed credit", ErrCorruptPayload)
+	}
+	return int(n), nil
+}
+
+// grantWindow sends the initial credit after the welcome, on the event loop.
+func (s *Server) grantWindow(c *Conn) error {
+	if s.flow == nil || !c.HasCapability(CapabilityCredit) {
+		return nil
+	}
+	c.credit.Store(true)
+	return s.grant(c, s.flow.Window)
+}
+
+// consume gives the credit of a handled frame back, it is safe to call from any goroutine.
+// Credit is granted in batches of half the window.
+func (s *Server) consume(c *Conn, f *Frame) {
+	if !c.credit.Load() {
+		return
+	}
+	n := c.consumed.Add(int64(max(f.size, 1)))
+	if n < int64(s.flow.Window/2) || !c.consumed.CompareAndSwap(n, 0) {
+		return
+	}
+	// fails only once c is closed
+	_ = s.grant(c, int(n))
+}
+
+func (s *Server) grant(c *Conn, n int) error {
+	buf, err := PackFrame(CreditFrame(n))
+	if err != nil {
+		return err
+	}
+	if err := c.AsyncWrite(buf, nil); err != nil {
+		return ErrConnClosed
+	}
+	s.metrics.CreditGranted.Add(int64(n))
+	return nil
+}
+
+// outboundFull reports whether c is not read because of its outbound buffer, it runs
+// on the event loop. While paused the connection is woken every flowPollInterval.
+func (s *Server) outboundFull(c *Conn) bool {
+	buffered := c.OutboundBuffered()
+	if !c.outPaused {
+		if buffered <= s.flow.HighWater {
+			return false
+		}
+		c.outPaused = true
+		s.metrics.ReadPauses.Add(1)
+		s.logger.Debug("outbound over high watermark, pause reading", KeyAddr, addrOf(c), "buffered", buffered)
+	} else if buffered <= s.flow.LowWater {
+		c.outPaused = false
+		s.logger.Debug("outbound drained, resume reading", KeyAddr, addrOf(c), "buffered", buffered)
+		return false
+	}
+	if c.outPoll.CompareAndSwap(false, true) {
+		time.AfterFunc(flowPollInterval, func() {
+			c.outPoll.Store(false)
+			_ = c.Wake(nil)
+		})
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+package gnetrw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+func TestCreditFrame(t *testing.T) {
+	n, err := ParseCredit(CreditFrame(12345))
+	if n != 12345 || err != nil {
+		t.Fatalf("ParseCredit = %d, %v", n, err)
+	}
+	for _, f := range []*Frame{{Flags: FlagCredit}, {Flags: FlagCredit, Payload: []byte{0x80}}, CreditFrame(1<<40 + 1)} {
+		if _, err := ParseCredit(f); !errors.Is(err, ErrCorruptPayload) {
+			t.Errorf("ParseCredit(%x): err = %v, want ErrCorruptPayload", f.Payload, err)
+		}
+	}
+}
+
+// helloFrame is the hello of a client announcing capabilities.
+func helloFrame(t *testing.T, capabilities ...string) *Frame {
+	t.Helper()
+	data, err := json.Marshal(Hello{Version: ProtocolVersion, Name: "test", Capabilities: capabilities})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Frame{Payload: data}
+}
+
+// credits returns the credits written to fc, failing on other frames than the welcome.
+func credits(t *testing.T, fc *fakeConn) []int {
+	t.Helper()
+	var got []int
+	for _, f := range fc.frames(t) {
+		if f.Flags&FlagCredit == 0 {
+			if _, err := ParseWelcome(f.Payload); err != nil {
+				t.Fatalf("unexpected frame %#x %q", f.Flags, f.Payload)
+			}
+			continue
+		}
+		n, err := ParseCredit(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, n)
+	}
+	return got
+}
+
+func TestCreditGrant(t *testing.T) {
+	const window = 100
+	handled := 0
+	h := func(ctx context.Context, c *Conn, f *Frame) error { handled++; return nil }
+	s := NewServer("", h, WithLogger(Discard), WithHandshake(HandshakeConfig{}), WithFlowControl(FlowControl{Window: window}))
+	c, fc := openConn(t, s)
+	traffic(t, s, fc, helloFrame(t, CapabilityCredit))
+	if !c.HasCapability(CapabilityCredit) {
+		t.Fatalf("credit not negotiated, %v", c.welcome.Capabilities)
+	}
+	if got := credits(t, fc); len(got) != 1 || got[0] != window {
+		t.Fatalf("first credits %v, want [%d]", got, window)
+	}
+
+	// given back once half the window was handled
+	payload := make([]byte, 20)
+	traffic(t, s, fc, &Frame{Payload: payload}, &Frame{Payload: payload})
+	if got := credits(t, fc); len(got) != 0 {
+		t.Fatalf("credit %v given back before half the window", got)
+	}
+	traffic(t, s, fc, &Frame{Payload: payload}, CreditFrame(5))
+	got := credits(t, fc)
+	if len(got) != 1 || got[0] < window/2 || got[0] >= window {
+		t.Fatalf("credits %v, want one between %d and %d", got, window/2, window)
+	}
+	if handled != 3 {
+		t.Fatalf("handled %d frames, want 3, a credit from the client is not handled", handled)
+	}
+
+	if action := traffic(t, s, fc, &Frame{Flags: FlagCredit, Payload: []byte{0x80}}); action != gnet.Close {
+		t.Fatalf("malformed credit: TrafficData = %v, want Close", action)
+	}
+}
+
+func TestCreditNotNegotiated(t *testing.T) {
+	s := NewServer("", func(ctx context.Context, c *Conn, f *Frame) error { return nil },
+		WithLogger(Discard), WithHandshake(HandshakeConfig{}), WithFlowControl(FlowControl{Window: 100}))
+	_, fc := openConn(t, s)
+	traffic(t, s, fc, helloFrame(t))
+	traffic(t, s, fc, &Frame{Payload: make([]byte, 200)})
+	if got := credits(t, fc); len(got) != 0 {
+		t.Fatalf("credits %v sent to a client that does not honor them", got)
+	}
+}
+
+func TestOutboundWatermarks(t *testing.T) {
+	s := NewServer("", nil, WithLogger(Discard), WithFlowControl(FlowControl{HighWater: 100, LowWater: 40}))
+	_, fc := openConn(t, s)
+	for _, step := range []struct {
+		outbound int
+		paused   bool
+	}{
+		{100, false},
+		{101, true},
+		{60, true}, // between the watermarks, still paused
+		{40, false},
+		{60, false},
+	} {
+		fc.outbound = step.outbound
+		if paused := s.ReadPaused(fc); paused != step.paused {
+			t.Fatalf("%d bytes buffered: paused %v, want %v", step.outbound, paused, step.paused)
+		}
+		if step.paused {
+			select {
+			case <-fc.wakes:
+			case <-time.After(time.Second):
+				t.Fatal("paused connection not woken to check its buffer")
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package gnetrw
+
+import (
+	"encoding/binary"
+	"io"
+	"slices"
+)
+
+// 数据格式：uint32(4byte) + Data
+// 长度前缀的高 8 位是帧标志，低 24 位是后续内容长度。
+//
+//	flags(1byte) length(3byte) | [header block] | payload
+//
+// The low 4 bits of the flags name the Compression of the payload, see compress.go.
+//
+// Frames from version 1 peers always have zero flags, so both formats can be read
+// by the same code. Flags are only sent to peers that negotiated version 2 or later.
+const (
+	// FlagHeader marks a frame whose payload is preceded by a header block.
+	FlagHeader byte = 0x80
+
+	lengthMask = 1<<24 - 1
+)
+
+// Frame is one decoded frame, a message is its payload together with its header.
+type Frame struct {
+	Flags   byte
+	Header  Header
+	Payload []byte
+	size    int // length read, prefix excluded, for the flow control credits
+}
+
+// Header is the optional key/value block of a frame, for metadata such as content type,
+// tenant or auth token. It implements the Get/Set/Keys carrier used by trace propagators,
+// Set needs a non-nil map.
+type Header map[string]string
+
+func (h Header) Get(key string) string { return h[key] }
+
+func (h Header) Set(key, value string) { h[key] = value }
+
+func (h Header) Del(key string) { delete(h, key) }
+
+// Clone returns a copy of h, nil when h is nil.
+func (h Header) Clone() Header {
+	if h == nil {
+		return nil
+	}
+	c := make(Header, len(h))
+	for k, v := range h {
+		c[k] = v
+	}
+	return c
+}
+
+func (h Header) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// appendHeader encodes h as uvarint(count) followed by uvarint-length prefixed keys and values.
+func appendHeader(b []byte, h Header) []byte {
+	b = binary.AppendUvarint(b, uint64(len(h)))
+	for _, k := range h.Keys() {
+		b = binary.AppendUvarint(b, uint64(len(k)))
+		b = append(b, k...)
+		b = binary.AppendUvarint(b, uint64(len(h[k])))
+		b = append(b, h[k]...)
+	}
+	return b
+}
+
+func readUvarintBytes(b []byte) ([]byte, []byte, error) {
+	n, size := binary.Uvarint(b)
+	if size <= 0 || n > uint64(len(b)-size) {
+		return nil, nil, ErrMalformedHeader
+	}
+	b = b[size:]
+	return b[:n], b[n:], nil
+}
+
+func decodeHeader(b []byte) (Header, []byte, error) {
+	count, size := binary.Uvarint(b)
+	if size <= 0 || count > uint64(len(b)) {
+		return nil, nil, ErrMalformedHeader
+	}
+	b = b[size:]
+	h := make(Header, count)
+	for i := uint64(0); i < count; i++ {
+		var k, v []byte
+		var err error
+		if k, b, err = readUvarintBytes(b); err != nil {
+			return nil, nil, err
+		}
+		if v, b, err = readUvarintBytes(b); err != nil {
+			return nil, nil, err
+		}
+		h[string(k)] = string(v)
+	}
+	return h, b, nil
+}
+
+// DecodeFrame splits the content of a frame read with the given flags and decompresses
+// its payload. The payload aliases data unless it was compressed.
+func DecodeFrame(flags byte, data []byte) (*Frame, error) {
+	f := &Frame{Flags: flags, Payload: data, size: len(data)}
+	if flags&FlagHeader != 0 {
+		h, payload, err := decodeHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		f.Header, f.Payload = h, payload
+	}
+	if c := Compression(flags & flagCompressMask); c != CompressNone {
+		payload, err := decompress(c, f.Payload)
+		if err != nil {
+			return nil, err
+		}
+		f.Flags &^= flagCompressMask
+		f.Payload = payload
+	}
+	return f, nil
+}
+
+// PackFrame encodes f with its length prefix, FlagHeader is set when f has a header.
+// A frame with a header may have an empty payload. f is sent as is, see Compressor.Compress.
+func PackFrame(f *Frame) ([]byte, error) {
+	flags := f.Flags &^ FlagHeader
+	buf := make([]byte, 4, 4+len(f.Payload))
+	if len(f.Header) > 0 {
+		flags |= FlagHeader
+		buf = appendHeader(buf, f.Header)
+	} else if len(f.Payload) == 0 {
+		return nil, ErrEmptyFrame
+	}
+	buf = append(buf, f.Payload...)
+
+	n := len(buf) - 4
+	if n > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	binary.BigEndian.PutUint32(buf, uint32(flags)<<24|uint32(n))
+	return buf, nil
+}
+
+// PackData prefixes data with its length so it can be written as one frame.
+func PackData(data []byte) ([]byte, error) {
+	return PackFrame(&Frame{Payload: data})
+}
+
+// splitPrefix returns the flags and content length of a length prefix.
+func splitPrefix(prefix []byte) (byte, int) {
+	v := binary.BigEndian.Uint32(prefix)
+	return byte(v >> 24), int(v & lengthMask)
+}
+
+// WriteFrame writes data as one frame to a blocking writer such as net.Conn.
+func WriteFrame(w io.Writer, data []byte) error {
+	buf, err := PackData(data)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// WriteMessage writes payload with header h as one frame to a blocking writer.
+// Only send headers to peers that negotiated HeaderVersion.
+func WriteMessage(w io.Writer, h Header, payload []byte) error {
+	buf, err := PackFrame(&Frame{Header: h, Payload: payload})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadFrame reads one frame from a blocking reader such as net.Conn and returns its payload.
+// A clean close between frames is reported as ErrPeerClosed wrapping io.EOF.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	f, err := ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	return f.Payload, nil
+}
+
+// ReadMessage reads one frame from a blocking reader, header included.
+func ReadMessage(r io.Reader) (*Frame, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		switch err {
+		case io.EOF:
+			return nil, peerClosed(false, false)
+		case io.ErrUnexpectedEOF:
+			return nil, peerClosed(true, false)
+		}
+		return nil, err
+	}
+	flags, dataLen := splitPrefix(lenBuf[:])
+	if dataLen > MaxFrameSize {
+		return nil, &FrameError{Op: "read", Len: dataLen, Err: ErrFrameTooLarge}
+	}
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, peerClosed(false, true)
+		}
+		return nil, err
+	}
+	f, err := DecodeFrame(flags, data)
+	if err != nil {
+		return nil, &FrameError{Op: "decode", Len: dataLen, Err: err}
+	}
+	return f, nil
+}
@@ -0,0 +1,110 @@
+package gnetrw
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame *Frame
+	}{
+		{"payload", &Frame{Payload: []byte("hello")}},
+		{"header", &Frame{Header: Header{"type": "echo", "tenant": "a"}, Payload: []byte("hello")}},
+		{"header only", &Frame{Header: Header{"ack": "7"}}},
+		{"empty values", &Frame{Header: Header{"": ""}, Payload: []byte{0}}},
+		{"stream flag", &Frame{Flags: FlagStream, Payload: []byte{1, 2, 3}}},
+		{"large header", &Frame{Header: Header{"k": string(bytes.Repeat([]byte("v"), 300))}, Payload: []byte("x")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := PackFrame(tt.frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			flags, n := splitPrefix(buf[:4])
+			if n != len(buf)-4 {
+				t.Fatalf("prefix length %d, want %d", n, len(buf)-4)
+			}
+			if (flags&FlagHeader != 0) != (len(tt.frame.Header) > 0) {
+				t.Errorf("flags %#x, header %v", flags, tt.frame.Header)
+			}
+			f, err := DecodeFrame(flags, buf[4:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertFrame(t, f, tt.frame)
+
+			// the blocking reader decodes the same frame
+			f, err = ReadMessage(bytes.NewReader(buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertFrame(t, f, tt.frame)
+		})
+	}
+}
+
+func TestDecodeMalformedHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"bad count", []byte{0xff}},
+		{"count above size", []byte{5, 1, 'k'}},
+		{"missing value", []byte{1, 1, 'k'}},
+		{"key too long", []byte{1, 9, 'k', 0}},
+		{"value too long", []byte{1, 1, 'k', 9, 'v'}},
+	}
+	for _, tt := range tests {
+		if _, err := DecodeFrame(FlagHeader, tt.data); !errors.Is(err, ErrMalformedHeader) {
+			t.Errorf("%s: DecodeFrame = %v, want ErrMalformedHeader", tt.name, err)
+		}
+	}
+}
+
+func TestPackFrameErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame *Frame
+		want  error
+	}{
+		{"empty", &Frame{}, ErrEmptyFrame},
+		{"empty header", &Frame{Header: Header{}}, ErrEmptyFrame},
+		{"too large", &Frame{Payload: make([]byte, MaxFrameSize+1)}, ErrFrameTooLarge},
+	}
+	for _, tt := range tests {
+		if _, err := PackFrame(tt.frame); !errors.Is(err, tt.want) {
+			t.Errorf("%s: PackFrame = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestReadMessageTruncated(t *testing.T) {
+	buf, err := PackFrame(&Frame{Header: Header{"type": "echo"}, Payload: []byte("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{1, 3, 4, len(buf) - 1} {
+		if _, err := ReadMessage(bytes.NewReader(buf[:n])); err == nil {
+			t.Errorf("ReadMessage of %d bytes of %d succeeded", n, len(buf))
+		}
+	}
+}
+
+func assertFrame(t *testing.T, got, want *Frame) {
+	t.Helper()
+	if got.Flags&^FlagHeader != want.Flags&^FlagHeader {
+		t.Errorf("flags %#x, want %#x", got.Flags, want.Flags)
+	}
+	if !maps.Equal(got.Header, want.Header) {
+		t.Errorf("header %v, want %v", got.Header, want.Header)
+	}
+	if !bytes.Equal(got.Payload, want.Payload) {
+		t.Errorf("payload %q, want %q", got.Payload, want.Payload)
+	}
+}
@@ -0,0 +1,131 @@
+package gnetrw
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// ProtocolVersion is the framing protocol version spoken by this package.
+//
+//	1  uint32 length + payload
+//	2  frames may carry flags and a header block, see frame.go
+const ProtocolVersion = 2
+
+// HeaderVersion is the first protocol version whose frames may carry a header block.
+const HeaderVersion = 2
+
+var (
+	ErrHandshakeRejected = errors.New("handshake rejected")
+	// ErrRetryLater marks a rejection the client may retry, such as a full server.
+	ErrRetryLater = errors.New("retry later")
+)
+
+// Hello is the first frame a client sends after connecting.
+type Hello struct {
+	Version      int      `json:"version"`
+	Name         string   `json:"name,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	// ClientID identifies the client across its connections, for acknowledged delivery.
+	// Epoch names its numbering of HeaderSeq, which starts over when Epoch changes.
+	ClientID string `json:"client_id,omitempty"`
+	Epoch    string `json:"epoch,omitempty"`
+	// Session is the token of the session to resume and Received the highest message
+	// number received on it, see CapabilityResume.
+	Session  string `json:"session,omitempty"`
+	Received uint64 `json:"received,omitempty"`
+}
+
+// Welcome is the server's answer to Hello. Capabilities holds the ones both sides support.
+type Welcome struct {
+	Accepted     bool     `json:"accepted"`
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Reason       string   `json:"reason,omitempty"`
+	Retry        bool     `json:"retry,omitempty"` // the rejection is temporary
+	// Session is the token of the session of the client, Resumed tells whether it is
+	// the one Hello.Session asked for, see CapabilityResume.
+	Session string `json:"session,omitempty"`
+	Resumed bool   `json:"resumed,omitempty"`
+}
+
+// HandshakeConfig is the server side of the handshake.
+type HandshakeConfig struct {
+	Version      int      // defaults to ProtocolVersion
+	MinVersion   int      // oldest client version accepted, defaults to 1
+	Capabilities []string // offered to clients
+	// Accept may reject a client by returning an error, its message is sent as the reason.
+	Accept func(c *Conn, hello *Hello) error
+}
+
+// HelloFrame returns the packed frame carrying h.
+func (h Hello) HelloFrame() ([]byte, error) {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return PackData(data)
+}
+
+// ParseWelcome decodes the server answer, returning an ErrHandshakeRejected error when refused.
+func ParseWelcome(msg []byte) (*Welcome, error) {
+	var w Welcome
+	if err := json.Unmarshal(msg, &w); err != nil {
+		return nil, fmt.Errorf("decode welcome, %w", err)
+	}
+	if !w.Accepted && w.Retry {
+		return &w, fmt.Errorf("%w, %w: %s", ErrHandshakeRejected, ErrRetryLater, w.Reason)
+	}
+	if !w.Accepted {
+		return &w, fmt.Errorf("%w: %s", ErrHandshakeRejected, w.Reason)
+	}
+	return &w, nil
+}
+
+// Handshake runs the client side of the handshake on a blocking connection.
+func Handshake(rw io.ReadWriter, hello Hello) (*Welcome, error) {
+	frame, err := hello.HelloFrame()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = rw.Write(frame); err != nil {
+		// 服务端拒绝连接时可能在收到 Hello 前就已关闭, 尝试读出拒绝原因
+		if msg, rerr := ReadFrame(rw); rerr == nil {
+			return ParseWelcome(msg)
+		}
+		return nil, err
+	}
+	msg, err := ReadFrame(rw)
+	if err != nil {
+		return nil, err
+	}
+	return ParseWelcome(msg)
+}
+
+// negotiate checks hello against the config and builds the answer.
+func (cfg *HandshakeConfig) negotiate(c *Conn, hello *Hello) (*Welcome, error) {
+	version := cfg.Version
+	if version == 0 {
+		version = ProtocolVersion
+	}
+	minVersion := max(cfg.MinVersion, 1)
+
+	w := &Welcome{Version: min(version, hello.Version)}
+	if hello.Version < minVersion {
+		return w, fmt.Errorf("unsupported protocol version %d, need >= %d", hello.Version, minVersion)
+	}
+	for _, capability := range hello.Capabilities {
+		if slices.Contains(cfg.Capabilities, capability) {
+			w.Capabilities = append(w.Capabilities, capability)
+		}
+	}
+	if cfg.Accept != nil {
+		if err := cfg.Accept(c, hello); err != nil {
+			return w, err
+		}
+	}
+	w.Accepted = true
+	return w, nil
+}
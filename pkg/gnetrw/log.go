@@ -0,0 +1,90 @@
+package gnetrw
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+)
+
+// Logger is the logging interface used by the framing package, the servers and the clients.
+// *slog.Logger implements it, other libraries such as zap can be adapted through slog handlers.
+// args are alternating key/value pairs, see the Key constants for the common keys.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// Common structured logging keys.
+const (
+	KeyAddr   = "addr"
+	KeyLen    = "len"
+	KeyErr    = "err"
+	KeyClient = "client"
+	KeyTopic  = "topic"
+)
+
+// LogLevel controls the level of the default logger, it starts at slog.LevelInfo.
+var LogLevel = new(slog.LevelVar)
+
+// Discard drops every record.
+var Discard Logger = slog.New(discardHandler{})
+
+var defaultLogger atomic.Value
+
+func init() {
+	defaultLogger.Store(loggerHolder{NewLogger(os.Stderr, LogLevel)})
+}
+
+// loggerHolder lets atomic.Value store different Logger implementations.
+type loggerHolder struct{ Logger }
+
+// NewLogger returns a text logger writing records at level or above to w.
+func NewLogger(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// SetLogger replaces the default logger used by TrafficData and by servers and
+// clients created without their own logger.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = Discard
+	}
+	defaultLogger.Store(loggerHolder{l})
+}
+
+// DefaultLogger returns the logger set by SetLogger.
+func DefaultLogger() Logger {
+	return defaultLogger.Load().(loggerHolder).Logger
+}
+
+// loggerOf returns the logger of svr when it provides one.
+func loggerOf(svr any) Logger {
+	if l, ok := svr.(interface{ Logger() Logger }); ok {
+		if logger := l.Logger(); logger != nil {
+			return logger
+		}
+	}
+	return DefaultLogger()
+}
+
+func addrOf(conn interface{ RemoteAddr() net.Addr }) string {
+	if conn == nil {
+		return ""
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
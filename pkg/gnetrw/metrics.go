@@ -0,0 +1,140 @@
+package gnetrw
+
+import (
+	"unixsocket/pkg/metrics"
+)
+
+// FrameMetrics are the instruments updated by the framing layer.
+type FrameMetrics struct {
+	FramesIn       metrics.Counter
+	FramesOut      metrics.Counter
+	BytesIn        metrics.Counter // on the wire, length prefix included
+	BytesOut       metrics.Counter
+	Reassemblies   metrics.Counter // frames that arrived over several reads
+	DispatchErrors metrics.Counter
+	Panics         metrics.Counter // recovered in TrafficData
+}
+
+// NewFrameMetrics creates the frame instruments in m with names starting with prefix.
+func NewFrameMetrics(m metrics.Metrics, prefix string) *FrameMetrics {
+	m = metrics.OrNop(m)
+	return &FrameMetrics{
+		FramesIn:       m.Counter(prefix+"_frames_in_total", "Frames received."),
+		FramesOut:      m.Counter(prefix+"_frames_out_total", "Frames sent."),
+		BytesIn:        m.Counter(prefix+"_bytes_in_total", "Bytes received, frame headers included."),
+		BytesOut:       m.Counter(prefix+"_bytes_out_total", "Bytes sent, frame headers included."),
+		Reassemblies:   m.Counter(prefix+"_partial_frame_reassemblies_total", "Frames reassembled from several reads."),
+		DispatchErrors: m.Counter(prefix+"_dispatch_errors_total", "Frames whose handler returned an error."),
+		Panics:         m.Counter(prefix+"_panics_total", "Panics recovered while handling traffic."),
+	}
+}
+
+var nopFrameMetrics = NewFrameMetrics(metrics.Nop, "")
+
+// FrameIn records a received frame with a payload of n bytes.
+func (fm *FrameMetrics) FrameIn(n int) {
+	fm.FramesIn.Add(1)
+	fm.BytesIn.Add(int64(n + 4))
+}
+
+// FrameOut records a sent frame with a payload of n bytes.
+func (fm *FrameMetrics) FrameOut(n int) {
+	fm.FramesOut.Add(1)
+	fm.BytesOut.Add(int64(n + 4))
+}
+
+// metricsOf returns the frame metrics of svr when it provides them.
+func metricsOf(svr any) *FrameMetrics {
+	if m, ok := svr.(interface{ FrameMetrics() *FrameMetrics }); ok {
+		if fm := m.FrameMetrics(); fm != nil {
+			return fm
+		}
+	}
+	return nopFrameMetrics
+}
+
+// ServerMetrics are the instruments of a Server.
+type ServerMetrics struct {
+	*FrameMetrics
+	ActiveConns     metrics.Gauge
+	AcceptedConns   metrics.Counter
+	ClosedConns     metrics.Counter
+	QueuedFrames    metrics.Gauge   // frames waiting for the worker pool
+	ReadPauses      metrics.Counter // times a connection was not read because of back-pressure
+	Throttled       metrics.Counter // frames over a rate limit
+	RejectedConns   metrics.Counter // refused by the admission limits
+	EvictedConns    metrics.Counter // idle connections closed above the soft limit
+	ActiveStreams   metrics.Gauge   // streamed messages being handled
+	MuxStreams      metrics.Gauge   // logical streams being served, see WithMux
+	CreditGranted   metrics.Counter // bytes of credit granted to clients, see WithFlowControl
+	AckedFrames     metrics.Counter // numbered messages handled, see WithAckedDelivery
+	DuplicateFrames metrics.Counter // numbered messages skipped as already handled
+	ResumedSessions metrics.Counter // client sessions resumed, see WithSessionResumption
+	ReplayedFrames  metrics.Counter // messages sent again on resumption
+}
+
+func NewServerMetrics(m metrics.Metrics, prefix string) *ServerMetrics {
+	m = metrics.OrNop(m)
+	return &ServerMetrics{
+		FrameMetrics:    NewFrameMetrics(m, prefix),
+		ActiveConns:     m.Gauge(prefix+"_connections_active", "Connections currently open."),
+		AcceptedConns:   m.Counter(prefix+"_connections_accepted_total", "Connections accepted."),
+		ClosedConns:     m.Counter(prefix+"_connections_closed_total", "Connections closed."),
+		QueuedFrames:    m.Gauge(prefix+"_worker_queued_frames", "Frames waiting for the worker pool."),
+		ReadPauses:      m.Counter(prefix+"_read_pauses_total", "Times reading a connection was paused by back-pressure."),
+		Throttled:       m.Counter(prefix+"_throttled_frames_total", "Frames over a rate limit."),
+		RejectedConns:   m.Counter(prefix+"_connections_rejected_total", "Connections refused by the admission limits."),
+		EvictedConns:    m.Counter(prefix+"_connections_evicted_total", "Idle connections closed above the soft limit."),
+		ActiveStreams:   m.Gauge(prefix+"_streams_active", "Streamed messages being handled."),
+		MuxStreams:      m.Gauge(prefix+"_mux_streams_active", "Logical streams being served."),
+		CreditGranted:   m.Counter(prefix+"_credit_granted_bytes_total", "Bytes of flow control credit granted to clients."),
+		AckedFrames:     m.Counter(prefix+"_acked_frames_total", "Numbered messages handled and acknowledged."),
+		DuplicateFrames: m.Counter(prefix+"_duplicate_frames_total", "Numbered messages skipped as already handled."),
+		ResumedSessions: m.Counter(prefix+"_sessions_resumed_total", "Client sessions resumed after a reconnection."),
+		ReplayedFrames:  m.Counter(prefix+"_replayed_frames_total", "Messages sent again on session resumption."),
+	}
+}
+
+// BrokerMetrics are the instruments of a Broker.
+type BrokerMetrics struct {
+	Subscriptions metrics.Gauge
+	Published     metrics.Counter
+	Delivered     metrics.Counter // messages handed to subscribers
+	SlowConsumers metrics.Counter // subscribers disconnected for a full buffer
+}
+
+func NewBrokerMetrics(m metrics.Metrics, prefix string) *BrokerMetrics {
+	m = metrics.OrNop(m)
+	return &BrokerMetrics{
+		Subscriptions: m.Gauge(prefix+"_subscriptions", "Topic subscriptions currently active."),
+		Published:     m.Counter(prefix+"_published_total", "Messages published."),
+		Delivered:     m.Counter(prefix+"_delivered_total", "Messages handed to subscribers."),
+		SlowConsumers: m.Counter(prefix+"_slow_consumers_total", "Subscribers disconnected because their buffer was full."),
+	}
+}
+
+// ClientMetrics are the instruments of the reconnecting clients.
+type ClientMetrics struct {
+	*FrameMetrics
+	ReconnectAttempts metrics.Counter
+	Connected         metrics.Gauge   // 1 while the connection is open
+	WriteQueue        metrics.Gauge   // messages waiting to be written
+	CreditStalls      metrics.Counter // times writing waited for flow control credit
+	Retransmits       metrics.Counter // messages sent again after a reconnection
+	Unacked           metrics.Gauge   // messages waiting for an acknowledgement
+	Outbox            metrics.Gauge   // messages kept on disk and not delivered yet
+}
+
+func NewClientMetrics(m metrics.Metrics, prefix string) *ClientMetrics {
+	m = metrics.OrNop(m)
+	return &ClientMetrics{
+		FrameMetrics:      NewFrameMetrics(m, prefix),
+		ReconnectAttempts: m.Counter(prefix+"_reconnect_attempts_total", "Connection attempts made."),
+		Connected:         m.Gauge(prefix+"_connected", "1 while the connection is open."),
+		WriteQueue:        m.Gauge(prefix+"_write_queue_depth", "Messages waiting to be written."),
+		CreditStalls:      m.Counter(prefix+"_credit_stalls_total", "Times writing waited for flow control credit."),
+		Retransmits:       m.Counter(prefix+"_retransmits_total", "Messages sent again after a reconnection."),
+		Unacked:           m.Gauge(prefix+"_unacked_messages", "Messages waiting for an acknowledgement."),
+		Outbox:            m.Gauge(prefix+"_outbox_messages", "Messages kept on disk and not delivered yet."),
+	}
+}
@@ -0,0 +1,708 @@
+package gnetrw
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FlagMux marks a frame of a multiplexed logical stream. Its payload starts with the
+// stream ID as a uvarint and a byte of frame type, then the data of the type.
+//
+//	flags(FlagMux) length | uvarint(id) type(1byte) | data
+//
+// Streams opened by the client have odd IDs, the ones opened by the server even IDs.
+const FlagMux byte = 0x20
+
+// Logical stream frame types.
+const (
+	muxOpen   byte = iota + 1 // a new stream
+	muxData                   // stream data, within the receive window of the peer
+	muxClose                  // the sender will not write anymore
+	muxReset                  // the stream is aborted, data is the reason
+	muxWindow                 // uvarint number of bytes the sender may write more
+)
+
+// CapabilityMux is announced in the handshake by the peers that multiplex streams.
+const CapabilityMux = "mux"
+
+const (
+	// DefaultMuxWindow is the number of bytes a stream may receive before it is read.
+	DefaultMuxWindow = 256 << 10
+	// DefaultMuxStreams is the number of streams a session may have open at once.
+	DefaultMuxStreams = 256
+
+	maxMuxData = 64 << 10
+)
+
+// MuxConfig tunes a Session, zero values use the defaults.
+type MuxConfig struct {
+	Window     int // receive window of each stream, at least DefaultMuxWindow
+	MaxStreams int // streams open at once, the peer's extra streams are reset
+}
+
+// Session multiplexes logical streams over one connection. It is safe for concurrent
+// use, but HandleFrame must be called by a single reader.
+type Session struct {
+	send   func(f *Frame) error
+	client bool
+	window int
+	max    int
+	onOpen func(st *Stream) // replaces the accept queue when set
+	closer io.Closer        // closed with the session
+	local  net.Addr
+	remote net.Addr
+
+	mu      sync.Mutex
+	streams map[uint64]*Stream
+	nextID  uint64
+	err     error // why the session closed
+	accept  chan *Stream
+	done    chan struct{}
+}
+
+// NewSession creates the session of one end of a connection, client tells which end.
+// send writes a frame to the peer, it must be safe for concurrent use. The peer's frames
+// with FlagMux are passed to HandleFrame.
+func NewSession(send func(f *Frame) error, client bool, cfg MuxConfig) *Session {
+	cfg.Window = max(cfg.Window, DefaultMuxWindow)
+	if cfg.MaxStreams <= 0 {
+		cfg.MaxStreams = DefaultMuxStreams
+	}
+	s := &Session{
+		send:    send,
+		client:  client,
+		window:  cfg.Window,
+		max:     cfg.MaxStreams,
+		streams: make(map[uint64]*Stream),
+		nextID:  2,
+		accept:  make(chan *Stream, cfg.MaxStreams),
+		done:    make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	}
+	return s
+}
+
+// NewClientSession runs a client session over conn, a blocking connection that
+// completed the handshake with CapabilityMux. A goroutine reads conn, handing the frames
+// without FlagMux to other, which may be nil. The session closes when reading fails,
+// and conn with it.
+func NewClientSession(conn net.Conn, cfg MuxConfig, other func(f *Frame)) *Session {
+	var mu sync.Mutex
+	s := NewSession(func(f *Frame) error {
+		buf, err := PackFrame(f)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		_, err = conn.Write(buf)
+		return err
+	}, true, cfg)
+	s.closer, s.local, s.remote = conn, conn.LocalAddr(), conn.RemoteAddr()
+
+	go func() {
+		r := bufio.NewReader(conn)
+		for {
+			f, err := ReadMessage(r)
+			if err == nil {
+				if f.Flags&FlagMux != 0 {
+					err = s.HandleFrame(f)
+				} else if other != nil {
+					other(f)
+				}
+			}
+			if err != nil {
+				s.closeWith(err)
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// Open starts a new stream, the peer accepts it without a round trip.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	if len(s.streams) >= s.max {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w: more than %d", ErrTooManyStreams, s.max)
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := s.newStream(id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.send(muxFrame(id, muxOpen, nil)); err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	st.update(s.window - DefaultMuxWindow)
+	return st, nil
+}
+
+// AcceptStream waits for a stream opened by the peer.
+func (s *Session) AcceptStream(ctx context.Context) (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Accept implements net.Listener, see AcceptStream.
+func (s *Session) Accept() (net.Conn, error) {
+	return s.AcceptStream(context.Background())
+}
+
+// Addr implements net.Listener, it is the local address of the connection.
+func (s *Session) Addr() net.Addr { return muxAddr{s.local, 0} }
+
+// Close aborts every stream without telling the peer, and closes the connection of
+// NewClientSession.
+func (s *Session) Close() error {
+	s.closeWith(ErrConnClosed)
+	return nil
+}
+
+// Err returns why the session closed, nil while it is open.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) closeWith(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint64]*Stream)
+	close(s.done)
+	s.mu.Unlock()
+
+	for _, st := range streams {
+		st.fail(err)
+	}
+	if s.closer != nil {
+		_ = s.closer.Close()
+	}
+}
+
+// HandleFrame processes a frame with FlagMux received from the peer. It never blocks
+// on the application, an error is a protocol violation and the connection should close.
+func (s *Session) HandleFrame(f *Frame) error {
+	id, n := binary.Uvarint(f.Payload)
+	if n <= 0 || n >= len(f.Payload) {
+		return fmt.Errorf("%w: malformed stream frame", ErrCorruptPayload)
+	}
+	typ, data := f.Payload[n], f.Payload[n+1:]
+
+	if typ == muxOpen {
+		return s.opened(id)
+	}
+	s.mu.Lock()
+	st := s.streams[id]
+	s.mu.Unlock()
+	if st == nil {
+		// frames of a stream already reset or of an older connection
+		return nil
+	}
+	switch typ {
+	case muxData:
+		if err := st.receive(data); err != nil {
+			_ = st.Reset(err.Error())
+		}
+	case muxClose:
+		st.remoteClosed()
+	case muxReset:
+		st.fail(fmt.Errorf("%w: %s", ErrStreamReset, data))
+		s.remove(id)
+	case muxWindow:
+		delta, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("%w: malformed window update", ErrCorruptPayload)
+		}
+		st.grant(delta)
+	default:
+		return fmt.Errorf("%w: unknown stream frame type %d", ErrCorruptPayload, typ)
+	}
+	return nil
+}
+
+func (s *Session) opened(id uint64) error {
+	if (id%2 == 1) == s.client {
+		return fmt.Errorf("%w: peer opened stream %d with our parity", ErrCorruptPayload, id)
+	}
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.streams[id] != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: stream %d opened twice", ErrCorruptPayload, id)
+	}
+	if len(s.streams) >= s.max {
+		s.mu.Unlock()
+		return s.send(muxFrame(id, muxReset, []byte(ErrTooManyStreams.Error())))
+	}
+	st := s.newStream(id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	st.update(s.window - DefaultMuxWindow)
+	if s.onOpen != nil {
+		s.onOpen(st)
+		return nil
+	}
+	select {
+	case s.accept <- st:
+	default:
+		// the streams the peer closed before they were accepted still fill the queue
+		s.remove(id)
+		return s.send(muxFrame(id, muxReset, []byte(ErrTooManyStreams.Error())))
+	}
+	return nil
+}
+
+func (s *Session) newStream(id uint64) *Stream {
+	return &Stream{
+		id:         id,
+		sess:       s,
+		recvWindow: s.window,
+		sendWindow: DefaultMuxWindow,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+}
+
+func (s *Session) remove(id uint64) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func muxFrame(id uint64, typ byte, data []byte) *Frame {
+	payload := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+1+len(data)), id)
+	payload = append(payload, typ)
+	return &Frame{Flags: FlagMux, Payload: append(payload, data...)}
+}
+
+// Stream is a logical stream of a Session, it implements net.Conn.
+//
+// Both ends start with a send window of DefaultMuxWindow bytes, sessions with a larger
+// MuxConfig.Window grant the difference as soon as the stream opens.
+type Stream struct {
+	id   uint64
+	sess *Session
+
+	writeMu sync.Mutex // the chunks of concurrent writes do not interleave
+
+	mu          sync.Mutex
+	buf         [][]byte
+	size        int   // bytes buffered
+	recvWindow  int   // bytes the peer may still send
+	consumed    int   // bytes read and not yet granted back to the peer
+	sendWindow  int   // bytes we may still send
+	readErr     error // returned once the buffer is drained
+	writeErr    error
+	localClosed bool // we sent muxClose
+	closed      bool // Close was called, received data is dropped
+	remoteFin   bool // the peer sent muxClose
+	reset       bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readReady     chan struct{}
+	writeReady    chan struct{}
+}
+
+// ID returns the stream ID, odd for the streams opened by the client.
+func (st *Stream) ID() uint64 { return st.id }
+
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if expired(st.readDeadline) {
+			st.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		if st.size > 0 {
+			n := 0
+			for n < len(p) && len(st.buf) > 0 {
+				m := copy(p[n:], st.buf[0])
+				n += m
+				if m == len(st.buf[0]) {
+					st.buf[0] = nil
+					st.buf = st.buf[1:]
+				} else {
+					st.buf[0] = st.buf[0][m:]
+				}
+			}
+			st.size -= n
+			delta := st.consume(n)
+			st.mu.Unlock()
+			st.update(delta)
+			return n, nil
+		}
+		if st.readErr != nil {
+			err := st.readErr
+			st.mu.Unlock()
+			return 0, err
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		if err := wait(st.readReady, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	st.writeMu.Lock()
+	defer st.writeMu.Unlock()
+	n := 0
+	for n < len(p) {
+		st.mu.Lock()
+		if st.writeErr != nil {
+			err := st.writeErr
+			st.mu.Unlock()
+			return n, err
+		}
+		if expired(st.writeDeadline) {
+			st.mu.Unlock()
+			return n, os.ErrDeadlineExceeded
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := wait(st.writeReady, deadline); err != nil {
+				return n, err
+			}
+			continue
+		}
+		k := min(len(p)-n, st.sendWindow, maxMuxData)
+		st.sendWindow -= k
+		st.mu.Unlock()
+
+		if err := st.sess.send(muxFrame(st.id, muxData, p[n:n+k])); err != nil {
+			return n, err
+		}
+		n += k
+	}
+	return n, nil
+}
+
+// CloseWrite tells the peer that nothing more will be written, its reads end with
+// io.EOF. Reading goes on until the peer closes too.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.localClosed || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	if st.writeErr == nil {
+		st.writeErr = net.ErrClosed
+	}
+	done := st.remoteFin
+	st.mu.Unlock()
+	notify(st.writeReady)
+
+	err := st.sess.send(muxFrame(st.id, muxClose, nil))
+	if done {
+		st.sess.remove(st.id)
+	}
+	return err
+}
+
+// Close closes both directions. Data the peer still sends is dropped, but granted back
+// so its writes do not block.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	dropped := st.size
+	st.buf, st.size = nil, 0
+	delta := st.consume(dropped)
+	if st.readErr == nil || st.readErr == io.EOF {
+		st.readErr = net.ErrClosed
+	}
+	st.mu.Unlock()
+	notify(st.readReady)
+
+	st.update(delta)
+	return st.CloseWrite()
+}
+
+// Reset aborts the stream on both ends, reason is given to the peer.
+func (st *Stream) Reset(reason string) error {
+	st.fail(fmt.Errorf("%w: %s", ErrStreamReset, reason))
+	st.sess.remove(st.id)
+	return st.sess.send(muxFrame(st.id, muxReset, []byte(reason)))
+}
+
+func (st *Stream) LocalAddr() net.Addr  { return muxAddr{st.sess.local, st.id} }
+func (st *Stream) RemoteAddr() net.Addr { return muxAddr{st.sess.remote, st.id} }
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readReady)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writeReady)
+	return nil
+}
+
+// receive buffers data from the peer, it fails when the peer overruns the window.
+func (st *Stream) receive(data []byte) error {
+	st.mu.Lock()
+	if len(data) > st.recvWindow {
+		st.mu.Unlock()
+		return fmt.Errorf("flow control violation, %d bytes over a window of %d", len(data), st.recvWindow)
+	}
+	st.recvWindow -= len(data)
+	if st.closed || st.reset || st.remoteFin {
+		delta := st.consume(len(data))
+		st.mu.Unlock()
+		st.update(delta)
+		return nil
+	}
+	st.buf = append(st.buf, append([]byte(nil), data...))
+	st.size += len(data)
+	st.mu.Unlock()
+	notify(st.readReady)
+	return nil
+}
+
+// consume records n bytes read and returns the window to grant back to the peer,
+// once half of it is used. st.mu must be held.
+func (st *Stream) consume(n int) int {
+	st.consumed += n
+	if st.consumed < st.sess.window/2 {
+		return 0
+	}
+	delta := st.consumed
+	st.consumed = 0
+	st.recvWindow += delta
+	return delta
+}
+
+func (st *Stream) update(delta int) {
+	if delta > 0 {
+		_ = st.sess.send(muxFrame(st.id, muxWindow, binary.AppendUvarint(nil, uint64(delta))))
+	}
+}
+
+func (st *Stream) grant(delta uint64) {
+	st.mu.Lock()
+	st.sendWindow += int(min(delta, maxMuxGrant))
+	st.mu.Unlock()
+	notify(st.writeReady)
+}
+
+// maxMuxGrant bounds window updates so a broken peer cannot overflow the window.
+const maxMuxGrant = 1 << 30
+
+func (st *Stream) remoteClosed() {
+	st.mu.Lock()
+	st.remoteFin = true
+	if st.readErr == nil {
+		st.readErr = io.EOF
+	}
+	done := st.localClosed
+	st.mu.Unlock()
+	notify(st.readReady)
+	if done {
+		st.sess.remove(st.id)
+	}
+}
+
+// fail ends both directions with err, unless they already ended.
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	st.reset = true
+	if st.readErr == nil || st.readErr == io.EOF {
+		st.readErr = err
+	}
+	if st.writeErr == nil {
+		st.writeErr = err
+	}
+	st.mu.Unlock()
+	notify(st.readReady)
+	notify(st.writeReady)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// wait blocks until ready is signaled or the deadline passes.
+func wait(ready <-chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ready
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ready:
+		return nil
+	case <-t.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// muxAddr is the address of a stream, the address of its connection and the stream ID.
+type muxAddr struct {
+	conn net.Addr
+	id   uint64
+}
+
+func (a muxAddr) Network() string { return "mux" }
+
+func (a muxAddr) String() string {
+	base := "session"
+	if a.conn != nil {
+		base = a.conn.String()
+	}
+	return base + "#" + strconv.FormatUint(a.id, 10)
+}
+
+// MuxHandler serves a logical stream opened by the client, on its own goroutine.
+// The stream is closed when it returns, an error resets it instead.
+type MuxHandler func(ctx context.Context, c *Conn, st *Stream) error
+
+// WithMux lets clients open logical streams on their connection, served by h. It is
+// announced as CapabilityMux in the handshake, see Conn.OpenStream for the other way.
+func WithMux(h MuxHandler, cfg MuxConfig) Option {
+	return func(s *Server) {
+		s.onMux = h
+		s.muxConfig = cfg
+	}
+}
+
+// OpenStream opens a logical stream to the client, it is safe to call from any goroutine.
+// It fails with ErrMuxNotSupported unless the client negotiated CapabilityMux.
+func (c *Conn) OpenStream() (*Stream, error) {
+	if c.mux == nil || (c.srv.handshake != nil && !c.muxReady()) {
+		return nil, ErrMuxNotSupported
+	}
+	return c.mux.Open()
+}
+
+func (c *Conn) muxReady() bool {
+	c.srv.mu.RLock()
+	defer c.srv.mu.RUnlock()
+	return c.HasCapability(CapabilityMux)
+}
+
+// newMux creates the session of c, it runs on the event loop in OnOpen.
+func (s *Server) newMux(c *Conn) {
+	c.mux = NewSession(func(f *Frame) error {
+		n, err := AsyncWritePackFrame(c, f)
+		if err == nil {
+			s.metrics.FrameOut(n)
+		}
+		return err
+	}, false, s.muxConfig)
+	c.mux.local, c.mux.remote = c.LocalAddr(), c.RemoteAddr()
+	addr := addrOf(c) // the gnet connection is released on close
+	c.mux.onOpen = func(st *Stream) {
+		s.metrics.MuxStreams.Add(1)
+		go s.serveMux(c, addr, st)
+	}
+}
+
+// muxFrame hands a logical stream frame to the session of c, on the event loop.
+func (s *Server) muxFrame(c *Conn, f *Frame) error {
+	if c.mux == nil || (s.handshake != nil && !c.HasCapability(CapabilityMux)) {
+		return fmt.Errorf("%w: stream frame without multiplexing", ErrUnknownType)
+	}
+	return c.mux.HandleFrame(f)
+}
+
+func (s *Server) serveMux(c *Conn, addr string, st *Stream) {
+	defer s.metrics.MuxStreams.Add(-1)
+	ctx, span := s.tracer.Start(context.Background(), "gnetrw.mux", SpanKindServer)
+	defer span.End()
+
+	err := func() (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				p := &PanicError{Value: v, Stack: debug.Stack()}
+				s.metrics.Panics.Add(1)
+				s.logger.Error("stream panic", KeyAddr, addr, "stream", st.id, "panic", v, "stack", string(p.Stack))
+				err = p
+			}
+		}()
+		return s.onMux(ctx, c, st)
+	}()
+	if err != nil {
+		span.SetError(err)
+		s.logger.Warn("reset stream", KeyAddr, addr, "stream", st.id, KeyErr, err)
+		reason := err.Error()
+		if errors.Is(err, ErrPanic) {
+			reason = "internal error"
+		}
+		_ = st.Reset(reason)
+		return
+	}
+	_ = st.Close()
+}
@@ -0,0 +1,255 @@
+package gnetrw
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sessionPair connects a client and a server session, each peer reads its frames on
+// its own goroutine like a connection reader.
+func sessionPair(t *testing.T, client, server MuxConfig) (*Session, *Session) {
+	t.Helper()
+	toClient, toServer := make(chan *Frame, 1024), make(chan *Frame, 1024)
+	c := NewSession(func(f *Frame) error { toServer <- f; return nil }, true, client)
+	s := NewSession(func(f *Frame) error { toClient <- f; return nil }, false, server)
+	var wg sync.WaitGroup
+	read := func(sess *Session, in chan *Frame) {
+		defer wg.Done()
+		for f := range in {
+			if err := sess.HandleFrame(f); err != nil {
+				sess.closeWith(err)
+			}
+		}
+	}
+	wg.Add(2)
+	go read(c, toClient)
+	go read(s, toServer)
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+		close(toClient)
+		close(toServer)
+		wg.Wait()
+	})
+	return c, s
+}
+
+func accept(t *testing.T, s *Session) *Stream {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	st, err := s.AcceptStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestMuxSession(t *testing.T) {
+	client, server := sessionPair(t, MuxConfig{}, MuxConfig{})
+	cst, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cst.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	cst.CloseWrite()
+
+	sst := accept(t, server)
+	if sst.ID() != cst.ID() || sst.ID()%2 != 1 {
+		t.Fatalf("stream IDs %d and %d, want the same odd one", cst.ID(), sst.ID())
+	}
+	if data, err := io.ReadAll(sst); string(data) != "hello" || err != nil {
+		t.Fatalf("server read %q, %v", data, err)
+	}
+	if _, err := sst.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+	if data, err := io.ReadAll(cst); string(data) != "world" || err != nil {
+		t.Fatalf("client read %q, %v", data, err)
+	}
+	if _, err := cst.Write([]byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("write after CloseWrite: err = %v", err)
+	}
+
+	// the other way, server streams have even IDs
+	sst, err = server.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cst = accept(t, client); cst.ID() != sst.ID() || cst.ID()%2 != 0 {
+		t.Fatalf("server stream IDs %d and %d, want the same even one", sst.ID(), cst.ID())
+	}
+}
+
+func TestMuxWindow(t *testing.T) {
+	client, server := sessionPair(t, MuxConfig{}, MuxConfig{})
+	cst, _ := client.Open()
+	sst := accept(t, server)
+
+	// nothing is read, the writer stops at the window
+	cst.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	data := bytes.Repeat([]byte("0123456789abcdef"), DefaultMuxWindow/8)
+	n, err := cst.Write(data)
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != DefaultMuxWindow {
+		t.Fatalf("Write = %d, %v, want the window and a deadline error", n, err)
+	}
+
+	// reading grants the window back
+	cst.SetWriteDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := cst.Write(data[n:])
+		cst.CloseWrite()
+		done <- err
+	}()
+	got, err := io.ReadAll(sst)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v, want %d", len(got), err, len(data))
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxReset(t *testing.T) {
+	client, server := sessionPair(t, MuxConfig{}, MuxConfig{})
+	cst, _ := client.Open()
+	sst := accept(t, server)
+	if err := sst.Reset("bye"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cst.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) || !strings.Contains(err.Error(), "bye") {
+		t.Fatalf("read of a reset stream: err = %v", err)
+	}
+	if _, err := cst.Write([]byte("x")); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("write to a reset stream: err = %v", err)
+	}
+	if server.NumStreams() != 0 {
+		t.Fatalf("%d streams left after a reset", server.NumStreams())
+	}
+}
+
+func TestMuxTooManyStreams(t *testing.T) {
+	client, server := sessionPair(t, MuxConfig{MaxStreams: 2}, MuxConfig{MaxStreams: 1})
+	first, _ := client.Open()
+	second, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server refuses the stream over its limit
+	if _, err := second.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("stream over the server limit: err = %v, want ErrStreamReset", err)
+	}
+	accept(t, server)
+	if _, err := client.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Open(); !errors.Is(err, ErrTooManyStreams) {
+		t.Fatalf("Open over the client limit: err = %v, want ErrTooManyStreams", err)
+	}
+	first.Close()
+}
+
+func TestMuxClose(t *testing.T) {
+	client, server := sessionPair(t, MuxConfig{}, MuxConfig{})
+	cst, _ := client.Open()
+	accept(t, server)
+	client.closeWith(ErrConnClosed)
+	if _, err := cst.Read(make([]byte, 1)); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("read after the session closed: err = %v", err)
+	}
+	if _, err := client.Open(); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("Open after the session closed: err = %v", err)
+	}
+	if _, err := client.AcceptStream(context.Background()); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("AcceptStream after the session closed: err = %v", err)
+	}
+}
+
+func TestMuxProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		f    *Frame
+	}{
+		{"malformed", &Frame{Flags: FlagMux, Payload: []byte{1}}},
+		{"client parity", muxFrame(2, muxOpen, nil)},
+		{"opened twice", muxFrame(1, muxOpen, nil)},
+		{"unknown type", muxFrame(1, 99, nil)},
+		{"bad window", muxFrame(1, muxWindow, []byte{0x80})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSession(func(f *Frame) error { return nil }, false, MuxConfig{})
+			if err := s.HandleFrame(muxFrame(1, muxOpen, nil)); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.HandleFrame(tt.f); !errors.Is(err, ErrCorruptPayload) {
+				t.Fatalf("HandleFrame: err = %v, want ErrCorruptPayload", err)
+			}
+		})
+	}
+}
+
+// muxFrames returns the mux frames of stream id written to fc by type.
+func muxFrames(t *testing.T, fc *fakeConn, id uint64) map[byte][]byte {
+	t.Helper()
+	got := make(map[byte][]byte)
+	for _, f := range fc.frames(t) {
+		sid, n := binary.Uvarint(f.Payload)
+		if f.Flags&FlagMux == 0 || sid != id {
+			t.Fatalf("unexpected frame %#x %x", f.Flags, f.Payload)
+		}
+		got[f.Payload[n]] = append(got[f.Payload[n]], f.Payload[n+1:]...)
+	}
+	return got
+}
+
+func TestServerMux(t *testing.T) {
+	echo := func(ctx context.Context, c *Conn, st *Stream) error {
+		_, err := io.Copy(st, st)
+		return err
+	}
+	s := NewServer("", nil, WithLogger(Discard), WithMux(echo, MuxConfig{}))
+	c, fc := openConn(t, s)
+	traffic(t, s, fc, muxFrame(1, muxOpen, nil), muxFrame(1, muxData, []byte("ping")), muxFrame(1, muxClose, nil))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.mux.NumStreams() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	got := muxFrames(t, fc, 1)
+	if string(got[muxData]) != "ping" {
+		t.Fatalf("echoed %q, want ping", got[muxData])
+	}
+	if _, ok := got[muxClose]; !ok {
+		t.Fatal("stream not closed once the handler returned")
+	}
+
+	st, err := c.OpenStream()
+	if err != nil || st.ID()%2 != 0 {
+		t.Fatalf("OpenStream = %v, %v", st, err)
+	}
+
+	// with a handshake the client must negotiate multiplexing
+	s = NewServer("", nil, WithLogger(Discard), WithMux(echo, MuxConfig{}), WithHandshake(HandshakeConfig{}))
+	c, fc = openConn(t, s)
+	c.welcome = &Welcome{Accepted: true, Version: ProtocolVersion}
+	if _, err := c.OpenStream(); !errors.Is(err, ErrMuxNotSupported) {
+		t.Fatalf("OpenStream without the capability: err = %v", err)
+	}
+	if err := s.muxFrame(c, muxFrame(1, muxOpen, nil)); !errors.Is(err, ErrUnknownType) {
+		t.Fatalf("mux frame without the capability: err = %v", err)
+	}
+}
@@ -2,21 +2,18 @@ package gnetrw
 
 import (
 	"bytes"
-	"encoding/binary"
-	"errors"
+	"fmt"
 	"io"
-
-	"log"
+	"runtime/debug"
 
 	"github.com/panjf2000/gnet/v2"
 )
 
-var (
-	ErrBufferOverflow = errors.New("data exceeds 10M limit")
-	ErrEmptySendData  = errors.New("empoty send data")
-	ErrConnectClsoed  = errors.New("connect closed")
-)
-
+// DataDispatch stores partial frames per connection and handles complete ones.
+// DispatchData receives the payload only, implement FrameDispatch to receive headers too.
+// Implementations may also provide `Logger() Logger` and `FrameMetrics() *FrameMetrics`
+// to receive TrafficData's logs and measurements,
+// and implement ErrorHandler to learn why a connection is closed.
 type DataDispatch interface {
 	GetPartData(conn gnet.Conn) *PartData
 	AddPartData(conn gnet.Conn, datalen int) *PartData
@@ -24,7 +21,14 @@ type DataDispatch interface {
 	DispatchData(conn gnet.Conn, msg []byte) error
 }
 
+// FrameDispatch may be implemented by a DataDispatch to receive decoded frames
+// instead of DispatchData. The frame is only valid during the call.
+type FrameDispatch interface {
+	DispatchFrame(conn gnet.Conn, f *Frame) error
+}
+
 type PartData struct {
+	Flags   byte
 	DataLen int
 	ReadLen int
 	buf     bytes.Buffer
@@ -41,37 +45,64 @@ func (p *PartData) Data() []byte {
 }
 
 func (p *PartData) Clear() {
+	p.Flags = 0
 	p.DataLen = 0
 	p.ReadLen = 0
 	p.buf.Reset()
 }
 
-func TrafficData(svr DataDispatch, conn gnet.Conn) gnet.Action {
+// TrafficData reads the complete frames buffered on conn and dispatches them.
+// A panic only closes conn, see PanicHandler.
+func TrafficData(svr DataDispatch, conn gnet.Conn) (action gnet.Action) {
 	var (
+		flags   byte
 		dataLen int
 		readLen int
 		err     error
 		part    *PartData
 	)
 
-	// 数据格式：uint32(4byte) + Data
+	// 数据格式：uint32(4byte) + Data，见 frame.go
 	// xx xx xx xx | ......
 	// 第一次读取时优先获取内容长度，读取内容不完整时暂存，下次触发时需要继续读取内容。
 	part = svr.GetPartData(conn)
+	logger := loggerOf(svr)
+	fm := metricsOf(svr)
+
+	fail := func(op string, dataLen int, err error) gnet.Action {
+		err = &FrameError{Op: op, Addr: addrOf(conn), Len: dataLen, Err: err}
+		logger.Warn("close connection", KeyAddr, addrOf(conn), KeyLen, dataLen, KeyErr, err)
+		reportError(svr, conn, err)
+		return gnet.Close
+	}
+	defer func() {
+		// a panic outside the handler, the framing state of conn is lost
+		if v := recover(); v != nil {
+			p := &PanicError{Value: v, Stack: debug.Stack()}
+			fm.Panics.Add(1)
+			logger.Error("traffic panic", KeyAddr, addrOf(conn), "panic", v, "stack", string(p.Stack))
+			action = fail("read", dataLen, p)
+		}
+	}()
 
 	for {
 		readLen = 0
 		if part == nil {
-			if dataLen, err = readDataLen(conn); err != nil {
-				if err != io.EOF {
-					log.Printf("read conn data length, %v", err)
+			if readPaused(svr, conn) {
+				if n := conn.InboundBuffered(); n > MaxPausedInbound {
+					return fail("read", n, ErrInboundOverflow)
 				}
-				return gnet.Close
+				// the rest stays buffered until conn is woken
+				return gnet.None
+			}
+			if flags, dataLen, err = readDataLen(conn); err != nil {
+				return fail("read", dataLen, err)
 			}
 			if dataLen <= 0 {
 				return gnet.None
 			}
 		} else {
+			flags = part.Flags
 			dataLen = part.DataLen
 			readLen = part.ReadLen
 		}
@@ -84,53 +115,99 @@ func TrafficData(svr DataDispatch, conn gnet.Conn) gnet.Action {
 				msg, _ = conn.Next(-1)
 				if part == nil {
 					part = svr.AddPartData(conn, dataLen)
+					part.Flags = flags
 				}
 				part.Put(msg)
+				logger.Debug("partial frame", KeyAddr, addrOf(conn), KeyLen, dataLen, "read", part.ReadLen)
 				return gnet.None
 			}
-			log.Printf("read conn data, %v", err)
-			return gnet.Close
+			return fail("read", dataLen, err)
 		}
 
 		// When there are data fragments, they must be concatenated before calling the message handler.
-		if part == nil {
-			if err = svr.DispatchData(conn, msg); err != nil {
-				log.Printf("handler traffic data, %v", err)
-				return gnet.Close
-			}
-		} else {
+		if part != nil {
 			// exist part message
-			if part.Put(msg) == dataLen {
-				msg = part.Data()
-				if err = svr.DispatchData(conn, msg); err != nil {
-					log.Printf("handler traffic data, %v", err)
-					return gnet.Close
-				}
-				part = nil
-				svr.RemovePartData(conn)
+			if part.Put(msg) != dataLen {
+				continue
 			}
+			msg = part.Data()
+			fm.Reassemblies.Add(1)
+		}
+		fm.FrameIn(dataLen)
+
+		f, err := DecodeFrame(flags, msg)
+		if err != nil {
+			return fail("decode", dataLen, err)
+		}
+		err = safeDispatch(svr, conn, f)
+		if p, ok := err.(*PanicError); ok {
+			fm.Panics.Add(1)
+			logger.Error("dispatch panic", KeyAddr, addrOf(conn), KeyLen, dataLen, "panic", p.Value, "stack", string(p.Stack))
+			err = handlePanic(svr, conn, f, p)
+		}
+		if err != nil {
+			fm.DispatchErrors.Add(1)
+			return fail("dispatch", dataLen, fmt.Errorf("%w: %w", ErrHandler, err))
+		}
+		if part != nil {
+			part = nil
+			svr.RemovePartData(conn)
 		}
 	}
 }
-func WritePackData(conn gnet.Conn, data []byte) (int, error) {
-	n := len(data)
-	if n == 0 {
-		return 0, ErrEmptySendData
+
+func readPaused(svr DataDispatch, conn gnet.Conn) bool {
+	p, ok := svr.(ReadPauser)
+	return ok && p.ReadPaused(conn)
+}
+
+// safeDispatch dispatches f, turning a panic into a *PanicError.
+func safeDispatch(svr DataDispatch, conn gnet.Conn, f *Frame) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return dispatchFrame(svr, conn, f)
+}
+
+func handlePanic(svr DataDispatch, conn gnet.Conn, f *Frame, p *PanicError) error {
+	if h, ok := svr.(PanicHandler); ok {
+		return h.HandlePanic(conn, f, p)
 	}
+	return p
+}
+
+func dispatchFrame(svr DataDispatch, conn gnet.Conn, f *Frame) error {
+	if fd, ok := svr.(FrameDispatch); ok {
+		return fd.DispatchFrame(conn, f)
+	}
+	return svr.DispatchData(conn, f.Payload)
+}
+
+func WritePackData(conn gnet.Conn, data []byte) (int, error) {
+	return WritePackFrame(conn, &Frame{Payload: data})
+}
+
+// WritePackFrame writes f on the event loop of conn and returns the length written
+// after the prefix. Only send headers to peers that negotiated HeaderVersion.
+// The payload is compressed when conn negotiated a compression, see Compressor.
+func WritePackFrame(conn gnet.Conn, f *Frame) (int, error) {
 	if conn == nil {
-		return 0, ErrConnectClsoed
+		return 0, ErrConnClosed
 	}
 
-	var buf bytes.Buffer
-	length := uint32(len(data))
-	if err := binary.Write(&buf, binary.BigEndian, length); err != nil {
+	f, err := compressorOf(conn).Compress(f)
+	if err != nil {
+		return 0, err
+	}
+	buf, err := PackFrame(f)
+	if err != nil {
 		return 0, err
 	}
-	buf.Write(data)
-	// buf.WriteByte(0)
 
 	// 确保完整写入
-	n, err := conn.Write(buf.Bytes())
+	n, err := conn.Write(buf)
 	if err != nil {
 		return -1, err
 	}
@@ -140,14 +217,38 @@ func WritePackData(conn gnet.Conn, data []byte) (int, error) {
 	return n - 4, nil
 }
 
-func readDataLen(conn gnet.Conn) (int, error) {
+// AsyncWritePackFrame is WritePackFrame for goroutines other than the event loop,
+// the frame is queued with AsyncWrite.
+func AsyncWritePackFrame(conn gnet.Conn, f *Frame) (int, error) {
+	if conn == nil {
+		return 0, ErrConnClosed
+	}
+
+	f, err := compressorOf(conn).Compress(f)
+	if err != nil {
+		return 0, err
+	}
+	buf, err := PackFrame(f)
+	if err != nil {
+		return 0, err
+	}
+	if err = conn.AsyncWrite(buf, nil); err != nil {
+		return -1, err
+	}
+	return len(buf) - 4, nil
+}
+
+func readDataLen(conn gnet.Conn) (byte, int, error) {
 	lenBuf, err := conn.Next(4)
 	if err != nil {
 		if err == io.ErrShortBuffer {
-			return 0, nil
+			return 0, 0, nil
 		}
-		return 0, err
+		return 0, 0, err
+	}
+	flags, dataLen := splitPrefix(lenBuf)
+	if dataLen > MaxFrameSize {
+		return flags, dataLen, ErrFrameTooLarge
 	}
-	dataLen := int(binary.BigEndian.Uint32(lenBuf))
-	return dataLen, err
+	return flags, dataLen, nil
 }
@@ -0,0 +1,114 @@
+package gnetrw
+
+import (
+	"fmt"
+	"time"
+
+	"unixsocket/pkg/ratelimit"
+)
+
+// RateAction is what the server does with a frame over a rate limit.
+type RateAction int
+
+const (
+	RateDelay      RateAction = iota // handle it, then stop reading the connection until the debt is paid
+	RateDrop                         // discard it
+	RateReply                        // discard it and answer with a CodeRateLimited error frame
+	RateDisconnect                   // close the connection
+)
+
+func (a RateAction) String() string {
+	switch a {
+	case RateDelay:
+		return "delay"
+	case RateDrop:
+		return "drop"
+	case RateReply:
+		return "reply"
+	case RateDisconnect:
+		return "disconnect"
+	}
+	return fmt.Sprintf("RateAction(%d)", int(a))
+}
+
+// Rate limits frames and payload bytes per second, a zero rate is unlimited.
+// Bursts under 1 allow one second worth.
+type Rate struct {
+	Frames     float64
+	FrameBurst int
+	Bytes      float64
+	ByteBurst  int
+}
+
+// RateLimits are enforced on every frame after the handshake, on the event loop.
+type RateLimits struct {
+	PerConn Rate
+	Global  Rate // shared by all connections
+	Action  RateAction
+}
+
+// WithRateLimit throttles clients, see RateLimits.
+func WithRateLimit(l RateLimits) Option {
+	return func(s *Server) {
+		s.limits = &l
+		s.global = newLimiter(l.Global)
+	}
+}
+
+// limiter holds the buckets of one Rate.
+type limiter struct {
+	frames *ratelimit.Bucket
+	bytes  *ratelimit.Bucket
+}
+
+func newLimiter(r Rate) limiter {
+	return limiter{
+		frames: ratelimit.NewBucket(r.Frames, r.FrameBurst),
+		bytes:  ratelimit.NewBucket(r.Bytes, r.ByteBurst),
+	}
+}
+
+// requests returns the tokens a frame of n bytes takes from l.
+func (l limiter) requests(n int) []ratelimit.Request {
+	return []ratelimit.Request{{Bucket: l.frames, N: 1}, {Bucket: l.bytes, N: float64(n)}}
+}
+
+func (l limiter) take(now time.Time, n int) time.Duration {
+	return max(l.frames.Take(now, 1), l.bytes.Take(now, float64(n)))
+}
+
+// throttle applies the rate limits to f. It reports whether f should still be handled,
+// an error closes the connection.
+func (s *Server) throttle(c *Conn, f *Frame) (bool, error) {
+	now := time.Now()
+	n := len(f.Payload)
+	action := s.limits.Action
+	if (action == RateDrop || action == RateReply) && c.ack != nil && f.Header.Get(HeaderSeq) != "" {
+		// acknowledgements are cumulative, a dropped message would be acknowledged
+		action = RateDelay
+	}
+	if action == RateDelay {
+		wait := max(c.limit.take(now, n), s.global.take(now, n))
+		if wait > 0 {
+			s.metrics.Throttled.Add(1)
+			c.resumeAt = now.Add(wait)
+			time.AfterFunc(wait, func() { _ = c.Wake(nil) })
+			s.logger.Debug("rate limited, delay reading", KeyAddr, addrOf(c), "wait", wait)
+		}
+		return true, nil
+	}
+
+	// a refused frame takes no token, from the connection buckets nor the global ones
+	if ratelimit.AllowAll(now, append(c.limit.requests(n), s.global.requests(n)...)...) {
+		return true, nil
+	}
+	s.metrics.Throttled.Add(1)
+	s.logger.Debug("rate limited", KeyAddr, addrOf(c), KeyLen, n, "action", action)
+	switch action {
+	case RateReply:
+		return false, writeRouteError(c, &RouteError{Code: CodeRateLimited, Route: RouteOf(f)}, false)
+	case RateDisconnect:
+		return false, fmt.Errorf("%w: %d bytes", ErrRateLimited, n)
+	}
+	return false, nil
+}
@@ -0,0 +1,118 @@
+package gnetrw
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+func TestRateLimitActions(t *testing.T) {
+	// two frames pass, the rate is too low to refill during the test
+	perConn := Rate{Frames: 0.001, FrameBurst: 2}
+	tests := []struct {
+		action  RateAction
+		handled int
+		errors  int // error frames
+		closed  bool
+		paused  bool
+	}{
+		{RateDrop, 2, 0, false, false},
+		{RateReply, 2, 2, false, false},
+		{RateDisconnect, 2, 0, true, false},
+		// handled, then the rest waits for the debt to be paid
+		{RateDelay, 3, 0, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action.String(), func(t *testing.T) {
+			r := newRecorder(-1)
+			var failed error
+			s := NewServer("", r.handle, WithLogger(Discard), WithRateLimit(RateLimits{PerConn: perConn, Action: tt.action}),
+				WithOnError(func(c *Conn, err error) { failed = err }))
+			c, fc := openConn(t, s)
+			c.headers.Store(true)
+
+			action := traffic(t, s, fc, messages("m", 4)...)
+			if (action == gnet.Close) != tt.closed {
+				t.Fatalf("action %v, want closed %v", action, tt.closed)
+			}
+			if tt.closed && !errors.Is(failed, ErrRateLimited) {
+				t.Errorf("error %v, want ErrRateLimited", failed)
+			}
+			if got := len(r.handled[c.ID()]); got != tt.handled {
+				t.Errorf("handled %d frames, want %d", got, tt.handled)
+			}
+			errs := 0
+			for _, f := range fc.frames(t) {
+				if e := DecodeError(f); e != nil {
+					if e.Code != CodeRateLimited {
+						t.Errorf("error frame %+v", e)
+					}
+					errs++
+				}
+			}
+			if errs != tt.errors {
+				t.Errorf("%d error frames, want %d", errs, tt.errors)
+			}
+			if paused := s.ReadPaused(fc); !tt.closed && (paused != tt.paused || (len(fc.in) > 0) != tt.paused) {
+				t.Errorf("paused %v with %d bytes left, want %v", paused, len(fc.in), tt.paused)
+			}
+		})
+	}
+}
+
+func TestRateLimitRefusedTakesNothing(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits RateLimits
+		sizes  []int  // payload sizes sent in turn
+		passed []bool // by the limits
+	}{
+		{
+			// the second frame is over the bytes, its frame token is kept for the third
+			name:   "bytes refuse",
+			limits: RateLimits{PerConn: Rate{Frames: 0.001, FrameBurst: 2, Bytes: 0.001, ByteBurst: 10}},
+			sizes:  []int{8, 8, 2, 1},
+			passed: []bool{true, false, true, false},
+		},
+		{
+			// refused by the global bytes, the connection keeps its frame tokens
+			name: "global refuses",
+			limits: RateLimits{PerConn: Rate{Frames: 0.001, FrameBurst: 2},
+				Global: Rate{Bytes: 0.001, ByteBurst: 10}},
+			sizes:  []int{8, 8, 2, 1},
+			passed: []bool{true, false, true, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.limits.Action = RateDrop
+			r := newRecorder(-1)
+			s := NewServer("", r.handle, WithLogger(Discard), WithRateLimit(tt.limits))
+			c, fc := openConn(t, s)
+			for i, n := range tt.sizes {
+				before := len(r.handled[c.ID()])
+				if traffic(t, s, fc, &Frame{Payload: make([]byte, n)}) != gnet.None {
+					t.Fatal("connection closed")
+				}
+				if passed := len(r.handled[c.ID()]) > before; passed != tt.passed[i] {
+					t.Errorf("frame %d of %d bytes passed %v, want %v", i, n, passed, tt.passed[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitDelayWakes(t *testing.T) {
+	r := newRecorder(-1)
+	s := NewServer("", r.handle, WithLogger(Discard),
+		WithRateLimit(RateLimits{PerConn: Rate{Frames: 100, FrameBurst: 1}, Action: RateDelay}))
+	_, fc := openConn(t, s)
+	start := time.Now()
+	pump(t, s, fc, messages("m", 3)...)
+	// the third frame is read once the 10ms debt of the second is paid
+	if took := time.Since(start); took < 10*time.Millisecond {
+		t.Errorf("read everything in %v", took)
+	}
+}
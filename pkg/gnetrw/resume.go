@@ -0,0 +1,282 @@
+package gnetrw
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Session resumption. The server gives the clients announcing CapabilityResume a token
+// in Welcome.Session and numbers its messages to them in HeaderSeq, from 1. A client
+// reconnecting sends the token back in Hello.Session with the highest number it
+// received in Hello.Received. Within the resumption window the server attaches the new
+// connection to the same ClientSession, restores its values and tags, and sends again
+// the messages after Hello.Received it still buffers. Otherwise, or when some of those
+// messages were already evicted from the buffer, the client gets a new session and
+// Welcome.Resumed is false.
+const CapabilityResume = "resume"
+
+const (
+	// DefaultResumeWindow is how long a session is kept after its connection closed.
+	DefaultResumeWindow = 2 * time.Minute
+	// DefaultReplayBuffer is the payload bytes of the last messages a session keeps to
+	// send them again.
+	DefaultReplayBuffer = 1 << 20
+)
+
+// ClientSession is the state of a client kept across its connections, see
+// WithSessionResumption. It is safe for concurrent use.
+type ClientSession struct {
+	token string
+	srv   *Server
+
+	mu       sync.Mutex
+	conn     *Conn     // nil while detached
+	detached time.Time // since the last connection closed
+	values   map[string]any
+	tags     map[string]string // of the last connection
+	seq      uint64            // last message number given
+	replay   []*Frame          // last messages, by number
+	bytes    int               // payload bytes in replay
+	evicted  uint64            // highest number dropped from replay
+}
+
+// Token returns the token the client presents to resume the session.
+func (cs *ClientSession) Token() string { return cs.token }
+
+// Value returns the value set for key, nil when unset.
+func (cs *ClientSession) Value(key string) any {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.values[key]
+}
+
+// SetValue keeps v for key across the connections of the session, nil deletes it.
+func (cs *ClientSession) SetValue(key string, v any) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if v == nil {
+		delete(cs.values, key)
+		return
+	}
+	if cs.values == nil {
+		cs.values = make(map[string]any)
+	}
+	cs.values[key] = v
+}
+
+// Send numbers payload with header h and writes it to the connection of the session.
+// While the client is disconnected the message is only buffered and sent on resumption.
+// It fails with ErrSessionExpired once the session is gone.
+func (cs *ClientSession) Send(h Header, payload []byte) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.conn == nil && time.Since(cs.detached) > cs.srv.resumeWindow {
+		return ErrSessionExpired
+	}
+	_, err := cs.send(cs.conn, h, payload)
+	return err
+}
+
+// write numbers a message written on c, see Conn.WriteMessage.
+func (cs *ClientSession) write(c *Conn, h Header, payload []byte) (int, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.conn != c {
+		// the session moved to a newer connection
+		return 0, ErrConnClosed
+	}
+	return cs.send(c, h, payload)
+}
+
+// send must be called with mu held, the messages are written with AsyncWrite under it
+// so that they leave in order. A message buffered for a connection that is closing is
+// sent again on resumption, so only encoding errors are returned.
+func (cs *ClientSession) send(c *Conn, h Header, payload []byte) (int, error) {
+	f := &Frame{Header: h.Clone(), Payload: append([]byte(nil), payload...)}
+	if f.Header == nil {
+		f.Header = Header{}
+	}
+	cs.seq++
+	f.Header.Set(HeaderSeq, strconv.FormatUint(cs.seq, 10))
+	cs.keep(f)
+	if c == nil {
+		return len(payload), nil
+	}
+	buf, err := newFramePacker(f).pack(c)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.AsyncWrite(buf, nil); err == nil {
+		cs.srv.metrics.FrameOut(len(buf) - 4)
+	}
+	return len(buf) - 4, nil
+}
+
+// keep adds f to the replay buffer, evicting the oldest messages above its size.
+func (cs *ClientSession) keep(f *Frame) {
+	cs.replay = append(cs.replay, f)
+	cs.bytes += len(f.Payload)
+	n := 0
+	for cs.bytes > cs.srv.replayBuffer && n < len(cs.replay)-1 {
+		cs.bytes -= len(cs.replay[n].Payload)
+		n++
+	}
+	cs.drop(n)
+}
+
+// drop removes the first n messages of the replay buffer.
+func (cs *ClientSession) drop(n int) {
+	if n == 0 {
+		return
+	}
+	cs.evicted = seqOfReplay(cs.replay[n-1])
+	k := copy(cs.replay, cs.replay[n:])
+	clear(cs.replay[k:])
+	cs.replay = cs.replay[:k]
+}
+
+func seqOfReplay(f *Frame) uint64 {
+	seq, _ := strconv.ParseUint(f.Header.Get(HeaderSeq), 10, 64)
+	return seq
+}
+
+// WithSessionResumption keeps the state of the clients announcing CapabilityResume for
+// window after their connection closed, 0 uses DefaultResumeWindow, and the last
+// buffer payload bytes of the messages sent to each, 0 uses DefaultReplayBuffer.
+// Messages written with Conn.WriteMessage, AsyncWriteMessage, SendTo, SendWhere and
+// ClientSession.Send are numbered, see CapabilityResume, the frames written otherwise,
+// such as the deliveries of a Broker, are not sent again. It needs WithHandshake and clients
+// speaking HeaderVersion.
+func WithSessionResumption(window time.Duration, buffer int) Option {
+	return func(s *Server) {
+		if window <= 0 {
+			window = DefaultResumeWindow
+		}
+		if buffer <= 0 {
+			buffer = DefaultReplayBuffer
+		}
+		s.resumeWindow = window
+		s.replayBuffer = buffer
+		s.sessions = make(map[string]*ClientSession)
+	}
+}
+
+// ClientSession returns the resumable session of c, nil unless CapabilityResume was
+// negotiated.
+func (c *Conn) ClientSession() *ClientSession { return c.session }
+
+// Resumed reports whether c resumed a session of a previous connection.
+func (c *Conn) Resumed() bool { return c.resumed }
+
+// findSession picks the session of a client during the handshake, before the welcome is
+// written: the one it resumes or a new one.
+func (s *Server) findSession(hello *Hello, w *Welcome) *ClientSession {
+	if s.sessions == nil || w.Version < HeaderVersion || !slices.Contains(w.Capabilities, CapabilityResume) {
+		return nil
+	}
+
+	now := time.Now()
+	s.sessMu.Lock()
+	defer s.sessMu.Unlock()
+	for token, cs := range s.sessions {
+		cs.mu.Lock()
+		expired := cs.conn == nil && now.Sub(cs.detached) > s.resumeWindow
+		cs.mu.Unlock()
+		if expired {
+			delete(s.sessions, token)
+		}
+	}
+	if cs := s.sessions[hello.Session]; cs != nil && hello.Session != "" && cs.resumable(hello.Received) {
+		w.Session, w.Resumed = cs.token, true
+		return cs
+	}
+	if hello.Session != "" {
+		s.logger.Info("session not resumed", KeyClient, hello.Name, "received", hello.Received)
+	}
+
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	cs := &ClientSession{token: hex.EncodeToString(b[:]), srv: s, detached: now}
+	s.sessions[cs.token] = cs
+	w.Session = cs.token
+	return cs
+}
+
+// resumable reports whether every message after received can be sent again.
+func (cs *ClientSession) resumable(received uint64) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return received >= cs.evicted && received <= cs.seq
+}
+
+// attachSession moves cs to c once the welcome is written, on the event loop with
+// Server.mu held, and sends the messages the client missed.
+func (s *Server) attachSession(c *Conn, cs *ClientSession, resumed bool) {
+	if cs == nil {
+		return
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	old := cs.conn
+	cs.conn = c
+	c.session = cs
+	c.resumed = resumed
+	if old != nil {
+		// the client came back before its previous connection was found dead
+		cs.tags = old.Tags()
+		old.closeWith(ErrSessionResumed)
+		_ = old.Close()
+	}
+	if !resumed {
+		return
+	}
+
+	for k, v := range cs.tags {
+		c.SetTag(k, v)
+	}
+	received := c.hello.Received
+	n := 0
+	for n < len(cs.replay) && seqOfReplay(cs.replay[n]) <= received {
+		cs.bytes -= len(cs.replay[n].Payload)
+		n++
+	}
+	cs.drop(n)
+	replayed := 0
+	for _, f := range cs.replay {
+		buf, err := newFramePacker(f).pack(c)
+		if err != nil {
+			s.logger.Warn("replay message", KeyAddr, addrOf(c), HeaderSeq, seqOfReplay(f), KeyErr, err)
+			continue
+		}
+		if c.AsyncWrite(buf, nil) != nil {
+			break
+		}
+		s.metrics.FrameOut(len(buf) - 4)
+		replayed++
+	}
+	s.metrics.ResumedSessions.Add(1)
+	s.metrics.ReplayedFrames.Add(int64(replayed))
+	s.logger.Info("session resumed", KeyAddr, addrOf(c), KeyClient, c.hello.Name,
+		"received", received, "replayed", replayed)
+}
+
+// detachSession starts the resumption window of the session of c, in OnClose.
+func (s *Server) detachSession(c *Conn) {
+	cs := c.session
+	if cs == nil {
+		return
+	}
+	tags := c.Tags()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.conn != c {
+		return
+	}
+	cs.conn = nil
+	cs.detached = time.Now()
+	cs.tags = tags
+}
@@ -0,0 +1,77 @@
+package gnetrw
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSessionResume(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    bool   // the client presents the token of its session
+		received uint64 // highest number it received
+		resumed  bool
+		replayed []uint64
+	}{
+		{"all received", true, 5, true, nil},
+		{"last missed", true, 4, true, []uint64{5}},
+		{"oldest kept", true, 3, true, []uint64{4, 5}},
+		{"evicted", true, 2, false, nil},
+		{"ahead", true, 6, false, nil},
+		{"unknown token", false, 5, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 4 bytes per message, the last two are kept
+			s := NewServer("", nil, WithLogger(Discard), WithHandshake(HandshakeConfig{}),
+				WithSessionResumption(time.Minute, 10))
+
+			first, _ := newTestConn(s, &Hello{Version: ProtocolVersion})
+			cs := resumeHandshake(t, s, first, false)
+			first.SetTag("room", "a")
+			for i := 0; i < 5; i++ {
+				if _, err := first.WriteMessage(nil, []byte("data")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.detachSession(first)
+
+			hello := &Hello{Version: ProtocolVersion, Session: "other", Received: tt.received}
+			if tt.token {
+				hello.Session = cs.Token()
+			}
+			next, fc := newTestConn(s, hello)
+			got := resumeHandshake(t, s, next, tt.resumed)
+			if (got == cs) != tt.resumed {
+				t.Errorf("same session %v, want %v", got == cs, tt.resumed)
+			}
+			if tt.resumed && next.Tags()["room"] != "a" {
+				t.Errorf("tags %v not restored", next.Tags())
+			}
+
+			var replayed []uint64
+			for _, f := range fc.frames(t) {
+				replayed = append(replayed, seqOfReplay(f))
+			}
+			if !slices.Equal(replayed, tt.replayed) {
+				t.Errorf("replayed %v, want %v", replayed, tt.replayed)
+			}
+		})
+	}
+}
+
+// resumeHandshake runs the session part of the handshake of c.
+func resumeHandshake(t *testing.T, s *Server, c *Conn, resumed bool) *ClientSession {
+	t.Helper()
+	c.welcome.Capabilities = []string{CapabilityResume}
+	cs := s.findSession(c.hello, c.welcome)
+	if cs == nil || c.welcome.Session != cs.Token() {
+		t.Fatalf("session %v, welcome %+v", cs, c.welcome)
+	}
+	if c.welcome.Resumed != resumed {
+		t.Fatalf("resumed %v, want %v", c.welcome.Resumed, resumed)
+	}
+	s.attachSession(c, cs, c.welcome.Resumed)
+	return cs
+}
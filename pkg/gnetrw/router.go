@@ -0,0 +1,252 @@
+package gnetrw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HeaderTopic is an alternative route key, used when a frame has no HeaderType.
+const HeaderTopic = "topic"
+
+// TypeError is the message type of the error frames sent by Router, see RouteError.
+const TypeError = "error"
+
+// Route error codes sent to clients.
+const (
+	CodeUnknownRoute = "unknown_route"
+	CodeUnauthorized = "unauthorized"
+	CodeRateLimited  = "rate_limited"
+	CodeInternal     = "internal"
+	CodeBadRequest   = "bad_request"
+	CodeUnavailable  = "unavailable" // the server refused the connection, retry later
+)
+
+// RouteError is a failure reported to the client in an error frame instead of closing
+// the connection. Handlers and middlewares return it to reject a single message.
+type RouteError struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+	Route   string `json:"route,omitempty"` // type or topic of the rejected message
+}
+
+func (e *RouteError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s: %q", e.Code, e.Route)
+	}
+	return fmt.Sprintf("%s: %q: %s", e.Code, e.Route, e.Message)
+}
+
+// Is makes an unknown route error match ErrUnknownType and an unavailable one ErrRetryLater.
+func (e *RouteError) Is(target error) bool {
+	return target == ErrUnknownType && e.Code == CodeUnknownRoute ||
+		target == ErrRetryLater && e.Code == CodeUnavailable
+}
+
+// DecodeError returns the RouteError carried by an error frame, nil when f is not one.
+func DecodeError(f *Frame) *RouteError {
+	if f.Header.Get(HeaderType) != TypeError {
+		return nil
+	}
+	e := &RouteError{}
+	if err := json.Unmarshal(f.Payload, e); err != nil {
+		return &RouteError{Code: CodeInternal, Message: fmt.Sprintf("malformed error frame, %v", err)}
+	}
+	return e
+}
+
+// Middleware wraps a Handler, see Router.Use.
+type Middleware func(next Handler) Handler
+
+// Router dispatches frames to the handler registered for their route, the HeaderType
+// or else the HeaderTopic of the frame. Its Handle method is a Handler, pass it to NewServer.
+//
+// Routes are matched exactly first, then by the longest "prefix.*" pattern. An empty
+// route catches the frames that carry neither header.
+type Router struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+	prefixes []string // patterns without the "*", longest first
+	chain    []Middleware
+}
+
+func NewRouter() *Router {
+	return &Router{handlers: make(map[string]Handler)}
+}
+
+// Use appends middlewares run around every routed handler, the first one outermost.
+// Unknown routes are answered before the chain runs.
+func (r *Router) Use(mw ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.chain = append(r.chain, mw...)
+}
+
+// HandleFunc registers h for route, mw run inside the router middlewares.
+func (r *Router) HandleFunc(route string, h Handler, mw ...Middleware) {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if prefix, ok := strings.CutSuffix(route, "*"); ok {
+		if _, exists := r.handlers[route]; !exists {
+			r.prefixes = append(r.prefixes, prefix)
+			// longest prefix wins
+			for i := len(r.prefixes) - 1; i > 0 && len(r.prefixes[i]) > len(r.prefixes[i-1]); i-- {
+				r.prefixes[i], r.prefixes[i-1] = r.prefixes[i-1], r.prefixes[i]
+			}
+		}
+	}
+	r.handlers[route] = h
+}
+
+// RouteOf returns the route key of f.
+func RouteOf(f *Frame) string {
+	if typ := f.Header.Get(HeaderType); typ != "" {
+		return typ
+	}
+	return f.Header.Get(HeaderTopic)
+}
+
+func (r *Router) lookup(route string) (Handler, []Middleware, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if h, ok := r.handlers[route]; ok {
+		return h, r.chain, true
+	}
+	if route != "" {
+		for _, prefix := range r.prefixes {
+			if strings.HasPrefix(route, prefix) {
+				return r.handlers[prefix+"*"], r.chain, true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// Handle dispatches f. A RouteError from the handler, unknown routes included, is
+// sent back as an error frame and the connection stays open; other errors close it.
+func (r *Router) Handle(ctx context.Context, c *Conn, f *Frame) error {
+	route := RouteOf(f)
+	h, chain, ok := r.lookup(route)
+	if !ok {
+		return writeRouteError(c, &RouteError{Code: CodeUnknownRoute, Route: route}, c.srv.pool != nil)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i](h)
+	}
+
+	err := h(ctx, c, f)
+	var re *RouteError
+	if errors.As(err, &re) {
+		if re.Route == "" {
+			re.Route = route
+		}
+		return writeRouteError(c, re, c.srv.pool != nil)
+	}
+	return err
+}
+
+// writeRouteError answers with an error frame, with AsyncWrite when async is set. Peers
+// that cannot read headers are disconnected with e instead.
+func writeRouteError(c *Conn, e *RouteError, async bool) error {
+	if !c.SupportsHeaders() {
+		return e
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	h := Header{HeaderType: TypeError, HeaderContentType: JSONCodec[RouteError]{}.ContentType()}
+	_, err = c.writeMessage(h, data, async)
+	return err
+}
+
+// Register handles the messages of type typ with h. The request is decoded with req,
+// a non-nil response is sent back encoded with resp under the same type.
+func Register[Req, Resp any](r *Router, typ string, req Codec[Req], resp Codec[Resp],
+	h func(ctx context.Context, req *Req) (*Resp, error), mw ...Middleware) {
+	r.HandleFunc(typ, func(ctx context.Context, c *Conn, f *Frame) error {
+		in, err := Decode(f, req)
+		if err != nil {
+			return err
+		}
+		out, err := h(ctx, in)
+		if err != nil || out == nil {
+			return err
+		}
+		reply, err := Encode(typ, resp, out)
+		if err != nil {
+			return err
+		}
+		_, err = c.WriteMessage(reply.Header, reply.Payload)
+		return err
+	}, mw...)
+}
+
+// RegisterJSON is Register with JSON for both the request and the response.
+func RegisterJSON[Req, Resp any](r *Router, typ string, h func(ctx context.Context, req *Req) (*Resp, error), mw ...Middleware) {
+	Register(r, typ, JSONCodec[Req]{}, JSONCodec[Resp]{}, h, mw...)
+}
+
+// Logging logs every routed message at debug level, failures at warn level.
+func Logging(l Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, c *Conn, f *Frame) error {
+			start := time.Now()
+			err := next(ctx, c, f)
+			args := []any{KeyAddr, addrOf(c), "route", RouteOf(f), KeyLen, len(f.Payload), "took", time.Since(start)}
+			if err != nil {
+				l.Warn("message failed", append(args, KeyErr, err)...)
+			} else {
+				l.Debug("message handled", args...)
+			}
+			return err
+		}
+	}
+}
+
+// Auth rejects a message with CodeUnauthorized when check returns an error.
+func Auth(check func(ctx context.Context, c *Conn, f *Frame) error) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, c *Conn, f *Frame) error {
+			if err := check(ctx, c, f); err != nil {
+				return &RouteError{Code: CodeUnauthorized, Message: err.Error()}
+			}
+			return next(ctx, c, f)
+		}
+	}
+}
+
+// Recovery turns a handler panic into a CodeInternal error frame, logging the stack to l.
+func Recovery(l Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, c *Conn, f *Frame) (err error) {
+			defer func() {
+				if p := recover(); p != nil {
+					l.Error("handler panic", KeyAddr, addrOf(c), "route", RouteOf(f), "panic", p, "stack", string(debug.Stack()))
+					err = &RouteError{Code: CodeInternal, Message: "internal error"}
+				}
+			}()
+			return next(ctx, c, f)
+		}
+	}
+}
+
+// RateLimit rejects a message with CodeRateLimited when allow returns false.
+func RateLimit(allow func(c *Conn, f *Frame) bool) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, c *Conn, f *Frame) error {
+			if !allow(c, f) {
+				return &RouteError{Code: CodeRateLimited}
+			}
+			return next(ctx, c, f)
+		}
+	}
+}
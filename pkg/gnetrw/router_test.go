@@ -0,0 +1,170 @@
+package gnetrw
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// routeTo returns a handler recording name in got.
+func routeTo(got *[]string, name string) Handler {
+	return func(ctx context.Context, c *Conn, f *Frame) error {
+		*got = append(*got, name)
+		return nil
+	}
+}
+
+func TestRouterMatch(t *testing.T) {
+	var got []string
+	r := NewRouter()
+	r.HandleFunc("order", routeTo(&got, "order"))
+	r.HandleFunc("order.*", routeTo(&got, "order.*"))
+	r.HandleFunc("order.eu.*", routeTo(&got, "order.eu.*"))
+	r.HandleFunc("", routeTo(&got, "empty"))
+	s := NewServer("", r.Handle, WithLogger(Discard))
+
+	tests := []struct {
+		name   string
+		header Header
+		want   string // handler, "" for an unknown route
+	}{
+		{"exact", Header{HeaderType: "order"}, "order"},
+		{"prefix", Header{HeaderType: "order.us"}, "order.*"},
+		{"longest prefix", Header{HeaderType: "order.eu.created"}, "order.eu.*"},
+		{"topic", Header{HeaderTopic: "order.us"}, "order.*"},
+		{"type before topic", Header{HeaderType: "order", HeaderTopic: "order.us"}, "order"},
+		{"no route key", nil, "empty"},
+		{"unknown", Header{HeaderType: "invoice"}, ""},
+		{"prefix needs the dot", Header{HeaderType: "orders"}, ""},
+	}
+	for _, tt := range tests {
+		got = nil
+		c, fc := newTestConn(s, &Hello{})
+		if err := r.Handle(context.Background(), c, &Frame{Header: tt.header, Payload: []byte("m")}); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		frames := fc.frames(t)
+		if tt.want == "" {
+			if len(got) != 0 || len(frames) != 1 {
+				t.Fatalf("%s: handled by %v, %d frames", tt.name, got, len(frames))
+			}
+			if e := DecodeError(frames[0]); e == nil || e.Code != CodeUnknownRoute || e.Route != RouteOf(&Frame{Header: tt.header}) {
+				t.Errorf("%s: error frame %+v", tt.name, e)
+			}
+			continue
+		}
+		if !slices.Equal(got, []string{tt.want}) || len(frames) != 0 {
+			t.Errorf("%s: handled by %v, %d frames, want %s", tt.name, got, len(frames), tt.want)
+		}
+	}
+}
+
+func TestRouterMiddleware(t *testing.T) {
+	var got []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, c *Conn, f *Frame) error {
+				got = append(got, name)
+				return next(ctx, c, f)
+			}
+		}
+	}
+	r := NewRouter()
+	r.Use(trace("outer"), trace("inner"))
+	r.HandleFunc("a", routeTo(&got, "a"), trace("route"))
+	s := NewServer("", r.Handle, WithLogger(Discard))
+
+	c, _ := newTestConn(s, &Hello{})
+	if err := r.Handle(context.Background(), c, &Frame{Header: Header{HeaderType: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"outer", "inner", "route", "a"}; !slices.Equal(got, want) {
+		t.Errorf("ran %v, want %v", got, want)
+	}
+	// unknown routes are answered before the chain
+	got = nil
+	if err := r.Handle(context.Background(), c, &Frame{Header: Header{HeaderType: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("ran %v for an unknown route", got)
+	}
+}
+
+func TestRouterErrors(t *testing.T) {
+	denied := errors.New("denied")
+	tests := []struct {
+		name    string
+		mw      Middleware
+		handler Handler
+		code    string // of the error frame, "" when the connection is closed
+	}{
+		{"route error", nil, func(context.Context, *Conn, *Frame) error {
+			return &RouteError{Code: CodeBadRequest, Message: "no"}
+		}, CodeBadRequest},
+		{"auth", Auth(func(context.Context, *Conn, *Frame) error { return denied }), nil, CodeUnauthorized},
+		{"rate limit", RateLimit(func(*Conn, *Frame) bool { return false }), nil, CodeRateLimited},
+		{"recovery", Recovery(Discard), func(context.Context, *Conn, *Frame) error { panic("boom") }, CodeInternal},
+		{"other error", nil, func(context.Context, *Conn, *Frame) error { return denied }, ""},
+	}
+	for _, tt := range tests {
+		r := NewRouter()
+		if tt.mw != nil {
+			r.Use(tt.mw)
+		}
+		h := tt.handler
+		if h == nil {
+			h = func(context.Context, *Conn, *Frame) error { return nil }
+		}
+		r.HandleFunc("a", h)
+		s := NewServer("", r.Handle, WithLogger(Discard))
+		c, fc := newTestConn(s, &Hello{})
+
+		err := r.Handle(context.Background(), c, &Frame{Header: Header{HeaderType: "a"}})
+		frames := fc.frames(t)
+		if tt.code == "" {
+			if !errors.Is(err, denied) || len(frames) != 0 {
+				t.Errorf("%s: Handle = %v, %d frames, want the error", tt.name, err, len(frames))
+			}
+			continue
+		}
+		if err != nil || len(frames) != 1 {
+			t.Fatalf("%s: Handle = %v, %d frames", tt.name, err, len(frames))
+		}
+		if e := DecodeError(frames[0]); e == nil || e.Code != tt.code || e.Route != "a" {
+			t.Errorf("%s: error frame %+v, want code %s", tt.name, e, tt.code)
+		}
+	}
+}
+
+func TestRouterErrorWithoutHeaders(t *testing.T) {
+	r := NewRouter()
+	s := NewServer("", r.Handle, WithLogger(Discard))
+	c, fc := newTestConn(s, &Hello{})
+	c.welcome.Version = 1
+	// an error frame cannot be read, the route error closes the connection
+	err := r.Handle(context.Background(), c, &Frame{Payload: []byte("m")})
+	if !errors.Is(err, ErrUnknownType) || len(fc.frames(t)) != 0 {
+		t.Errorf("Handle = %v, want ErrUnknownType and no frame", err)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	tests := []struct {
+		name string
+		f    *Frame
+		want *RouteError
+	}{
+		{"not an error", &Frame{Header: Header{HeaderType: "a"}}, nil},
+		{"error", &Frame{Header: Header{HeaderType: TypeError}, Payload: []byte(`{"code":"internal","route":"a"}`)},
+			&RouteError{Code: CodeInternal, Route: "a"}},
+		{"malformed", &Frame{Header: Header{HeaderType: TypeError}, Payload: []byte("{")}, &RouteError{Code: CodeInternal}},
+	}
+	for _, tt := range tests {
+		got := DecodeError(tt.f)
+		if (got == nil) != (tt.want == nil) || got != nil && (got.Code != tt.want.Code || got.Route != tt.want.Route) {
+			t.Errorf("%s: DecodeError = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
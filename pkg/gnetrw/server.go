@@ -0,0 +1,648 @@
+package gnetrw
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+
+	"unixsocket/pkg/admission"
+	"unixsocket/pkg/metrics"
+)
+
+// Handler processes one complete frame received on c.
+// ctx carries the span started for the frame, f is only valid until the handler returns.
+type Handler func(ctx context.Context, c *Conn, f *Frame) error
+
+// Conn is the per-connection state kept by Server in the gnet connection context.
+type Conn struct {
+	gnet.Conn
+	srv      *Server
+	id       uint64
+	since    time.Time
+	part     *PartData
+	hello    *Hello
+	welcome  *Welcome
+	closeErr error
+	headers  atomic.Bool // the peer sent a frame with a header block
+	compress Compressor
+	work     workQueue
+	limit    limiter
+	resumeAt time.Time // reading is delayed by the rate limits until then
+	entry    *admission.Entry
+	rejected bool                  // refused by the admission limits
+	cause    atomic.Pointer[error] // set by CloseWithError
+	streams  map[uint64]*streamReader
+	// streams whose buffer is full, the connection is not read meanwhile
+	streamPauses atomic.Int32
+	mux          *Session       // logical streams, see WithMux
+	credit       atomic.Bool    // the client honors credits, see WithFlowControl
+	consumed     atomic.Int64   // bytes handled since credit was last granted
+	outPaused    bool           // not read until the outbound buffer drains
+	outPoll      atomic.Bool    // a wake-up is scheduled for the paused connection
+	ack          *ackState      // numbered messages handled, see WithAckedDelivery
+	session      *ClientSession // see WithSessionResumption
+	resumed      bool           // session of a previous connection
+
+	tagMu sync.RWMutex
+	tags  map[string]string
+
+	closeMu  sync.Mutex
+	closed   bool           // OnClose ran
+	onClosed map[any]func() // run by OnClose, see whenClosed
+}
+
+// ID returns the server-unique identifier of the connection.
+func (c *Conn) ID() uint64 { return c.id }
+
+// Hello returns what the client sent during the handshake, nil without handshake.
+func (c *Conn) Hello() *Hello { return c.hello }
+
+// HasCapability reports whether capability was negotiated during the handshake.
+func (c *Conn) HasCapability(capability string) bool {
+	return c.welcome != nil && slices.Contains(c.welcome.Capabilities, capability)
+}
+
+// SupportsHeaders reports whether frames with a header block may be sent to the peer,
+// either because it negotiated HeaderVersion or because it sent one itself.
+func (c *Conn) SupportsHeaders() bool {
+	return c.headers.Load() || (c.welcome != nil && c.welcome.Version >= HeaderVersion)
+}
+
+// whenClosed runs fn once c is closed, right away if it is already. A later fn
+// registered under the same key replaces the previous one. It is safe to call from any
+// goroutine but not from fn.
+func (c *Conn) whenClosed(key any, fn func()) {
+	c.closeMu.Lock()
+	if !c.closed {
+		if c.onClosed == nil {
+			c.onClosed = make(map[any]func())
+		}
+		c.onClosed[key] = fn
+		c.closeMu.Unlock()
+		return
+	}
+	c.closeMu.Unlock()
+	fn()
+}
+
+// runClosed runs the functions passed to whenClosed, on the event loop in OnClose.
+func (c *Conn) runClosed() {
+	c.closeMu.Lock()
+	c.closed = true
+	hooks := c.onClosed
+	c.onClosed = nil
+	c.closeMu.Unlock()
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+// CloseWithError closes c with err as the reason given to the WithOnClose callback,
+// unless the connection fails otherwise first. It is safe to call from any goroutine,
+// only the first reason is kept.
+func (c *Conn) CloseWithError(err error) error {
+	c.closeWith(err)
+	return c.Close()
+}
+
+// closeWith records err as the close reason, it reports whether it is the first one.
+func (c *Conn) closeWith(err error) bool {
+	return c.cause.CompareAndSwap(nil, &err)
+}
+
+// Compressor returns the compression negotiated with the peer, WritePackFrame applies it.
+func (c *Conn) Compressor() Compressor { return c.compress }
+
+// WriteFrame writes msg as one frame, see WriteMessage.
+func (c *Conn) WriteFrame(msg []byte) (int, error) {
+	return c.WriteMessage(nil, msg)
+}
+
+// WriteMessage writes payload with header h as one frame. It must be called from the
+// handler, which runs on the event loop, or on a worker with AsyncWrite when the server
+// runs a worker pool. On the event loop the frame is written at once, before the
+// connection is closed by an error of the handler. Other goroutines, StreamHandler and
+// MuxHandler included, use AsyncWriteMessage.
+// It fails with ErrHeaderNotSupported when h is not empty and the peer cannot read headers.
+func (c *Conn) WriteMessage(h Header, payload []byte) (int, error) {
+	return c.writeMessage(h, payload, c.srv.pool != nil)
+}
+
+// AsyncWriteMessage is WriteMessage for any goroutine, the frame is written with AsyncWrite.
+func (c *Conn) AsyncWriteMessage(h Header, payload []byte) (int, error) {
+	return c.writeMessage(h, payload, true)
+}
+
+func (c *Conn) writeMessage(h Header, payload []byte, async bool) (int, error) {
+	if len(h) > 0 && !c.SupportsHeaders() {
+		return 0, ErrHeaderNotSupported
+	}
+	if c.session != nil {
+		// numbered and kept to be sent again, see WithSessionResumption: always written
+		// with AsyncWrite to keep the numbers in order, a message lost by a close is
+		// sent again on resumption
+		return c.session.write(c, h, payload)
+	}
+	write := WritePackFrame
+	if async {
+		write = AsyncWritePackFrame
+	}
+	// c rather than c.Conn, the gnet context is released on close while AsyncWrite may
+	// still be used from other goroutines
+	n, err := write(c, &Frame{Header: h, Payload: payload})
+	if err == nil {
+		c.srv.metrics.FrameOut(n)
+	}
+	return n, err
+}
+
+// Server is a gnet event handler speaking the length-prefixed frame protocol.
+type Server struct {
+	*gnet.BuiltinEventEngine
+	addr         string
+	handler      Handler
+	handshake    *HandshakeConfig
+	logger       Logger
+	onError      func(c *Conn, err error)
+	onClose      func(c *Conn, reason error)
+	metrics      *ServerMetrics
+	tracer       Tracer
+	propagator   Propagator
+	compress     []Compression
+	threshold    int
+	onPanic      PanicPolicy
+	pool         Pool
+	maxPending   int
+	limits       *RateLimits
+	global       limiter
+	admit        *admission.Controller[uint64]
+	onStream     StreamHandler
+	window       int // stream buffer, see WithStreamHandler
+	onMux        MuxHandler
+	muxConfig    MuxConfig
+	flow         *FlowControl
+	ackRetention time.Duration
+	resumeWindow time.Duration
+	replayBuffer int
+	eng          gnet.Engine
+
+	ackMu sync.Mutex
+	acks  map[string]*ackState // by Hello.ClientID
+
+	sessMu   sync.Mutex
+	sessions map[string]*ClientSession // by token
+
+	waitMu  sync.Mutex
+	waiting []*Conn // connections the saturated pool could not take
+	working int     // workers submitted and not done
+
+	mu     sync.RWMutex
+	conns  map[uint64]*Conn
+	nextID atomic.Uint64
+}
+
+// ConnInfo describes a live connection, see Server.Connections.
+type ConnInfo struct {
+	ID     uint64            `json:"id"`
+	Addr   string            `json:"addr"`
+	Client string            `json:"client,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
+	Since  time.Time         `json:"since"`
+}
+
+type Option func(s *Server)
+
+// WithHandshake requires every client to complete the handshake before its frames reach the handler.
+func WithHandshake(cfg HandshakeConfig) Option {
+	return func(s *Server) { s.handshake = &cfg }
+}
+
+// WithLogger sets the server logger, DefaultLogger is used otherwise.
+func WithLogger(l Logger) Option {
+	return func(s *Server) { s.logger = l }
+}
+
+// WithOnError sets a callback for every frame error that makes the server close a connection.
+func WithOnError(fn func(c *Conn, err error)) Option {
+	return func(s *Server) { s.onError = fn }
+}
+
+// WithOnClose sets a callback receiving the reason of every closed connection,
+// see CloseReason. reason is nil when the server closed the connection itself.
+func WithOnClose(fn func(c *Conn, reason error)) Option {
+	return func(s *Server) { s.onClose = fn }
+}
+
+// WithMetrics reports the server measurements to m, see ServerMetrics.
+func WithMetrics(m metrics.Metrics) Option {
+	return func(s *Server) { s.metrics = NewServerMetrics(m, "unixsocket_server") }
+}
+
+// WithTracing starts a span with t around every handler call, parented to the
+// trace context p extracts from the frame header. nil p uses TraceContext.
+func WithTracing(t Tracer, p Propagator) Option {
+	return func(s *Server) {
+		s.tracer = t
+		s.propagator = p
+	}
+}
+
+// WithCompression offers algs, in order of preference, to clients completing the
+// handshake. Payloads under threshold bytes are sent raw, 0 uses DefaultCompressThreshold.
+// It needs WithHandshake, clients that do not announce a compression get raw frames.
+func WithCompression(threshold int, algs ...Compression) Option {
+	return func(s *Server) {
+		s.compress = algs
+		s.threshold = threshold
+	}
+}
+
+// PanicPolicy selects what the server does with a connection whose handler panicked.
+// The panic is logged with its stack and counted either way.
+type PanicPolicy int
+
+const (
+	PanicClose PanicPolicy = iota // close the connection
+	PanicReply                    // answer with a CodeInternal error frame and keep it open
+)
+
+// WithPanicPolicy sets the reaction to handler panics, PanicClose by default.
+func WithPanicPolicy(p PanicPolicy) Option {
+	return func(s *Server) { s.onPanic = p }
+}
+
+// WithAdmission caps the open connections, see admission.Limits. Refused clients are
+// closed after a frame giving the reason: with WithHandshake a Welcome frame with Retry
+// set, else a CodeUnavailable error frame. Above the soft limit the connections idle the
+// longest are closed, checked every second and on every new connection. Per-uid limits
+// need a unix socket on linux.
+func WithAdmission(l admission.Limits) Option {
+	return func(s *Server) { s.admit = admission.New[uint64](l) }
+}
+
+func NewServer(addr string, handler Handler, opts ...Option) *Server {
+	s := &Server{addr: addr, handler: handler, conns: make(map[uint64]*Conn)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.logger == nil {
+		s.logger = DefaultLogger()
+	}
+	if s.metrics == nil {
+		s.metrics = NewServerMetrics(metrics.Nop, "")
+	}
+	if s.tracer == nil {
+		s.tracer = NopTracer
+	}
+	if s.propagator == nil {
+		s.propagator = TraceContext{}
+	}
+	if s.maxPending <= 0 {
+		s.maxPending = DefaultMaxPending
+	}
+	if s.window <= 0 {
+		s.window = DefaultStreamWindow
+	}
+	if s.handshake != nil && len(s.compress) > 0 {
+		s.handshake.Capabilities = append(slices.Clip(s.handshake.Capabilities), CompressionCapabilities(s.compress...)...)
+	}
+	if s.handshake != nil && s.onMux != nil {
+		s.handshake.Capabilities = append(slices.Clip(s.handshake.Capabilities), CapabilityMux)
+	}
+	if s.handshake != nil && s.flow != nil {
+		s.handshake.Capabilities = append(slices.Clip(s.handshake.Capabilities), CapabilityCredit)
+	}
+	if s.handshake != nil && s.acks != nil {
+		s.handshake.Capabilities = append(slices.Clip(s.handshake.Capabilities), CapabilityAck)
+	}
+	if s.handshake != nil && s.sessions != nil {
+		s.handshake.Capabilities = append(slices.Clip(s.handshake.Capabilities), CapabilityResume)
+	}
+	return s
+}
+
+// FrameMetrics returns the frame instruments, TrafficData reports through them.
+func (s *Server) FrameMetrics() *FrameMetrics { return s.metrics.FrameMetrics }
+
+// Logger returns the server logger, TrafficData logs through it.
+func (s *Server) Logger() Logger { return s.logger }
+
+// Connections lists the open connections ordered by ID, it is safe to call from any goroutine.
+func (s *Server) Connections() []ConnInfo {
+	s.mu.RLock()
+	list := make([]ConnInfo, 0, len(s.conns))
+	for _, c := range s.conns {
+		info := ConnInfo{ID: c.id, Addr: addrOf(c), Tags: c.Tags(), Since: c.since}
+		if c.hello != nil {
+			info.Client = c.hello.Name
+		}
+		list = append(list, info)
+	}
+	s.mu.RUnlock()
+	slices.SortFunc(list, func(a, b ConnInfo) int { return cmp.Compare(a.ID, b.ID) })
+	return list
+}
+
+// Run starts serving and blocks until the engine stops.
+func (s *Server) Run(opts ...gnet.Option) error {
+	if s.admit != nil {
+		opts = append(opts, gnet.WithTicker(true))
+	}
+	return gnet.Run(s, s.addr, opts...)
+}
+
+// Stop shuts the engine down.
+func (s *Server) Stop(ctx context.Context) error {
+	return s.eng.Stop(ctx)
+}
+
+func (s *Server) OnBoot(eng gnet.Engine) gnet.Action {
+	s.eng = eng
+	s.logger.Info("frame server is listening", KeyAddr, s.addr)
+	return gnet.None
+}
+
+func (s *Server) OnShutdown(eng gnet.Engine) {
+	s.logger.Info("frame server is shutting down", KeyAddr, s.addr)
+}
+
+func (s *Server) OnOpen(c gnet.Conn) ([]byte, gnet.Action) {
+	conn := &Conn{Conn: c, srv: s, id: s.nextID.Add(1), since: time.Now()}
+	if s.limits != nil {
+		conn.limit = newLimiter(s.limits.PerConn)
+	}
+	c.SetContext(conn)
+	if s.admit != nil {
+		uid, _ := admission.PeerUID(c.Fd())
+		entry, err := s.admit.Admit(conn.id, uid, conn.since)
+		if err != nil {
+			conn.rejected = true
+			s.metrics.RejectedConns.Add(1)
+			s.logger.Warn("connection rejected", KeyAddr, addrOf(c), "uid", uid, KeyErr, err)
+			return rejectFrame(s.handshake != nil, err), gnet.Close
+		}
+		conn.entry = entry
+		defer s.evict(conn.since)
+	}
+	if s.onMux != nil {
+		s.newMux(conn)
+	}
+	s.mu.Lock()
+	s.conns[conn.id] = conn
+	s.mu.Unlock()
+	s.metrics.AcceptedConns.Add(1)
+	s.metrics.ActiveConns.Add(1)
+	s.logger.Debug("connection opened", KeyAddr, addrOf(c))
+	return nil, gnet.None
+}
+
+func (s *Server) OnClose(c gnet.Conn, err error) gnet.Action {
+	conn := connOf(c)
+	if conn.rejected {
+		return gnet.None
+	}
+	if s.admit != nil {
+		s.admit.Release(conn.id)
+	}
+	s.mu.Lock()
+	delete(s.conns, conn.id)
+	s.mu.Unlock()
+	s.closeStreams(conn)
+	if conn.mux != nil {
+		conn.mux.closeWith(ErrConnClosed)
+	}
+	s.detachAck(conn)
+	s.detachSession(conn)
+	conn.runClosed()
+	if s.pool != nil {
+		if err := s.closeWork(conn, nil); conn.closeErr == nil {
+			conn.closeErr = err
+		}
+	}
+	s.metrics.ClosedConns.Add(1)
+	s.metrics.ActiveConns.Add(-1)
+	reason := CloseReason(c, conn.part, conn.closeErr, err)
+	if cause := conn.cause.Load(); reason == nil && cause != nil {
+		reason = *cause
+	}
+	if reason != nil {
+		s.logger.Debug("connection closed", KeyAddr, addrOf(c), KeyErr, reason)
+	} else {
+		s.logger.Debug("connection closed", KeyAddr, addrOf(c))
+	}
+	if s.onClose != nil {
+		s.onClose(conn, reason)
+	}
+	return gnet.None
+}
+
+// OnError records err as the close reason of c, see ErrorHandler.
+func (s *Server) OnError(c gnet.Conn, err error) {
+	conn := connOf(c)
+	conn.closeErr = err
+	if s.onError != nil {
+		s.onError(conn, err)
+	}
+}
+
+// rejectFrame is the frame telling a client refused by the admission limits why: a
+// Welcome with Retry set when it expects one, else a CodeUnavailable error frame.
+func rejectFrame(handshake bool, err error) []byte {
+	if handshake {
+		data, _ := json.Marshal(&Welcome{Version: ProtocolVersion, Reason: err.Error(), Retry: true})
+		out, _ := PackData(data)
+		return out
+	}
+	data, _ := json.Marshal(&RouteError{Code: CodeUnavailable, Message: err.Error()})
+	h := Header{HeaderType: TypeError, HeaderContentType: JSONCodec[RouteError]{}.ContentType()}
+	out, _ := PackFrame(&Frame{Header: h, Payload: data})
+	return out
+}
+
+// evictInterval is how often the idle connections are looked for above the soft
+// admission limit, besides on every admitted connection.
+const evictInterval = time.Second
+
+// OnTick evicts the idle connections above the soft admission limit, Run turns the
+// ticker on with WithAdmission.
+func (s *Server) OnTick() (time.Duration, gnet.Action) {
+	if s.admit == nil {
+		return time.Hour, gnet.None
+	}
+	s.evict(time.Now())
+	return evictInterval, gnet.None
+}
+
+// evict closes the connections idle the longest while above the soft admission limit.
+// They may belong to other event loops, so only concurrency-safe methods are used.
+func (s *Server) evict(now time.Time) {
+	for _, id := range s.admit.Evict(now) {
+		s.mu.RLock()
+		victim := s.conns[id]
+		s.mu.RUnlock()
+		if victim == nil || !victim.closeWith(ErrEvicted) {
+			continue
+		}
+		s.metrics.EvictedConns.Add(1)
+		s.logger.Info("evict idle connection", "id", id, "idle", now.Sub(victim.entry.LastActive()))
+		_ = victim.Close()
+	}
+}
+
+// HandlePanic applies the panic policy, see PanicHandler. Peers that cannot read
+// headers are closed whatever the policy.
+func (s *Server) HandlePanic(c gnet.Conn, f *Frame, p *PanicError) error {
+	return s.handlePanic(connOf(c), f, p, false)
+}
+
+// handlePanic is HandlePanic for the workers and stream goroutines, which hold conn
+// rather than the gnet connection: its context is released once it is closed. async
+// is set off the event loop.
+func (s *Server) handlePanic(conn *Conn, f *Frame, p *PanicError, async bool) error {
+	if s.onPanic != PanicReply || (conn.welcome == nil && s.handshake != nil) {
+		return p
+	}
+	if err := writeRouteError(conn, &RouteError{Code: CodeInternal, Message: "internal error", Route: RouteOf(f)}, async); err != nil {
+		return fmt.Errorf("%w: %w", p, err)
+	}
+	return nil
+}
+
+func (s *Server) OnTraffic(c gnet.Conn) gnet.Action {
+	return TrafficData(s, c)
+}
+
+func connOf(c gnet.Conn) *Conn {
+	conn, _ := c.Context().(*Conn)
+	return conn
+}
+
+func (s *Server) GetPartData(c gnet.Conn) *PartData {
+	return connOf(c).part
+}
+
+func (s *Server) AddPartData(c gnet.Conn, datalen int) *PartData {
+	conn := connOf(c)
+	conn.part = &PartData{DataLen: datalen}
+	return conn.part
+}
+
+func (s *Server) RemovePartData(c gnet.Conn) {
+	connOf(c).part = nil
+}
+
+func (s *Server) DispatchData(c gnet.Conn, msg []byte) error {
+	return s.DispatchFrame(c, &Frame{Payload: msg})
+}
+
+func (s *Server) DispatchFrame(c gnet.Conn, f *Frame) error {
+	conn := connOf(c)
+	if s.handshake != nil && conn.welcome == nil {
+		return s.serverHandshake(conn, f.Payload)
+	}
+	if conn.entry != nil {
+		conn.entry.Touch(time.Now())
+	}
+	if f.Flags&FlagCredit != 0 {
+		// clients do not grant credits to the server
+		_, err := ParseCredit(f)
+		return err
+	}
+	queued := false
+	defer func() {
+		// the worker gives the credit of the frames it handles back, the others are
+		// handled or discarded here
+		if !queued {
+			s.consume(conn, f)
+		}
+	}()
+	if conn.ack != nil {
+		if dup, err := s.duplicate(conn, f); dup || err != nil {
+			return err
+		}
+	}
+	if s.limits != nil {
+		if ok, err := s.throttle(conn, f); !ok || err != nil {
+			return err
+		}
+	}
+	if f.Flags&FlagStream != 0 {
+		return s.streamChunk(conn, f)
+	}
+	if f.Flags&FlagMux != 0 {
+		return s.muxFrame(conn, f)
+	}
+	if s.pool != nil {
+		s.enqueue(conn, f)
+		queued = true
+		return nil
+	}
+	if err := s.serve(conn, f); err != nil {
+		return err
+	}
+	return s.acknowledge(conn, f)
+}
+
+// serve runs the handler for f, on the event loop or on a worker.
+func (s *Server) serve(conn *Conn, f *Frame) error {
+	ctx := context.Background()
+	if f.Header != nil {
+		conn.headers.Store(true)
+		ctx = s.propagator.Extract(ctx, f.Header)
+	}
+
+	ctx, span := s.tracer.Start(ctx, "gnetrw.dispatch", SpanKindServer)
+	defer span.End()
+	err := s.handler(ctx, conn, f)
+	if err != nil {
+		span.SetError(err)
+	}
+	return err
+}
+
+func (s *Server) serverHandshake(c *Conn, msg []byte) error {
+	var (
+		hello   Hello
+		welcome *Welcome
+		session *ClientSession
+		err     error
+	)
+	if err = json.Unmarshal(msg, &hello); err != nil {
+		welcome, err = &Welcome{Version: ProtocolVersion}, fmt.Errorf("malformed hello, %v", err)
+	} else {
+		welcome, err = s.handshake.negotiate(c, &hello)
+	}
+	if err != nil {
+		welcome.Reason = err.Error()
+	} else {
+		session = s.findSession(&hello, welcome)
+	}
+
+	data, _ := json.Marshal(welcome)
+	// on the event loop, a rejected client is closed once this returns
+	if _, werr := c.writeMessage(nil, data, false); werr != nil {
+		return werr
+	}
+	if err != nil {
+		s.logger.Warn("handshake rejected", KeyAddr, addrOf(c), KeyClient, hello.Name, KeyErr, err)
+		return fmt.Errorf("%w: %v", ErrHandshakeRejected, err)
+	}
+	s.mu.Lock() // read by Connections and SendWhere
+	c.hello = &hello
+	c.welcome = welcome
+	c.compress = NegotiatedCompressor(welcome, s.threshold)
+	// before SendWhere can see c, so that its messages are numbered from the first
+	s.attachSession(c, session, welcome.Resumed)
+	s.mu.Unlock()
+	s.logger.Info("handshake accepted", KeyAddr, addrOf(c), KeyClient, hello.Name,
+		"version", welcome.Version, "capabilities", welcome.Capabilities, "compression", c.compress.Compression)
+	s.attachAck(c)
+	return s.grantWindow(c)
+}
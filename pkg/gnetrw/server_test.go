@@ -0,0 +1,135 @@
+package gnetrw
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// fakeConn records what is written to it, on the event loop or with AsyncWrite.
+// in is what the peer sent and TrafficData reads, wakes signals Wake. outbound is
+// reported as the bytes gnet did not write yet.
+type fakeConn struct {
+	gnet.Conn
+	mu       sync.Mutex
+	out      [][]byte
+	closed   bool
+	in       []byte
+	ctx      any
+	wakes    chan struct{}
+	outbound int
+}
+
+func (c *fakeConn) Context() any       { return c.ctx }
+func (c *fakeConn) SetContext(ctx any) { c.ctx = ctx }
+func (c *fakeConn) Fd() int            { return -1 }
+
+func (c *fakeConn) Next(n int) ([]byte, error) {
+	if n < 0 {
+		n = len(c.in)
+	}
+	if n > len(c.in) {
+		return nil, io.ErrShortBuffer
+	}
+	buf := c.in[:n:n]
+	c.in = c.in[n:]
+	return buf, nil
+}
+
+func (c *fakeConn) InboundBuffered() int  { return len(c.in) }
+func (c *fakeConn) OutboundBuffered() int { return c.outbound }
+
+func (c *fakeConn) Wake(cb gnet.AsyncCallback) error {
+	if c.wakes != nil {
+		select {
+		case c.wakes <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr { return nil }
+func (c *fakeConn) LocalAddr() net.Addr  { return nil }
+
+func (c *fakeConn) Write(buf []byte) (int, error) {
+	c.mu.Lock()
+	c.out = append(c.out, append([]byte(nil), buf...))
+	c.mu.Unlock()
+	return len(buf), nil
+}
+
+func (c *fakeConn) Flush() error { return nil }
+
+func (c *fakeConn) AsyncWrite(buf []byte, cb gnet.AsyncCallback) error {
+	_, _ = c.Write(buf)
+	if cb != nil {
+		return cb(c, nil)
+	}
+	return nil
+}
+
+func (c *fakeConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *fakeConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// frames decodes what was written and forgets it.
+func (c *fakeConn) frames(t *testing.T) []*Frame {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var frames []*Frame
+	for _, buf := range c.out {
+		f, err := ReadMessage(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, f)
+	}
+	c.out = nil
+	return frames
+}
+
+// openConn opens a connection on s as gnet would.
+func openConn(t *testing.T, s *Server) (*Conn, *fakeConn) {
+	t.Helper()
+	fc := &fakeConn{wakes: make(chan struct{}, 1)}
+	if _, action := s.OnOpen(fc); action != gnet.None {
+		t.Fatalf("OnOpen = %v", action)
+	}
+	return connOf(fc), fc
+}
+
+// traffic receives frames on fc and runs TrafficData, as the event loop would.
+func traffic(t *testing.T, s *Server, fc *fakeConn, frames ...*Frame) gnet.Action {
+	t.Helper()
+	for _, f := range frames {
+		buf, err := PackFrame(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fc.in = append(fc.in, buf...)
+	}
+	return TrafficData(s, fc)
+}
+
+// newTestConn returns a connection of s whose handshake negotiated capabilities.
+func newTestConn(s *Server, hello *Hello, capabilities ...string) (*Conn, *fakeConn) {
+	fc := &fakeConn{}
+	c := &Conn{Conn: fc, srv: s, hello: hello,
+		welcome: &Welcome{Accepted: true, Version: ProtocolVersion, Capabilities: capabilities}}
+	return c, fc
+}
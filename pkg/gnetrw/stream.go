@@ -0,0 +1,338 @@
+package gnetrw
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sync"
+)
+
+// FlagStream marks a chunk of a streamed message. Its payload starts with the stream ID
+// as a uvarint and a byte of chunk flags, the header of the first chunk is the header
+// of the message. Streams need a peer that negotiated HeaderVersion.
+//
+//	flags(FlagStream) length | [header block] | uvarint(id) chunk-flags(1byte) | data
+const FlagStream byte = 0x40
+
+const (
+	chunkFirst byte = 1 << iota
+	chunkLast
+)
+
+// HeaderStreamError, on the last chunk, aborts the stream with its value as the reason.
+const HeaderStreamError = "stream-error"
+
+// DefaultChunkSize is the data size of the chunks written by SendStream.
+const DefaultChunkSize = 64 << 10
+
+// DefaultStreamWindow is the number of bytes of a stream the server buffers before it
+// stops reading the connection, see WithStreamHandler.
+const DefaultStreamWindow = 1 << 20
+
+// MaxStreams is the number of streams a connection may have open at once.
+const MaxStreams = 16
+
+// Chunk is a decoded stream chunk, see ParseChunk.
+type Chunk struct {
+	ID    uint64
+	First bool
+	Last  bool
+	Data  []byte
+}
+
+// StreamChunk builds a chunk of stream id, h is only sent with the first chunk.
+func StreamChunk(id uint64, h Header, data []byte, first, last bool) *Frame {
+	var flags byte
+	if first {
+		flags |= chunkFirst
+	}
+	if last {
+		flags |= chunkLast
+	}
+	payload := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+1+len(data)), id)
+	payload = append(payload, flags)
+	return &Frame{Flags: FlagStream, Header: h, Payload: append(payload, data...)}
+}
+
+// ParseChunk decodes a frame with FlagStream, the data aliases the frame payload.
+func ParseChunk(f *Frame) (Chunk, error) {
+	id, n := binary.Uvarint(f.Payload)
+	if n <= 0 || n >= len(f.Payload) {
+		return Chunk{}, fmt.Errorf("%w: malformed stream chunk", ErrCorruptPayload)
+	}
+	flags := f.Payload[n]
+	return Chunk{ID: id, First: flags&chunkFirst != 0, Last: flags&chunkLast != 0, Data: f.Payload[n+1:]}, nil
+}
+
+// FrameSender queues frames in order, blocking while its queue is full.
+type FrameSender interface {
+	SendFrame(ctx context.Context, f *Frame) error
+}
+
+// SendStream writes the content of r to w as stream id, in chunks of chunkSize bytes,
+// 0 uses DefaultChunkSize. h is the header of the message. When reading r fails the
+// stream is aborted on the peer and the error returned.
+func SendStream(ctx context.Context, w FrameSender, id uint64, h Header, r io.Reader, chunkSize int) (int64, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	chunkSize = min(chunkSize, MaxFrameSize-binary.MaxVarintLen64-1)
+
+	var sent int64
+	buf := make([]byte, chunkSize)
+	first := true
+	for {
+		n, err := io.ReadFull(r, buf)
+		last := err != nil
+		failed := last && err != io.EOF && err != io.ErrUnexpectedEOF
+		var ch Header
+		if first {
+			ch = h
+		}
+		if failed {
+			ch = mergeHeader(ch, Header{HeaderStreamError: err.Error()})
+		}
+		if n > 0 || last {
+			// StreamChunk copies the data, buf is reused
+			if serr := w.SendFrame(ctx, StreamChunk(id, ch, buf[:n], first, last)); serr != nil {
+				return sent, serr
+			}
+			sent += int64(n)
+			first = false
+		}
+		if failed {
+			return sent, err
+		}
+		if last {
+			return sent, nil
+		}
+	}
+}
+
+func mergeHeader(h, extra Header) Header {
+	if len(extra) == 0 {
+		return h
+	}
+	h = h.Clone()
+	if h == nil {
+		h = Header{}
+	}
+	for k, v := range extra {
+		h[k] = v
+	}
+	return h
+}
+
+// StreamHandler processes a streamed message while its chunks arrive. h is the header
+// of the first chunk, r returns the data in order and fails with ErrStreamAborted or
+// ErrStreamTruncated when the message is incomplete. It runs on its own goroutine,
+// ctx is canceled when the connection closes. An error closes the connection.
+type StreamHandler func(ctx context.Context, c *Conn, h Header, r io.Reader) error
+
+// WithStreamHandler delivers the streamed messages to h. Up to window bytes of a stream
+// are buffered, beyond them the connection is not read until h catches up,
+// 0 uses DefaultStreamWindow. gnet still buffers what the socket receives meanwhile,
+// so a sender ignoring the pace of the server is only bounded by its own memory.
+// Replies are written with AsyncWrite.
+func WithStreamHandler(h StreamHandler, window int) Option {
+	return func(s *Server) {
+		s.onStream = h
+		s.window = window
+	}
+}
+
+// streamChunk hands a chunk to its stream, it runs on the event loop.
+func (s *Server) streamChunk(c *Conn, f *Frame) error {
+	if s.onStream == nil {
+		return fmt.Errorf("%w: stream chunk without stream handler", ErrUnknownType)
+	}
+	ch, err := ParseChunk(f)
+	if err != nil {
+		return err
+	}
+
+	r := c.streams[ch.ID]
+	switch {
+	case ch.First && r != nil:
+		return fmt.Errorf("%w: stream %d opened twice", ErrCorruptPayload, ch.ID)
+	case ch.First:
+		if len(c.streams) >= MaxStreams {
+			return fmt.Errorf("%w: more than %d streams", ErrTooManyStreams, MaxStreams)
+		}
+		r = s.openStream(c, ch.ID, f.Header)
+	case r == nil:
+		// the rest of a stream cut by a reconnection
+		s.logger.Debug("drop chunk of unknown stream", KeyAddr, addrOf(c), "stream", ch.ID, KeyLen, len(ch.Data))
+		return nil
+	}
+
+	if len(ch.Data) > 0 && r.push(ch.Data) {
+		s.metrics.ReadPauses.Add(1)
+	}
+	if ch.Last {
+		delete(c.streams, ch.ID)
+		if reason := f.Header.Get(HeaderStreamError); reason != "" {
+			r.finish(fmt.Errorf("%w: %s", ErrStreamAborted, reason))
+		} else {
+			r.finish(io.EOF)
+		}
+	}
+	return nil
+}
+
+func (s *Server) openStream(c *Conn, id uint64, h Header) *streamReader {
+	ctx := context.Background()
+	if h != nil {
+		c.headers.Store(true)
+		ctx = s.propagator.Extract(ctx, h)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	r := &streamReader{conn: c, window: s.window, cancel: cancel}
+	r.cond.L = &r.mu
+	if c.streams == nil {
+		c.streams = make(map[uint64]*streamReader)
+	}
+	c.streams[id] = r
+	s.metrics.ActiveStreams.Add(1)
+
+	// the gnet connection is released on close, its address is read on the event loop
+	addr := addrOf(c)
+	go func() {
+		defer s.metrics.ActiveStreams.Add(-1)
+		defer cancel()
+		err := s.serveStream(ctx, c, addr, h, r)
+		r.discard()
+		if err != nil {
+			s.metrics.DispatchErrors.Add(1)
+			err = &FrameError{Op: "dispatch", Addr: addr, Err: fmt.Errorf("%w: stream %d: %w", ErrHandler, id, err)}
+			s.logger.Warn("close connection", KeyAddr, addr, KeyErr, err)
+			if s.onError != nil {
+				s.onError(c, err)
+			}
+			_ = c.CloseWithError(err)
+		}
+	}()
+	return r
+}
+
+// serveStream runs the stream handler, applying the panic policy like TrafficData.
+func (s *Server) serveStream(ctx context.Context, c *Conn, addr string, h Header, r io.Reader) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			p := &PanicError{Value: v, Stack: debug.Stack()}
+			s.metrics.Panics.Add(1)
+			s.logger.Error("stream panic", KeyAddr, addr, "panic", v, "stack", string(p.Stack))
+			err = s.handlePanic(c, &Frame{Header: h}, p, true)
+		}
+	}()
+
+	ctx, span := s.tracer.Start(ctx, "gnetrw.stream", SpanKindServer)
+	defer span.End()
+	if err = s.onStream(ctx, c, h, r); err != nil {
+		span.SetError(err)
+	}
+	return err
+}
+
+// closeStreams fails the streams still open when c closes.
+func (s *Server) closeStreams(c *Conn) {
+	for id, r := range c.streams {
+		r.finish(ErrStreamTruncated)
+		r.cancel()
+		delete(c.streams, id)
+	}
+}
+
+// streamReader is the io.Reader given to a StreamHandler. The event loop pushes the
+// chunks, the handler goroutine reads them.
+type streamReader struct {
+	conn   *Conn
+	window int
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	cond   sync.Cond
+	chunks [][]byte
+	size   int   // bytes buffered
+	err    error // returned once the buffer is drained, io.EOF at the end
+	paused bool  // the connection is not read until the buffer shrinks
+	done   bool  // the handler returned, chunks are discarded
+}
+
+// push buffers a copy of data, it reports whether reading the connection paused.
+func (r *streamReader) push(data []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done || r.err != nil {
+		return false
+	}
+	r.chunks = append(r.chunks, append([]byte(nil), data...))
+	r.size += len(data)
+	r.cond.Signal()
+	if !r.paused && r.size > r.window {
+		r.paused = true
+		r.conn.streamPauses.Add(1)
+		return true
+	}
+	return false
+}
+
+func (r *streamReader) finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.cond.Broadcast()
+}
+
+// discard drops what the handler left unread.
+func (r *streamReader) discard() {
+	r.mu.Lock()
+	r.done = true
+	r.chunks, r.size = nil, 0
+	r.mu.Unlock()
+	r.resume()
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	for r.size == 0 && r.err == nil {
+		r.cond.Wait()
+	}
+	if r.size == 0 {
+		err := r.err
+		r.mu.Unlock()
+		return 0, err
+	}
+	n := 0
+	for n < len(p) && len(r.chunks) > 0 {
+		m := copy(p[n:], r.chunks[0])
+		n += m
+		if m == len(r.chunks[0]) {
+			r.chunks[0] = nil
+			r.chunks = r.chunks[1:]
+		} else {
+			r.chunks[0] = r.chunks[0][m:]
+		}
+	}
+	r.size -= n
+	r.mu.Unlock()
+	r.resume()
+	return n, nil
+}
+
+// resume wakes the connection once the buffer is down to half the window.
+func (r *streamReader) resume() {
+	r.mu.Lock()
+	wake := r.paused && r.size <= r.window/2
+	if wake {
+		r.paused = false
+	}
+	r.mu.Unlock()
+	if wake && r.conn.streamPauses.Add(-1) == 0 {
+		_ = r.conn.Wake(nil)
+	}
+}
@@ -0,0 +1,221 @@
+package gnetrw
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// frameRecorder records the frames of SendStream.
+type frameRecorder struct{ frames []*Frame }
+
+func (r *frameRecorder) SendFrame(ctx context.Context, f *Frame) error {
+	r.frames = append(r.frames, f)
+	return nil
+}
+
+// failAfter returns data then err.
+type failAfter struct {
+	data []byte
+	err  error
+}
+
+func (r *failAfter) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestChunk(t *testing.T) {
+	f := StreamChunk(300, Header{"a": "b"}, []byte("data"), true, false)
+	ch, err := ParseChunk(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.ID != 300 || !ch.First || ch.Last || string(ch.Data) != "data" || f.Flags != FlagStream {
+		t.Fatalf("chunk = %+v, flags %#x", ch, f.Flags)
+	}
+	for _, payload := range [][]byte{nil, {0x80}, {5}} {
+		if _, err := ParseChunk(&Frame{Flags: FlagStream, Payload: payload}); !errors.Is(err, ErrCorruptPayload) {
+			t.Errorf("ParseChunk(%x): err = %v, want ErrCorruptPayload", payload, err)
+		}
+	}
+}
+
+func TestSendStream(t *testing.T) {
+	var w frameRecorder
+	n, err := SendStream(context.Background(), &w, 7, Header{"name": "x"}, strings.NewReader("abcdefg"), 3)
+	if n != 7 || err != nil {
+		t.Fatalf("SendStream = %d, %v", n, err)
+	}
+	var data []string
+	for i, f := range w.frames {
+		ch, _ := ParseChunk(f)
+		if ch.ID != 7 || ch.First != (i == 0) || ch.Last != (i == len(w.frames)-1) || (f.Header != nil) != (i == 0) {
+			t.Fatalf("chunk %d = %+v, header %v", i, ch, f.Header)
+		}
+		data = append(data, string(ch.Data))
+	}
+	if got := strings.Join(data, "|"); got != "abc|def|g" {
+		t.Fatalf("chunks = %s", got)
+	}
+
+	// an empty stream is one chunk, first and last
+	w.frames = nil
+	if _, err := SendStream(context.Background(), &w, 1, nil, strings.NewReader(""), 0); err != nil || len(w.frames) != 1 {
+		t.Fatalf("empty stream: %d frames, %v", len(w.frames), err)
+	}
+
+	w.frames = nil
+	boom := errors.New("boom")
+	if _, err := SendStream(context.Background(), &w, 2, nil, &failAfter{data: []byte("ab"), err: boom}, 3); err != boom {
+		t.Fatalf("failing reader: err = %v", err)
+	}
+	last := w.frames[len(w.frames)-1]
+	if ch, _ := ParseChunk(last); !ch.Last || last.Header.Get(HeaderStreamError) != "boom" {
+		t.Fatalf("last chunk = %+v, header %v", ch, last.Header)
+	}
+}
+
+type streamResult struct {
+	name string
+	data string
+	err  error
+}
+
+// streamServer returns a server handing each stream, by its "name" header, to results.
+// Reading waits for gate when it is not nil.
+func streamServer(window int, gate chan struct{}) (*Server, chan streamResult) {
+	results := make(chan streamResult, MaxStreams+1)
+	h := func(ctx context.Context, c *Conn, h Header, r io.Reader) error {
+		if gate != nil {
+			<-gate
+		}
+		data, err := io.ReadAll(r)
+		results <- streamResult{h.Get("name"), string(data), err}
+		return nil
+	}
+	return NewServer("", nil, WithLogger(Discard), WithStreamHandler(h, window)), results
+}
+
+func result(t *testing.T, results chan streamResult) streamResult {
+	t.Helper()
+	select {
+	case r := <-results:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream handler not done")
+		return streamResult{}
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	s, results := streamServer(0, nil)
+	_, fc := openConn(t, s)
+
+	// two streams interleaved, a chunk of an unknown stream is dropped
+	action := traffic(t, s, fc,
+		StreamChunk(1, Header{"name": "one"}, []byte("a"), true, false),
+		StreamChunk(2, Header{"name": "two"}, []byte("x"), true, false),
+		StreamChunk(9, nil, []byte("?"), false, false),
+		StreamChunk(1, nil, []byte("b"), false, true),
+		StreamChunk(2, Header{HeaderStreamError: "gave up"}, []byte("y"), false, true),
+	)
+	if action != gnet.None {
+		t.Fatalf("TrafficData = %v", action)
+	}
+	got := map[string]streamResult{}
+	for range 2 {
+		r := result(t, results)
+		got[r.name] = r
+	}
+	if r := got["one"]; r.data != "ab" || r.err != nil {
+		t.Fatalf("stream one = %+v", r)
+	}
+	if r := got["two"]; r.data != "xy" || !errors.Is(r.err, ErrStreamAborted) {
+		t.Fatalf("stream two = %+v, want ErrStreamAborted", r)
+	}
+
+	// cut by a close
+	traffic(t, s, fc, StreamChunk(3, Header{"name": "three"}, []byte("z"), true, false))
+	s.OnClose(fc, nil)
+	if r := result(t, results); r.data != "z" || !errors.Is(r.err, ErrStreamTruncated) {
+		t.Fatalf("stream cut by a close = %+v, want ErrStreamTruncated", r)
+	}
+}
+
+func TestStreamProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames []*Frame
+		want   error
+	}{
+		{"opened twice", []*Frame{
+			StreamChunk(1, nil, nil, true, false),
+			StreamChunk(1, nil, nil, true, false),
+		}, ErrCorruptPayload},
+		{"too many", func() []*Frame {
+			var frames []*Frame
+			for i := range MaxStreams + 1 {
+				frames = append(frames, StreamChunk(uint64(i), nil, nil, true, false))
+			}
+			return frames
+		}(), ErrTooManyStreams},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var closeErr error
+			s, _ := streamServer(0, nil)
+			s.onError = func(c *Conn, err error) { closeErr = err }
+			_, fc := openConn(t, s)
+			if action := traffic(t, s, fc, tt.frames...); action != gnet.Close || !errors.Is(closeErr, tt.want) {
+				t.Fatalf("TrafficData = %v, %v, want Close with %v", action, closeErr, tt.want)
+			}
+			s.OnClose(fc, nil)
+		})
+	}
+
+	s := NewServer("", nil, WithLogger(Discard))
+	_, fc := openConn(t, s)
+	if action := traffic(t, s, fc, StreamChunk(1, nil, nil, true, true)); action != gnet.Close {
+		t.Fatalf("stream without handler: TrafficData = %v, want Close", action)
+	}
+}
+
+func TestStreamWindow(t *testing.T) {
+	gate := make(chan struct{})
+	s, results := streamServer(4, gate)
+	c, fc := openConn(t, s)
+
+	traffic(t, s, fc, StreamChunk(1, nil, []byte("abc"), true, false), StreamChunk(1, nil, []byte("de"), false, false))
+	if !s.ReadPaused(fc) {
+		t.Fatal("reading not paused above the stream window")
+	}
+	traffic(t, s, fc, StreamChunk(1, nil, bytes.Repeat([]byte("f"), 5), false, true))
+	if fc.InboundBuffered() == 0 {
+		t.Fatal("chunk read while paused")
+	}
+
+	close(gate)
+	select {
+	case <-fc.wakes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not woken once the handler caught up")
+	}
+	TrafficData(s, fc)
+	if r := result(t, results); r.data != "abcdefffff" || r.err != nil {
+		t.Fatalf("stream = %+v", r)
+	}
+	if s.ReadPaused(fc) || c.streamPauses.Load() != 0 {
+		t.Fatal("reading still paused")
+	}
+}
@@ -0,0 +1,182 @@
+package gnetrw
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// W3C trace context keys carried in the frame header.
+// See https://www.w3.org/TR/trace-context/ and https://www.w3.org/TR/baggage/ .
+const (
+	HeaderTraceParent = "traceparent"
+	HeaderTraceState  = "tracestate"
+	HeaderBaggage     = "baggage"
+)
+
+type SpanKind int
+
+const (
+	SpanKindServer SpanKind = iota // handling a received frame
+	SpanKindClient                 // sending a frame
+)
+
+// Span is the part of a tracing span used by the framing layer.
+type Span interface {
+	SetError(err error)
+	End()
+}
+
+// Tracer starts the spans around DispatchData and client sends.
+// OpenTelemetry users adapt their trace.Tracer to it.
+type Tracer interface {
+	Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span)
+}
+
+// Propagator moves the span context of ctx in and out of frame headers.
+// Header implements the TextMapCarrier of OpenTelemetry, so its propagators can be adapted directly.
+type Propagator interface {
+	Inject(ctx context.Context, h Header)
+	Extract(ctx context.Context, h Header) context.Context
+}
+
+// NopTracer starts spans that do nothing, it is the default.
+var NopTracer Tracer = nopTracer{}
+
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, _ string, _ SpanKind) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetError(error) {}
+func (nopSpan) End()           {}
+
+// SpanContext is the W3C trace context of a span.
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Flags      byte // 0x01 sampled
+	TraceState string
+	Baggage    string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent formats sc as a traceparent header value.
+func (sc SpanContext) TraceParent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), sc.Flags)
+}
+
+// ParseTraceParent parses a version 00 traceparent header value.
+func ParseTraceParent(s string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || parts[0] != "00" {
+		return sc, false
+	}
+	if n, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil || n != 16 {
+		return sc, false
+	}
+	if n, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil || n != 8 {
+		return sc, false
+	}
+	var flags [1]byte
+	if n, err := hex.Decode(flags[:], []byte(parts[3])); err != nil || n != 1 {
+		return sc, false
+	}
+	sc.Flags = flags[0]
+	return sc, sc.IsValid()
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a copy of ctx carrying sc.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context carried by ctx.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// TraceContext is the W3C propagator for the SpanContext carried by the context.
+type TraceContext struct{}
+
+func (TraceContext) Inject(ctx context.Context, h Header) {
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok || !sc.IsValid() {
+		return
+	}
+	h.Set(HeaderTraceParent, sc.TraceParent())
+	if sc.TraceState != "" {
+		h.Set(HeaderTraceState, sc.TraceState)
+	}
+	if sc.Baggage != "" {
+		h.Set(HeaderBaggage, sc.Baggage)
+	}
+}
+
+func (TraceContext) Extract(ctx context.Context, h Header) context.Context {
+	sc, ok := ParseTraceParent(h.Get(HeaderTraceParent))
+	if !ok {
+		return ctx
+	}
+	sc.TraceState = h.Get(HeaderTraceState)
+	sc.Baggage = h.Get(HeaderBaggage)
+	return ContextWithSpanContext(ctx, sc)
+}
+
+// FinishedSpan is reported by SimpleTracer when a span ends.
+type FinishedSpan struct {
+	Name     string
+	Kind     SpanKind
+	Context  SpanContext
+	ParentID [8]byte
+	Start    time.Time
+	End      time.Time
+	Err      error
+}
+
+// SimpleTracer creates W3C span contexts without any tracing dependency and
+// reports every finished span to OnEnd. It pairs with the TraceContext propagator.
+type SimpleTracer struct {
+	OnEnd func(FinishedSpan)
+}
+
+func (t *SimpleTracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span) {
+	parent, _ := SpanContextFromContext(ctx)
+	sc := parent
+	if !parent.IsValid() {
+		rand.Read(sc.TraceID[:])
+		sc.Flags = 0x01
+	}
+	rand.Read(sc.SpanID[:])
+	s := &simpleSpan{tracer: t, data: FinishedSpan{
+		Name: name, Kind: kind, Context: sc, ParentID: parent.SpanID, Start: time.Now(),
+	}}
+	return ContextWithSpanContext(ctx, sc), s
+}
+
+type simpleSpan struct {
+	tracer *SimpleTracer
+	data   FinishedSpan
+}
+
+func (s *simpleSpan) SetError(err error) { s.data.Err = err }
+
+func (s *simpleSpan) End() {
+	s.data.End = time.Now()
+	if s.tracer.OnEnd != nil {
+		s.tracer.OnEnd(s.data)
+	}
+}
@@ -0,0 +1,219 @@
+package gnetrw
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// Pool runs tasks on other goroutines. *ants.Pool and gnet's goroutine.Pool implement it.
+// Submit fails when the pool is saturated, the task is retried once a worker frees up.
+type Pool interface {
+	Submit(task func()) error
+}
+
+// ReadPauser may be implemented by a DataDispatch to stop TrafficData between frames.
+// The frames left are kept in the gnet buffer, wake the connection to resume reading.
+// gnet keeps reading the socket meanwhile, TrafficData closes a paused connection
+// with ErrInboundOverflow once more than MaxPausedInbound bytes are buffered.
+type ReadPauser interface {
+	ReadPaused(conn gnet.Conn) bool
+}
+
+// MaxPausedInbound is the most a paused connection may buffer, above the largest frame.
+const MaxPausedInbound = 16 << 20
+
+// DefaultMaxPending is the number of frames a connection may queue for the worker pool
+// before the server stops reading from it.
+const DefaultMaxPending = 64
+
+// workQueue holds the frames of a connection waiting for a worker. One worker at a
+// time owns the queue, so the frames of a connection are handled in order.
+type workQueue struct {
+	mu     sync.Mutex
+	frames []*Frame
+	busy   bool // a worker owns the queue or it waits for one
+	paused bool // TrafficData stopped reading
+	closed bool
+	err    error // why a worker closed the connection, read by OnClose
+}
+
+// WithWorkerPool runs the handler on p instead of the event loop. Frames of one
+// connection are handled in order, replies are written with AsyncWrite.
+// A connection with maxPending frames queued is not read until its worker catches up,
+// 0 uses DefaultMaxPending.
+func WithWorkerPool(p Pool, maxPending int) Option {
+	return func(s *Server) {
+		s.pool = p
+		s.maxPending = maxPending
+	}
+}
+
+// ReadPaused implements ReadPauser, for the worker pool, the rate limits, the
+// stream windows and the outbound watermarks.
+func (s *Server) ReadPaused(c gnet.Conn) bool {
+	conn := connOf(c)
+	if !conn.resumeAt.IsZero() && time.Now().Before(conn.resumeAt) {
+		return true
+	}
+	if s.flow != nil && s.outboundFull(conn) {
+		return true
+	}
+	if conn.streamPauses.Load() > 0 {
+		return true
+	}
+	if s.pool == nil {
+		return false
+	}
+	conn.work.mu.Lock()
+	defer conn.work.mu.Unlock()
+	return conn.work.paused
+}
+
+// enqueue queues f for the worker of c, it runs on the event loop.
+func (s *Server) enqueue(c *Conn, f *Frame) {
+	// the payload aliases the gnet buffer
+	f = &Frame{Flags: f.Flags, Header: f.Header, Payload: append([]byte(nil), f.Payload...), size: f.size}
+
+	q := &c.work
+	q.mu.Lock()
+	q.frames = append(q.frames, f)
+	submit := !q.busy
+	q.busy = true
+	if len(q.frames) >= s.maxPending && !q.paused {
+		q.paused = true
+		s.metrics.ReadPauses.Add(1)
+	}
+	q.mu.Unlock()
+	s.metrics.QueuedFrames.Add(1)
+
+	if submit {
+		s.submit(c)
+	}
+}
+
+func (s *Server) submit(c *Conn) {
+	s.waitMu.Lock()
+	s.working++
+	s.waitMu.Unlock()
+	err := s.pool.Submit(func() { s.work(c) })
+	if err == nil {
+		return
+	}
+
+	s.logger.Debug("worker pool busy", KeyAddr, addrOf(c), KeyErr, err)
+	c.work.mu.Lock()
+	if !c.work.paused {
+		c.work.paused = true
+		s.metrics.ReadPauses.Add(1)
+	}
+	c.work.mu.Unlock()
+	s.waitMu.Lock()
+	if s.working--; s.working > 0 {
+		// saturated, one of the workers takes c over before it exits, see work
+		s.waiting = append(s.waiting, c)
+		s.waitMu.Unlock()
+		return
+	}
+	s.working++
+	s.waitMu.Unlock()
+	// none of the busy workers is ours to take c over, the pool may be shared or closed
+	go s.work(c)
+}
+
+// work drains c, then the connections that could not get a worker. A worker only
+// exits once it found no connection waiting, under the lock submit checks.
+func (s *Server) work(c *Conn) {
+	for {
+		s.drain(c)
+		s.waitMu.Lock()
+		if len(s.waiting) == 0 {
+			s.working--
+			s.waitMu.Unlock()
+			return
+		}
+		c = s.waiting[0]
+		s.waiting[0] = nil
+		s.waiting = s.waiting[1:]
+		s.waitMu.Unlock()
+	}
+}
+
+func (s *Server) drain(c *Conn) {
+	q := &c.work
+	for {
+		q.mu.Lock()
+		if q.closed || len(q.frames) == 0 {
+			q.busy = false
+			wake := q.paused && !q.closed
+			q.paused = false
+			q.mu.Unlock()
+			if wake {
+				_ = c.Wake(nil)
+			}
+			return
+		}
+		f := q.frames[0]
+		q.frames[0] = nil
+		q.frames = q.frames[1:]
+		wake := q.paused && len(q.frames) < s.maxPending
+		if wake {
+			q.paused = false
+		}
+		q.mu.Unlock()
+		s.metrics.QueuedFrames.Add(-1)
+		if wake {
+			_ = c.Wake(nil)
+		}
+
+		err := s.safeServe(c, f)
+		if err == nil {
+			err = s.acknowledge(c, f)
+		}
+		s.consume(c, f)
+		if err != nil {
+			s.metrics.DispatchErrors.Add(1)
+			err = &FrameError{Op: "dispatch", Addr: addrOf(c), Len: len(f.Payload), Err: fmt.Errorf("%w: %w", ErrHandler, err)}
+			s.logger.Warn("close connection", KeyAddr, addrOf(c), KeyLen, len(f.Payload), KeyErr, err)
+			s.closeWork(c, err)
+			if s.onError != nil {
+				s.onError(c, err)
+			}
+			_ = c.Close()
+			return
+		}
+	}
+}
+
+// safeServe runs the handler on a worker, applying the panic policy like TrafficData.
+func (s *Server) safeServe(c *Conn, f *Frame) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			p := &PanicError{Value: v, Stack: debug.Stack()}
+			s.metrics.Panics.Add(1)
+			s.logger.Error("dispatch panic", KeyAddr, addrOf(c), KeyLen, len(f.Payload), "panic", v, "stack", string(p.Stack))
+			err = s.handlePanic(c, f, p, true)
+		}
+	}()
+	return s.serve(c, f)
+}
+
+// closeWork drops the frames still queued for c and records err as its close reason.
+// It returns the first reason recorded.
+func (s *Server) closeWork(c *Conn, err error) error {
+	q := &c.work
+	q.mu.Lock()
+	n := len(q.frames)
+	q.frames = nil
+	q.closed = true
+	if q.err == nil {
+		q.err = err
+	}
+	err = q.err
+	q.mu.Unlock()
+	s.metrics.QueuedFrames.Add(-int64(n))
+	return err
+}
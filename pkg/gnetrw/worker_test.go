@@ -0,0 +1,255 @@
+package gnetrw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+var errPoolFull = errors.New("pool full")
+
+// boundedPool runs at most size tasks at a time, Submit fails beyond.
+type boundedPool struct{ sem chan struct{} }
+
+func newBoundedPool(size int) *boundedPool { return &boundedPool{sem: make(chan struct{}, size)} }
+
+func (p *boundedPool) Submit(task func()) error {
+	select {
+	case p.sem <- struct{}{}:
+	default:
+		return errPoolFull
+	}
+	go func() {
+		defer func() { <-p.sem }()
+		task()
+	}()
+	return nil
+}
+
+// recorder is a handler keeping the payloads it handled by connection.
+type recorder struct {
+	mu      sync.Mutex
+	handled map[uint64][]string
+	gate    chan struct{} // when set, every frame waits for it
+	done    chan struct{}
+	want    int
+}
+
+func newRecorder(want int) *recorder {
+	return &recorder{handled: make(map[uint64][]string), done: make(chan struct{}), want: want}
+}
+
+func (r *recorder) handle(ctx context.Context, c *Conn, f *Frame) error {
+	if r.gate != nil {
+		<-r.gate
+	}
+	if string(f.Payload) == "fail" {
+		return errors.New("fail")
+	}
+	if string(f.Payload) == "panic" {
+		panic("boom")
+	}
+	r.mu.Lock()
+	r.handled[c.ID()] = append(r.handled[c.ID()], string(f.Payload))
+	n := 0
+	for _, h := range r.handled {
+		n += len(h)
+	}
+	r.mu.Unlock()
+	if n == r.want {
+		close(r.done)
+	}
+	_, err := c.WriteMessage(nil, f.Payload)
+	return err
+}
+
+func (r *recorder) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case <-r.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("frames not handled")
+	}
+}
+
+func messages(prefix string, n int) []*Frame {
+	frames := make([]*Frame, n)
+	for i := range frames {
+		frames[i] = &Frame{Payload: []byte(prefix + strconv.Itoa(i))}
+	}
+	return frames
+}
+
+// pump runs TrafficData until fc read everything, waiting for the workers to wake
+// it while its reading is paused.
+func pump(t *testing.T, s *Server, fc *fakeConn, frames ...*Frame) {
+	t.Helper()
+	if traffic(t, s, fc, frames...) != gnet.None {
+		t.Fatal("connection closed")
+	}
+	for len(fc.in) > 0 {
+		select {
+		case <-fc.wakes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("paused connection not woken")
+		}
+		if TrafficData(s, fc) != gnet.None {
+			t.Fatal("connection closed")
+		}
+	}
+}
+
+func TestWorkerPoolOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		pool       Pool
+		maxPending int
+	}{
+		{"pool", newBoundedPool(8), 0},
+		{"paused reading", newBoundedPool(8), 2},
+		{"saturated pool", newBoundedPool(1), 2},
+		// no worker of the pool can take the connections over
+		{"full pool", newBoundedPool(0), 4},
+	}
+	const conns, frames = 3, 50
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRecorder(conns * frames)
+			s := NewServer("", r.handle, WithLogger(Discard), WithWorkerPool(tt.pool, tt.maxPending))
+			var fcs []*fakeConn
+			for i := 0; i < conns; i++ {
+				_, fc := openConn(t, s)
+				fcs = append(fcs, fc)
+			}
+			var wg sync.WaitGroup
+			for i, fc := range fcs {
+				wg.Add(1)
+				// one event loop per connection
+				go func() {
+					defer wg.Done()
+					pump(t, s, fc, messages(fmt.Sprintf("c%d-", i), frames)...)
+				}()
+			}
+			wg.Wait()
+			r.wait(t)
+
+			for i, fc := range fcs {
+				got := r.handled[connOf(fc).ID()]
+				for j, f := range messages(fmt.Sprintf("c%d-", i), frames) {
+					if got[j] != string(f.Payload) {
+						t.Fatalf("connection %d handled %v", i, got)
+					}
+				}
+				if replies := fc.frames(t); len(replies) != frames {
+					t.Errorf("connection %d got %d replies", i, len(replies))
+				}
+			}
+		})
+	}
+}
+
+func TestWorkerHandlerFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy PanicPolicy
+		frames []string
+		closed bool
+		errors int // error frames written
+	}{
+		{"error closes", PanicClose, []string{"a", "fail", "b"}, true, 0},
+		{"panic closes", PanicClose, []string{"a", "panic", "b"}, true, 0},
+		{"panic replies", PanicReply, []string{"a", "panic", "b"}, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRecorder(-1)
+			r.gate = make(chan struct{})
+			var failed error
+			s := NewServer("", r.handle, WithLogger(Discard), WithWorkerPool(newBoundedPool(1), 0),
+				WithPanicPolicy(tt.policy), WithOnError(func(c *Conn, err error) { failed = err }))
+			c, fc := openConn(t, s)
+			c.headers.Store(true) // the error frame can be read
+			var frames []*Frame
+			for _, p := range tt.frames {
+				frames = append(frames, &Frame{Payload: []byte(p)})
+			}
+			pump(t, s, fc, frames...)
+			close(r.gate)
+
+			// a failing worker closes the connection after reporting the error
+			waitWork(t, c, func(q *workQueue) bool { return fc.isClosed() || !q.busy })
+			if fc.isClosed() != tt.closed || (failed != nil) != tt.closed {
+				t.Errorf("closed %v, error %v, want closed %v", fc.isClosed(), failed, tt.closed)
+			}
+			if failed != nil && !errors.Is(failed, ErrHandler) {
+				t.Errorf("error %v, want ErrHandler", failed)
+			}
+			// the frames after a failure closing the connection are dropped
+			want := []string{"a", "b"}
+			if tt.closed {
+				want = want[:1]
+			}
+			if got := r.handled[c.ID()]; fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("handled %v, want %v", got, want)
+			}
+			errs := 0
+			for _, f := range fc.frames(t) {
+				if DecodeError(f) != nil {
+					errs++
+				}
+			}
+			if errs != tt.errors {
+				t.Errorf("%d error frames, want %d", errs, tt.errors)
+			}
+		})
+	}
+}
+
+func TestPausedInboundOverflow(t *testing.T) {
+	r := newRecorder(-1)
+	r.gate = make(chan struct{})
+	defer close(r.gate)
+	s := NewServer("", r.handle, WithLogger(Discard), WithWorkerPool(newBoundedPool(1), 1))
+	c, fc := openConn(t, s)
+	if traffic(t, s, fc, &Frame{Payload: []byte("a")}) != gnet.None {
+		t.Fatal("connection closed")
+	}
+	waitWork(t, c, func(q *workQueue) bool { return len(q.frames) == 0 })
+	// the worker is stuck on a, reading is paused once b is queued while the peer
+	// keeps sending
+	if traffic(t, s, fc, &Frame{Payload: []byte("b")}) != gnet.None || !s.ReadPaused(fc) {
+		t.Fatal("reading not paused")
+	}
+	fc.in = append(fc.in, make([]byte, MaxPausedInbound)...)
+	if TrafficData(s, fc) != gnet.None {
+		t.Fatal("closed at MaxPausedInbound")
+	}
+	fc.in = append(fc.in, 0)
+	if TrafficData(s, fc) != gnet.Close {
+		t.Error("not closed above MaxPausedInbound")
+	}
+}
+
+// waitWork waits until cond holds for the work queue of c.
+func waitWork(t *testing.T, c *Conn, cond func(q *workQueue) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.work.mu.Lock()
+		ok := cond(&c.work)
+		c.work.mu.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("worker did not get there")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,103 @@
+// Package metrics is the small metrics interface shared by the servers and clients,
+// with a Registry implementation that renders the Prometheus text format.
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Counter only goes up.
+type Counter interface {
+	Add(n int64)
+}
+
+// Gauge goes up and down.
+type Gauge interface {
+	Add(n int64)
+	Set(n int64)
+}
+
+// Metrics creates named instruments. Asking twice for the same name returns the same instrument.
+type Metrics interface {
+	Counter(name, help string) Counter
+	Gauge(name, help string) Gauge
+}
+
+// Nop discards every measurement.
+var Nop Metrics = nop{}
+
+type nop struct{}
+
+func (nop) Counter(string, string) Counter { return nopInstrument{} }
+func (nop) Gauge(string, string) Gauge     { return nopInstrument{} }
+
+type nopInstrument struct{}
+
+func (nopInstrument) Add(int64) {}
+func (nopInstrument) Set(int64) {}
+
+// OrNop returns m, or Nop when m is nil.
+func OrNop(m Metrics) Metrics {
+	if m == nil {
+		return Nop
+	}
+	return m
+}
+
+type kind string
+
+const (
+	kindCounter kind = "counter"
+	kindGauge   kind = "gauge"
+)
+
+type metric struct {
+	name  string
+	help  string
+	kind  kind
+	value atomic.Int64
+}
+
+func (m *metric) Add(n int64) { m.value.Add(n) }
+func (m *metric) Set(n int64) { m.value.Store(n) }
+
+// Registry keeps instruments in memory, it is safe for concurrent use.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]*metric)}
+}
+
+func (r *Registry) Counter(name, help string) Counter {
+	return r.get(name, help, kindCounter)
+}
+
+func (r *Registry) Gauge(name, help string) Gauge {
+	return r.get(name, help, kindGauge)
+}
+
+func (r *Registry) get(name, help string, k kind) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, ok := r.metrics[name]; ok {
+		return m
+	}
+	m := &metric{name: name, help: help, kind: k}
+	r.metrics[name] = m
+	return m
+}
+
+// Snapshot returns the current value of every instrument.
+func (r *Registry) Snapshot() map[string]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	values := make(map[string]int64, len(r.metrics))
+	for name, m := range r.metrics {
+		values[name] = m.value.Load()
+	}
+	return values
+}
@@ -0,0 +1,563 @@
+// Package outbox is a queue of records kept in segment files of a directory, so that
+// what a process could not send yet survives its restart. Records are read back in the
+// order they were appended and stay on disk until they are committed.
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A segment is a sequence of records, little endian:
+//
+//	length uint32 | crc32c(data) uint32 | data
+//
+// Segment files are named after the id of their first record, ids grow by one per
+// record. The cursor file holds the id of the first record not committed. A record whose
+// data does not match its checksum is skipped, its id stays unused. A record whose length
+// does not fit ends its segment, the next one cannot be found: it and what follows are
+// dropped by Open, and the ids they may have had are not given again.
+// The id file names the outbox, it changes when ids may start over.
+const (
+	segmentExt   = ".seg"
+	cursorName   = "cursor"
+	idName       = "id"
+	recordHeader = 8
+	cursorSize   = 12
+
+	// maxRecord bounds the length read from a damaged header.
+	maxRecord = 1 << 30
+)
+
+var (
+	ErrClosed   = errors.New("outbox closed")
+	ErrFull     = errors.New("outbox full")
+	ErrTooLarge = errors.New("record larger than the outbox")
+	// ErrCorrupt is wrapped by the errors given to Options.OnCorrupt.
+	ErrCorrupt  = errors.New("corrupt record")
+	errChecksum = fmt.Errorf("%w, checksum mismatch", ErrCorrupt)
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	// DefaultSegmentSize is the size above which appending starts a new segment file.
+	DefaultSegmentSize = 16 << 20
+	// DefaultMaxBytes is the size of the segment files above which appending fails.
+	DefaultMaxBytes = 256 << 20
+)
+
+// Options of Open, zero values use the defaults.
+type Options struct {
+	SegmentSize int64 // DefaultSegmentSize by default
+	MaxBytes    int64 // Append fails with ErrFull above it, DefaultMaxBytes by default
+	// Sync flushes every append and commit to the disk, so that the records survive a
+	// crash of the system too and not only of the process. It is much slower.
+	Sync bool
+	// OnCorrupt is told about the damaged records that are skipped or dropped, by Open
+	// or later by Next, with an error wrapping ErrCorrupt. It must not use the Outbox.
+	OnCorrupt func(err error)
+}
+
+// Stats describe an Outbox.
+type Stats struct {
+	Records  int   // appended and not committed
+	Bytes    int64 // size of the segment files
+	Segments int
+	Dropped  int64 // bytes of damaged records skipped or dropped since Open
+}
+
+type segment struct {
+	base  uint64 // id of the first record
+	count uint64
+	size  int64
+	f     *os.File
+	bad   map[uint64]bool // records skipped for their checksum
+	gap   uint64          // ids the records dropped at its end may have had
+}
+
+func (s *segment) end() uint64 { return s.base + s.count }
+
+// Outbox is a file backed queue with one reader. It is safe for concurrent use.
+type Outbox struct {
+	dir  string
+	opts Options
+	id   string
+
+	mu        sync.Mutex
+	segs      []*segment // by base, the last one is appended to
+	size      int64
+	next      uint64 // id of the next record appended
+	committed uint64 // records below it are consumed
+	read      uint64 // id of the next record Next returns
+	rseg      int    // segment and offset of that record
+	roff      int64
+	dropped   int64
+	cursor    *os.File
+	closed    bool
+
+	appended chan struct{}
+	done     chan struct{}
+}
+
+// Open opens the outbox kept in dir, creating it when needed. Damaged records are
+// skipped, or dropped along with the rest of their segment when their length is damaged
+// too, as a crash may leave the last one. See Stats.Dropped and Options.OnCorrupt.
+func Open(dir string, opts Options) (*Outbox, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultMaxBytes
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	cursor, err := os.OpenFile(filepath.Join(dir, cursorName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	o := &Outbox{
+		dir:      dir,
+		opts:     opts,
+		cursor:   cursor,
+		appended: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	lost, err := o.recover()
+	if err == nil {
+		err = o.loadID(lost)
+	}
+	if err != nil {
+		o.closeFiles()
+		return nil, err
+	}
+	return o, nil
+}
+
+// recover loads the cursor and the segments and positions the reader. It reports
+// whether the cursor was damaged.
+func (o *Outbox) recover() (bool, error) {
+	// a damaged cursor only makes the records since the start of the oldest segment
+	// read again
+	var buf [cursorSize]byte
+	n, _ := o.cursor.ReadAt(buf[:], 0)
+	lost := n > 0
+	if n == cursorSize && crc32.Checksum(buf[:8], castagnoli) == binary.LittleEndian.Uint32(buf[8:]) {
+		o.committed = binary.LittleEndian.Uint64(buf[:8])
+		lost = false
+	}
+
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return lost, err
+	}
+	var bases []uint64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), segmentExt)
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		if base, err := strconv.ParseUint(name, 10, 64); err == nil {
+			bases = append(bases, base)
+		}
+	}
+	slices.Sort(bases)
+
+	o.next = o.committed
+	for _, base := range bases {
+		seg, err := o.openSegment(base)
+		if err != nil {
+			return lost, err
+		}
+		o.next = max(o.next, seg.end()+seg.gap)
+		if seg.count == 0 || seg.end() <= o.committed {
+			if err := o.removeSegment(seg); err != nil {
+				return lost, err
+			}
+			continue
+		}
+		o.segs = append(o.segs, seg)
+		o.size += seg.size
+	}
+
+	o.read = o.next
+	for i, seg := range o.segs {
+		if seg.end() <= o.committed {
+			continue
+		}
+		o.rseg, o.read = i, seg.base
+		for o.read < o.committed {
+			_, n, err := readRecord(seg.f, o.roff, seg.size-o.roff)
+			if err != nil && !errors.Is(err, errChecksum) {
+				return lost, err
+			}
+			o.roff += recordHeader + n
+			o.read++
+		}
+		break
+	}
+	return lost, nil
+}
+
+// loadID reads the name of the outbox, a new one is given to a new directory and
+// when the ids may start over because the cursor was lost.
+func (o *Outbox) loadID(lost bool) error {
+	path := filepath.Join(o.dir, idName)
+	if data, err := os.ReadFile(path); err == nil && !lost && len(data) == 32 {
+		if _, err := hex.DecodeString(string(data)); err == nil {
+			o.id = string(data)
+			return nil
+		}
+	}
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	o.id = hex.EncodeToString(b[:])
+	if err := os.WriteFile(path, []byte(o.id), 0o600); err != nil {
+		return err
+	}
+	if o.opts.Sync {
+		return syncDir(o.dir)
+	}
+	return nil
+}
+
+func (o *Outbox) segmentPath(base uint64) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%020d%s", base, segmentExt))
+}
+
+// openSegment scans the segment of base, notes the records to skip and truncates it
+// at the first record whose length does not fit.
+func (o *Outbox) openSegment(base uint64) (*segment, error) {
+	f, err := os.OpenFile(o.segmentPath(base), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	seg := &segment{base: base, f: f}
+	for seg.size < fi.Size() {
+		_, n, err := readRecord(f, seg.size, fi.Size()-seg.size)
+		if errors.Is(err, errChecksum) {
+			if id := seg.end(); id >= o.committed {
+				if seg.bad == nil {
+					seg.bad = make(map[uint64]bool)
+				}
+				seg.bad[id] = true
+				o.corrupt(recordHeader+n, "record %d of %s: %w, skipped", id, filepath.Base(f.Name()), err)
+			}
+		} else if errors.Is(err, ErrCorrupt) {
+			break
+		} else if err != nil {
+			f.Close()
+			return nil, err
+		}
+		seg.size += recordHeader + n
+		seg.count++
+	}
+	if dropped := fi.Size() - seg.size; dropped > 0 {
+		// each record takes at least its header
+		seg.gap = uint64(dropped / recordHeader)
+		o.corrupt(dropped, "record %d of %s: %w, %d bytes dropped up to the end of the segment",
+			seg.end(), filepath.Base(f.Name()), ErrCorrupt, dropped)
+		if err := f.Truncate(seg.size); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return seg, nil
+}
+
+// corrupt counts n bytes of damaged records and reports them, mu is held or the
+// Outbox is being opened.
+func (o *Outbox) corrupt(n int64, format string, args ...any) {
+	o.dropped += n
+	if o.opts.OnCorrupt != nil {
+		o.opts.OnCorrupt(fmt.Errorf("outbox: "+format, args...))
+	}
+}
+
+// readRecord reads the record at off of f, avail bytes are left in the segment. It
+// returns the length of its data, also with errChecksum: the next record can be read.
+func readRecord(f *os.File, off, avail int64) ([]byte, int64, error) {
+	var h [recordHeader]byte
+	if avail < recordHeader {
+		return nil, 0, ErrCorrupt
+	}
+	if _, err := f.ReadAt(h[:], off); err != nil {
+		return nil, 0, err
+	}
+	n := int64(binary.LittleEndian.Uint32(h[:4]))
+	if n > maxRecord || n > avail-recordHeader {
+		return nil, 0, ErrCorrupt
+	}
+	data := make([]byte, n)
+	if _, err := f.ReadAt(data, off+recordHeader); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, 0, ErrCorrupt
+		}
+		return nil, 0, err
+	}
+	if crc32.Checksum(data, castagnoli) != binary.LittleEndian.Uint32(h[4:]) {
+		return nil, n, errChecksum
+	}
+	return data, n, nil
+}
+
+// Append adds data at the end of the queue and returns its id.
+func (o *Outbox) Append(data []byte) (uint64, error) {
+	n := recordHeader + int64(len(data))
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return 0, ErrClosed
+	}
+	if n > o.opts.MaxBytes || len(data) > maxRecord {
+		return 0, ErrTooLarge
+	}
+	if o.size+n > o.opts.MaxBytes {
+		return 0, ErrFull
+	}
+
+	seg, err := o.active(n)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, n)
+	binary.LittleEndian.PutUint32(buf, uint32(len(data)))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.Checksum(data, castagnoli))
+	copy(buf[recordHeader:], data)
+	if _, err := seg.f.WriteAt(buf, seg.size); err != nil {
+		_ = seg.f.Truncate(seg.size)
+		return 0, err
+	}
+	if o.opts.Sync {
+		if err := seg.f.Sync(); err != nil {
+			return 0, err
+		}
+	}
+
+	id := o.next
+	o.next++
+	seg.count++
+	seg.size += n
+	o.size += n
+	select {
+	case o.appended <- struct{}{}:
+	default:
+	}
+	return id, nil
+}
+
+// active returns the segment a record of n bytes is appended to, it starts a new one
+// once the last is full, or when ids were skipped after it.
+func (o *Outbox) active(n int64) (*segment, error) {
+	if len(o.segs) > 0 {
+		last := o.segs[len(o.segs)-1]
+		if last.end() == o.next && (last.size == 0 || last.size+n <= o.opts.SegmentSize) {
+			return last, nil
+		}
+	}
+	f, err := os.OpenFile(o.segmentPath(o.next), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if o.opts.Sync {
+		if err := syncDir(o.dir); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	seg := &segment{base: o.next, f: f}
+	o.segs = append(o.segs, seg)
+	if len(o.segs) == 1 {
+		o.rseg, o.roff, o.read = 0, 0, seg.base
+	}
+	return seg, nil
+}
+
+// Next returns the record following the one it returned last, waiting until one is
+// appended. Records are returned once per Open, those not committed are returned again
+// after the next Open. It must not be called concurrently.
+func (o *Outbox) Next(ctx context.Context) (uint64, []byte, error) {
+	for {
+		o.mu.Lock()
+		if o.closed {
+			o.mu.Unlock()
+			return 0, nil, ErrClosed
+		}
+		id, data, ok, err := o.readNext()
+		o.mu.Unlock()
+		if ok || err != nil {
+			return id, data, err
+		}
+
+		select {
+		case <-o.appended:
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		case <-o.done:
+			return 0, nil, ErrClosed
+		}
+	}
+}
+
+// readNext must be called with mu held.
+func (o *Outbox) readNext() (uint64, []byte, bool, error) {
+	for o.rseg < len(o.segs) {
+		seg := o.segs[o.rseg]
+		if o.roff < seg.size {
+			data, n, err := readRecord(seg.f, o.roff, seg.size-o.roff)
+			if errors.Is(err, errChecksum) {
+				if !seg.bad[o.read] {
+					// damaged since Open
+					o.corrupt(recordHeader+n, "record %d of %s: %w, skipped", o.read, filepath.Base(seg.f.Name()), err)
+				}
+				o.read++
+				o.roff += recordHeader + n
+				continue
+			}
+			if errors.Is(err, ErrCorrupt) {
+				// the file changed under us, skip what was appended to it so far
+				o.corrupt(seg.size-o.roff, "record %d of %s: %w, %d bytes skipped up to the end of the segment",
+					o.read, filepath.Base(seg.f.Name()), err, seg.size-o.roff)
+				o.roff, o.read = seg.size, seg.end()
+				continue
+			}
+			if err != nil {
+				return 0, nil, false, err
+			}
+			id := o.read
+			o.read++
+			o.roff += recordHeader + n
+			return id, data, true, nil
+		}
+		if o.rseg == len(o.segs)-1 {
+			break
+		}
+		o.rseg++
+		o.roff, o.read = 0, o.segs[o.rseg].base
+	}
+	return 0, nil, false, nil
+}
+
+// Commit marks the records up to id, included, as consumed, they are not returned
+// after the next Open. Segments holding only consumed records are deleted, except the
+// one appended to.
+func (o *Outbox) Commit(id uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return ErrClosed
+	}
+	if id >= o.read {
+		return fmt.Errorf("outbox: commit of record %d not read yet", id)
+	}
+	if id < o.committed {
+		return nil
+	}
+	o.committed = id + 1
+
+	var buf [cursorSize]byte
+	binary.LittleEndian.PutUint64(buf[:], o.committed)
+	binary.LittleEndian.PutUint32(buf[8:], crc32.Checksum(buf[:8], castagnoli))
+	if _, err := o.cursor.WriteAt(buf[:], 0); err != nil {
+		return err
+	}
+	if o.opts.Sync {
+		if err := o.cursor.Sync(); err != nil {
+			return err
+		}
+	}
+
+	k := 0
+	for k < len(o.segs)-1 && o.segs[k].end() <= o.committed {
+		if err := o.removeSegment(o.segs[k]); err != nil {
+			return err
+		}
+		o.size -= o.segs[k].size
+		k++
+	}
+	if k == 0 {
+		return nil
+	}
+	o.segs = slices.Delete(o.segs, 0, k)
+	if o.rseg < k {
+		// the reader was at the end of a deleted segment
+		o.rseg, o.roff, o.read = 0, 0, o.segs[0].base
+	} else {
+		o.rseg -= k
+	}
+	return nil
+}
+
+func (o *Outbox) removeSegment(seg *segment) error {
+	seg.f.Close()
+	return os.Remove(o.segmentPath(seg.base))
+}
+
+// ID returns the name of the outbox, kept in its directory. The ids of its records
+// only grow while the name stays the same.
+func (o *Outbox) ID() string { return o.id }
+
+// Stats returns the current state of the outbox.
+func (o *Outbox) Stats() Stats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := Stats{Bytes: o.size, Segments: len(o.segs), Dropped: o.dropped}
+	for _, seg := range o.segs {
+		if end := seg.end(); end > o.committed {
+			s.Records += int(end - max(seg.base, o.committed))
+		}
+		for id := range seg.bad {
+			if id >= o.committed {
+				s.Records--
+			}
+		}
+	}
+	return s
+}
+
+// Close closes the files, Next returns ErrClosed.
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	close(o.done)
+	return o.closeFiles()
+}
+
+func (o *Outbox) closeFiles() error {
+	err := o.cursor.Close()
+	for _, seg := range o.segs {
+		err = errors.Join(err, seg.f.Close())
+	}
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,367 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// record returns the data appended as record id, 10 bytes with its header.
+func record(id uint64) []byte { return []byte(fmt.Sprintf("r%d", id)) }
+
+// fill appends six records to a new outbox in dir, two per segment, and commits the
+// records up to commit when it is not negative.
+func fill(t *testing.T, dir string, commit int) string {
+	t.Helper()
+	o, err := Open(dir, Options{SegmentSize: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	for i := uint64(0); i < 6; i++ {
+		if id, err := o.Append(record(i)); err != nil || id != i {
+			t.Fatalf("Append = %d, %v, want %d", id, err, i)
+		}
+	}
+	for i := 0; i <= commit; i++ {
+		if _, _, err := o.Next(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if commit >= 0 {
+		if err := o.Commit(uint64(commit)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return o.ID()
+}
+
+// readAll returns the ids of the records Next returns without waiting, checking their data.
+func readAll(t *testing.T, o *Outbox) []uint64 {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var ids []uint64
+	for {
+		id, data, err := o.Next(ctx)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				t.Fatal(err)
+			}
+			return ids
+		}
+		if string(data) != string(record(id)) {
+			t.Errorf("record %d = %q", id, data)
+		}
+		ids = append(ids, id)
+	}
+}
+
+func segmentFile(dir string, base uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", base, segmentExt))
+}
+
+// flip changes the byte at off of the segment of base.
+func flip(base uint64, off int64) func(string) error {
+	return func(dir string) error {
+		f, err := os.OpenFile(segmentFile(dir, base), os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var b [1]byte
+		if _, err := f.ReadAt(b[:], off); err != nil {
+			return err
+		}
+		b[0] ^= 0xff
+		_, err = f.WriteAt(b[:], off)
+		return err
+	}
+}
+
+func TestRecover(t *testing.T) {
+	tests := []struct {
+		name    string
+		commit  int // last record committed before the damage, -1 for none
+		damage  func(dir string) error
+		ids     []uint64 // records read back
+		dropped int64
+		newID   bool
+		next    uint64 // id of the next record appended
+	}{
+		{
+			name:   "clean",
+			commit: -1,
+			damage: func(string) error { return nil },
+			ids:    []uint64{0, 1, 2, 3, 4, 5},
+			next:   6,
+		},
+		{
+			name:   "committed",
+			commit: 2,
+			damage: func(string) error { return nil },
+			ids:    []uint64{3, 4, 5},
+			next:   6,
+		},
+		{
+			name:   "truncated tail",
+			commit: -1,
+			damage: func(dir string) error {
+				return os.Truncate(segmentFile(dir, 4), 17)
+			},
+			ids:     []uint64{0, 1, 2, 3, 4},
+			dropped: 7,
+			next:    5,
+		},
+		{
+			name:   "truncated header",
+			commit: -1,
+			damage: func(dir string) error {
+				return os.Truncate(segmentFile(dir, 4), 14)
+			},
+			ids:     []uint64{0, 1, 2, 3, 4},
+			dropped: 4,
+			next:    5,
+		},
+		{
+			// only the damaged record is skipped
+			name:    "corrupt crc",
+			commit:  -1,
+			damage:  flip(0, 10+recordHeader),
+			ids:     []uint64{0, 2, 3, 4, 5},
+			dropped: 10,
+			next:    6,
+		},
+		{
+			name:    "corrupt crc of a first record",
+			commit:  -1,
+			damage:  flip(2, recordHeader),
+			ids:     []uint64{0, 1, 3, 4, 5},
+			dropped: 10,
+			next:    6,
+		},
+		{
+			name:   "corrupt crc committed",
+			commit: 2,
+			damage: flip(2, recordHeader),
+			ids:    []uint64{3, 4, 5},
+			next:   6,
+		},
+		{
+			// the rest of the segment is dropped, the next segments are kept
+			name:    "corrupt length",
+			commit:  -1,
+			damage:  flip(2, 0),
+			ids:     []uint64{0, 1, 4, 5},
+			dropped: 20,
+			next:    6,
+		},
+		{
+			// the ids of the dropped records are not given again
+			name:    "corrupt length of the last segment",
+			commit:  -1,
+			damage:  flip(4, 0),
+			ids:     []uint64{0, 1, 2, 3},
+			dropped: 20,
+			next:    6,
+		},
+		{
+			name:   "damaged cursor",
+			commit: 2,
+			damage: func(dir string) error {
+				return os.WriteFile(filepath.Join(dir, cursorName), []byte("garbage"), 0o600)
+			},
+			// read again from the oldest segment left
+			ids:   []uint64{2, 3, 4, 5},
+			newID: true,
+			next:  6,
+		},
+		{
+			name:   "missing id",
+			commit: -1,
+			damage: func(dir string) error {
+				return os.Remove(filepath.Join(dir, idName))
+			},
+			ids:   []uint64{0, 1, 2, 3, 4, 5},
+			newID: true,
+			next:  6,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			id := fill(t, dir, tt.commit)
+			if err := tt.damage(dir); err != nil {
+				t.Fatal(err)
+			}
+
+			o, err := Open(dir, Options{SegmentSize: 20})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer o.Close()
+			if (o.ID() != id) != tt.newID {
+				t.Errorf("ID %s after %s, new %v", o.ID(), id, tt.newID)
+			}
+			st := o.Stats()
+			if st.Records != len(tt.ids) || st.Dropped != tt.dropped {
+				t.Errorf("Stats = %+v, want %d records, %d dropped", st, len(tt.ids), tt.dropped)
+			}
+
+			if ids := readAll(t, o); !slices.Equal(ids, tt.ids) {
+				t.Errorf("read %v, want %v", ids, tt.ids)
+			}
+			if next, err := o.Append([]byte("x")); err != nil || next != tt.next {
+				t.Errorf("Append = %d, %v, want %d", next, err, tt.next)
+			}
+		})
+	}
+}
+
+func TestCommitRemovesSegments(t *testing.T) {
+	tests := []struct {
+		commit   uint64
+		segments int
+		records  int
+	}{
+		{0, 3, 5},
+		{1, 2, 4},
+		{4, 1, 1},
+		// Open removes the last segment too once it is consumed
+		{5, 0, 0},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		fill(t, dir, int(tt.commit))
+		o, err := Open(dir, Options{SegmentSize: 20})
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := o.Stats()
+		o.Close()
+		files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+		if st.Segments != tt.segments || len(files) != tt.segments || st.Records != tt.records {
+			t.Errorf("commit %d: %+v, %d files, want %d segments, %d records",
+				tt.commit, st, len(files), tt.segments, tt.records)
+		}
+	}
+}
+
+func TestAppendLimits(t *testing.T) {
+	o, err := Open(t.TempDir(), Options{SegmentSize: 20, MaxBytes: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	tests := []struct {
+		data []byte
+		want error
+	}{
+		{make([]byte, 30), ErrTooLarge},
+		{make([]byte, 12), nil},
+		{make([]byte, 2), nil},
+		{make([]byte, 1), ErrFull},
+	}
+	for i, tt := range tests {
+		if _, err := o.Append(tt.data); !errors.Is(err, tt.want) {
+			t.Errorf("append %d of %d bytes: %v, want %v", i, len(tt.data), err, tt.want)
+		}
+	}
+	o.Close()
+	if _, err := o.Append(nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("append after Close: %v, want ErrClosed", err)
+	}
+}
+
+func TestCorruptMidSegment(t *testing.T) {
+	tests := []struct {
+		name    string
+		off     int64 // of the byte flipped in the segment
+		ids     []uint64
+		records int
+		dropped int64
+		next    uint64
+	}{
+		// the records around it are kept
+		{"data", 20 + recordHeader, []uint64{0, 1, 3, 4, 5}, 5, 10, 6},
+		// what follows cannot be found, the ids it may have had are skipped
+		{"length", 20, []uint64{0, 1}, 2, 40, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			o, err := Open(dir, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := uint64(0); i < 6; i++ {
+				o.Append(record(i))
+			}
+			o.Close()
+			if err := flip(0, tt.off)(dir); err != nil {
+				t.Fatal(err)
+			}
+
+			var reports []error
+			o, err = Open(dir, Options{OnCorrupt: func(err error) { reports = append(reports, err) }})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer o.Close()
+			if len(reports) != 1 || !errors.Is(reports[0], ErrCorrupt) {
+				t.Fatalf("reports %v, want one ErrCorrupt", reports)
+			}
+			if st := o.Stats(); st.Records != tt.records || st.Dropped != tt.dropped {
+				t.Errorf("Stats = %+v, want %d records, %d dropped", st, tt.records, tt.dropped)
+			}
+			if ids := readAll(t, o); !slices.Equal(ids, tt.ids) {
+				t.Errorf("read %v, want %v", ids, tt.ids)
+			}
+			if len(reports) != 1 {
+				t.Errorf("reported again by Next: %v", reports[1:])
+			}
+			if next, err := o.Append(record(tt.next)); err != nil || next != tt.next {
+				t.Errorf("Append = %d, %v, want %d", next, err, tt.next)
+			}
+			if err := o.Commit(tt.ids[len(tt.ids)-1]); err != nil {
+				t.Fatal(err)
+			}
+			o.Close()
+
+			// the record appended after the damage is read back under its id
+			o, err = Open(dir, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := readAll(t, o); !slices.Equal(ids, []uint64{tt.next}) {
+				t.Errorf("after reopening: read %v, want [%d]", ids, tt.next)
+			}
+		})
+	}
+}
+
+func TestCorruptAfterOpen(t *testing.T) {
+	dir := t.TempDir()
+	var reports []error
+	o, err := Open(dir, Options{OnCorrupt: func(err error) { reports = append(reports, err) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	for i := uint64(0); i < 3; i++ {
+		o.Append(record(i))
+	}
+	if err := flip(0, 10+recordHeader)(dir); err != nil {
+		t.Fatal(err)
+	}
+	if ids := readAll(t, o); !slices.Equal(ids, []uint64{0, 2}) {
+		t.Errorf("read %v, want [0 2]", ids)
+	}
+	if len(reports) != 1 || !errors.Is(reports[0], ErrCorrupt) || o.Stats().Dropped != 10 {
+		t.Errorf("reports %v, dropped %d, want one ErrCorrupt for 10 bytes", reports, o.Stats().Dropped)
+	}
+}
@@ -0,0 +1,94 @@
+// Package ratelimit provides the token bucket used to throttle connections.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket refilled at rate tokens per second up to burst tokens.
+// It is safe for concurrent use, a nil *Bucket never limits.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket, nil when rate is not positive. A burst under 1
+// allows one second worth of tokens.
+func NewBucket(rate float64, burst int) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if b < 1 {
+		b = max(rate, 1)
+	}
+	return &Bucket{rate: rate, burst: b, tokens: b}
+}
+
+func (b *Bucket) refill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+}
+
+// Allow takes n tokens when they are available. n is capped at the burst so that
+// a large request can pass once the bucket is full, the same goes for AllowAll.
+func (b *Bucket) Allow(now time.Time, n float64) bool {
+	if b == nil {
+		return true
+	}
+	return AllowAll(now, Request{Bucket: b, N: n})
+}
+
+// Request is N tokens of Bucket, see AllowAll.
+type Request struct {
+	Bucket *Bucket
+	N      float64
+}
+
+// AllowAll takes the tokens of every request when all of them are available, none
+// otherwise, so that a refused request does not drain the buckets that had room. The
+// buckets are locked in turn, callers sharing several must list them in the same order.
+func AllowAll(now time.Time, reqs ...Request) bool {
+	for _, r := range reqs {
+		if r.Bucket != nil {
+			r.Bucket.mu.Lock()
+			defer r.Bucket.mu.Unlock()
+			r.Bucket.refill(now)
+		}
+	}
+	for _, r := range reqs {
+		if r.Bucket != nil && r.Bucket.tokens < min(r.N, r.Bucket.burst) {
+			return false
+		}
+	}
+	for _, r := range reqs {
+		if r.Bucket != nil {
+			r.Bucket.tokens -= min(r.N, r.Bucket.burst)
+		}
+	}
+	return true
+}
+
+// Take always takes n tokens, going into debt if needed, and returns how long to wait
+// until the balance is back to zero.
+func (b *Bucket) Take(now time.Time, n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	type step struct {
+		at    time.Duration // since start
+		n     float64
+		allow bool
+	}
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		steps []step
+	}{
+		{"burst", 1, 2, []step{{0, 1, true}, {0, 1, true}, {0, 1, false}}},
+		{"refill", 1, 2, []step{{0, 2, true}, {500 * time.Millisecond, 1, false}, {time.Second, 1, true}}},
+		{"refill capped at burst", 1, 2, []step{{0, 2, true}, {time.Hour, 2, true}, {time.Hour, 1, false}}},
+		{"default burst", 10, 0, []step{{0, 10, true}, {0, 1, false}}},
+		{"large request capped", 1, 2, []step{{0, 100, true}, {0, 1, false}}},
+		{"time going back", 1, 1, []step{{time.Second, 1, true}, {0, 1, false}}},
+	}
+	for _, tt := range tests {
+		b := NewBucket(tt.rate, tt.burst)
+		for i, st := range tt.steps {
+			if got := b.Allow(start.Add(st.at), st.n); got != st.allow {
+				t.Errorf("%s: step %d Allow(%v) = %v, want %v", tt.name, i, st.n, got, st.allow)
+			}
+		}
+	}
+}
+
+func TestBucketTake(t *testing.T) {
+	now := time.Now()
+	b := NewBucket(10, 5)
+	tests := []struct {
+		n    float64
+		wait time.Duration
+	}{
+		{5, 0},
+		{1, 100 * time.Millisecond},
+		{4, 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := b.Take(now, tt.n); got != tt.wait {
+			t.Errorf("Take(%v) = %v, want %v", tt.n, got, tt.wait)
+		}
+	}
+	if b.Allow(now.Add(400*time.Millisecond), 1) {
+		t.Error("allowed while in debt")
+	}
+}
+
+func TestNilBucket(t *testing.T) {
+	b := NewBucket(0, 10)
+	if b != nil {
+		t.Fatal("bucket without rate")
+	}
+	if !b.Allow(time.Now(), 1e9) || b.Take(time.Now(), 1e9) != 0 {
+		t.Error("nil bucket limits")
+	}
+}
+
+func TestAllowAll(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		tokens []float64 // left in each bucket of burst 10
+		n      []float64
+		allow  bool
+	}{
+		{"all have room", []float64{10, 10}, []float64{1, 5}, true},
+		{"second refuses", []float64{10, 2}, []float64{1, 5}, false},
+		{"first refuses", []float64{0, 10}, []float64{1, 5}, false},
+	}
+	for _, tt := range tests {
+		var reqs []Request
+		for i, left := range tt.tokens {
+			b := NewBucket(1e-9, 10)
+			b.Allow(now, 10-left)
+			reqs = append(reqs, Request{Bucket: b, N: tt.n[i]})
+		}
+		reqs = append(reqs, Request{}) // nil buckets never limit
+		if got := AllowAll(now, reqs...); got != tt.allow {
+			t.Fatalf("%s: AllowAll = %v, want %v", tt.name, got, tt.allow)
+		}
+		for i, r := range reqs[:len(tt.tokens)] {
+			want := tt.tokens[i]
+			if tt.allow {
+				want -= tt.n[i]
+			}
+			// a refused request leaves every bucket as it was
+			if r.Bucket.tokens != want {
+				t.Errorf("%s: bucket %d has %v tokens, want %v", tt.name, i, r.Bucket.tokens, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Package reconnect holds the pieces shared by the reconnecting clients:
+// backoff policies, the clock they run on and the connection state monitor.
+package reconnect
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/rand"
+)
+
+// ErrAttemptsExhausted is returned by a reconnect loop once its policy gives up.
+var ErrAttemptsExhausted = errors.New("reconnect attempts exhausted")
+
+// BackoffPolicy decides how long to wait between connection attempts.
+type BackoffPolicy interface {
+	// Next returns the delay to wait after the given failed attempt (starting at 1).
+	// ok is false when no further attempt should be made.
+	Next(attempt int) (delay time.Duration, ok bool)
+	// Reset is called after a successful connection so the next outage starts over.
+	Reset()
+}
+
+// Rand is the random source used for jitter.
+type Rand interface {
+	Int63n(n int64) int64
+}
+
+type globalRand struct{}
+
+func (globalRand) Int63n(n int64) int64 { return rand.Int63n(n) }
+
+func int63n(r Rand, n int64) int64 {
+	if n <= 0 {
+		return 0
+	}
+	if r == nil {
+		r = globalRand{}
+	}
+	return r.Int63n(n)
+}
+
+// maxDelay is the longest time.Duration, delays growing without Max stop there.
+const maxDelay = time.Duration(math.MaxInt64)
+
+// durationOf converts f to a delay, clamped so that an overflow does not turn into a
+// negative delay.
+func durationOf(f float64) time.Duration {
+	switch {
+	case f >= float64(maxDelay):
+		return maxDelay
+	case f > 0:
+		return time.Duration(f)
+	}
+	return 0
+}
+
+// addDelay returns d + j, at most maxDelay.
+func addDelay(d, j time.Duration) time.Duration {
+	if d > maxDelay-j {
+		return maxDelay
+	}
+	return d + j
+}
+
+// DefaultBackoff returns the policy the clients used before policies were pluggable:
+// 1s doubling up to 20s, with up to 50% jitter and no attempt cap.
+func DefaultBackoff() BackoffPolicy {
+	return &Exponential{Base: time.Second, Max: 20 * time.Second, Jitter: 0.5}
+}
+
+// Exponential multiplies the delay after each failure up to Max,
+// then adds a random jitter of up to Jitter times the delay.
+type Exponential struct {
+	Base       time.Duration
+	Max        time.Duration
+	Multiplier float64 // defaults to 2
+	Jitter     float64 // 0.5 adds up to 50% of the delay
+	Rand       Rand
+}
+
+func (e *Exponential) Next(attempt int) (time.Duration, bool) {
+	mult := e.Multiplier
+	if mult <= 1 {
+		mult = 2
+	}
+	if attempt < 1 {
+		attempt = 1
+	}
+	delay := float64(e.Base) * math.Pow(mult, float64(attempt-1))
+	if e.Max > 0 && delay > float64(e.Max) {
+		delay = float64(e.Max)
+	}
+	d := durationOf(delay)
+	if e.Jitter > 0 {
+		d = addDelay(d, time.Duration(int63n(e.Rand, int64(durationOf(float64(d)*e.Jitter)))))
+	}
+	return d, true
+}
+
+func (e *Exponential) Reset() {}
+
+// DecorrelatedJitter picks each delay at random between Base and three times
+// the previous delay, capped at Max.
+// See https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/ .
+type DecorrelatedJitter struct {
+	Base time.Duration
+	Max  time.Duration
+	Rand Rand
+
+	mu   sync.Mutex
+	prev time.Duration
+}
+
+func (d *DecorrelatedJitter) Next(int) (time.Duration, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.prev < d.Base {
+		d.prev = d.Base
+	}
+	// three times the previous delay, without overflowing when there is no Max
+	upper := maxDelay
+	if d.prev < maxDelay/3 {
+		upper = d.prev * 3
+	}
+	delay := d.Base + time.Duration(int63n(d.Rand, int64(upper-d.Base)))
+	if d.Max > 0 && delay > d.Max {
+		delay = d.Max
+	}
+	d.prev = delay
+	return delay, true
+}
+
+func (d *DecorrelatedJitter) Reset() {
+	d.mu.Lock()
+	d.prev = 0
+	d.mu.Unlock()
+}
+
+// Constant waits the same delay between every attempt.
+type Constant struct {
+	Delay time.Duration
+}
+
+func (c Constant) Next(int) (time.Duration, bool) { return c.Delay, true }
+func (c Constant) Reset()                         {}
+
+// MaxAttempts wraps policy so that it gives up after attempts failed attempts.
+func MaxAttempts(policy BackoffPolicy, attempts int) BackoffPolicy {
+	return &capped{policy: policy, max: attempts}
+}
+
+type capped struct {
+	policy BackoffPolicy
+	max    int
+}
+
+func (c *capped) Next(attempt int) (time.Duration, bool) {
+	if attempt >= c.max {
+		return 0, false
+	}
+	return c.policy.Next(attempt)
+}
+
+func (c *capped) Reset() { c.policy.Reset() }
@@ -0,0 +1,194 @@
+package reconnect
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fixedRand draws the fraction r of the range of Int63n, 1 gives n-1.
+type fixedRand float64
+
+func (r fixedRand) Int63n(n int64) int64 { return int64(float64(n-1) * float64(r)) }
+
+func TestExponential(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *Exponential
+		want   []time.Duration // delays after attempts 1, 2, ...
+	}{
+		{
+			name:   "doubling",
+			policy: &Exponential{Base: time.Second},
+			want:   []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second},
+		},
+		{
+			name:   "capped",
+			policy: &Exponential{Base: time.Second, Max: 5 * time.Second},
+			want:   []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+		{
+			name:   "multiplier",
+			policy: &Exponential{Base: 100 * time.Millisecond, Multiplier: 3},
+			want:   []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond},
+		},
+		{
+			name:   "no jitter drawn",
+			policy: &Exponential{Base: time.Second, Jitter: 0.5, Rand: fixedRand(0)},
+			want:   []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:   "full jitter",
+			policy: &Exponential{Base: time.Second, Jitter: 0.5, Rand: fixedRand(1)},
+			want:   []time.Duration{1500*time.Millisecond - 1, 3*time.Second - 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, want := range tt.want {
+				got, ok := tt.policy.Next(i + 1)
+				if !ok || got != want {
+					t.Errorf("Next(%d) = %v, %v, want %v, true", i+1, got, ok, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffOverflow(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy BackoffPolicy
+	}{
+		{"exponential", &Exponential{Base: time.Second}},
+		{"exponential jitter", &Exponential{Base: time.Second, Jitter: 0.5, Rand: fixedRand(1)}},
+		{"decorrelated", &DecorrelatedJitter{Base: time.Second, Rand: fixedRand(1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// without Max the delays grow until they stop near the longest duration
+			var prev time.Duration
+			for attempt := 1; attempt <= 200; attempt++ {
+				got, ok := tt.policy.Next(attempt)
+				if !ok || got < prev {
+					t.Fatalf("Next(%d) = %v, %v after %v", attempt, got, ok, prev)
+				}
+				prev = got
+			}
+			if prev < maxDelay/2 {
+				t.Errorf("last delay %v, want about %v", prev, maxDelay)
+			}
+		})
+	}
+}
+
+func TestDecorrelatedJitter(t *testing.T) {
+	tests := []struct {
+		name string
+		rand fixedRand
+		want []time.Duration
+	}{
+		{"lowest", 0, []time.Duration{time.Second, time.Second, time.Second}},
+		{"highest", 1, []time.Duration{3*time.Second - 1, 9*time.Second - 4, 10 * time.Second, 10 * time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &DecorrelatedJitter{Base: time.Second, Max: 10 * time.Second, Rand: tt.rand}
+			for round := 0; round < 2; round++ {
+				for i, want := range tt.want {
+					if got, ok := d.Next(i + 1); !ok || got != want {
+						t.Errorf("round %d: Next(%d) = %v, %v, want %v, true", round, i+1, got, ok, want)
+					}
+				}
+				// the next outage starts over
+				d.Reset()
+			}
+		})
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	tests := []struct {
+		attempts int
+		next     int
+		ok       bool
+	}{
+		{3, 1, true},
+		{3, 2, true},
+		{3, 3, false},
+		{3, 4, false},
+		{1, 1, false},
+	}
+	for _, tt := range tests {
+		p := MaxAttempts(Constant{Delay: time.Second}, tt.attempts)
+		got, ok := p.Next(tt.next)
+		if ok != tt.ok || (ok && got != time.Second) {
+			t.Errorf("MaxAttempts(%d).Next(%d) = %v, %v, want ok %v", tt.attempts, tt.next, got, ok, tt.ok)
+		}
+	}
+}
+
+func TestSleepManualClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		advance []time.Duration // the sleep returns after the last one
+		cancel  bool
+		want    error
+	}{
+		{"zero delay", 0, nil, false, nil},
+		{"one step", time.Second, []time.Duration{time.Second}, false, nil},
+		{"several steps", 3 * time.Second, []time.Duration{time.Second, time.Second, time.Second}, false, nil},
+		{"canceled", time.Minute, nil, true, context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewManualClock(start)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- Sleep(ctx, clock, tt.delay) }()
+
+			if tt.delay > 0 {
+				waitFor(t, func() bool { return clock.Waiters() == 1 })
+			}
+			for i, d := range tt.advance {
+				clock.Advance(d)
+				if i < len(tt.advance)-1 {
+					select {
+					case err := <-done:
+						t.Fatalf("Sleep returned %v after %v", err, clock.Now().Sub(start))
+					case <-time.After(10 * time.Millisecond):
+					}
+				}
+			}
+			if tt.cancel {
+				cancel()
+			}
+			select {
+			case err := <-done:
+				if !errors.Is(err, tt.want) {
+					t.Fatalf("Sleep = %v, want %v", err, tt.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Sleep did not return")
+			}
+			if n := clock.Waiters(); n != 0 {
+				t.Errorf("%d timers left", n)
+			}
+		})
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,211 @@
+package reconnect
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrStopped is returned by WaitReady once the monitor has been stopped.
+var ErrStopped = errors.New("client stopped")
+
+// State is the connection state of a reconnecting client.
+type State int32
+
+const (
+	StateClosed State = iota
+	StateConnecting
+	StateOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "Closed"
+	case StateConnecting:
+		return "Connecting"
+	case StateOpen:
+		return "Open"
+	}
+	return "Unknown"
+}
+
+// Transition describes a state change.
+type Transition struct {
+	From    State
+	To      State
+	Err     error // error that caused the change, nil for a clean change
+	Attempt int   // connection attempt the change belongs to, 0 when not dialing
+	At      time.Time
+}
+
+// Monitor tracks the state of a client and notifies subscribers of every transition.
+// Subscribers are called synchronously and in order, they must not block
+// or call back into the client that owns the monitor.
+type Monitor struct {
+	clock Clock
+
+	notifyMu sync.Mutex // serializes transitions so subscribers observe them in order
+	mu       sync.Mutex
+	state    State
+	subs     map[int]func(Transition)
+	nextID   int
+	ready    chan struct{} // closed while the state is StateOpen
+	stopped  chan struct{}
+	stopErr  error
+}
+
+// NewMonitor returns a monitor in StateClosed.
+func NewMonitor(clock Clock) *Monitor {
+	if clock == nil {
+		clock = SystemClock
+	}
+	return &Monitor{
+		clock:   clock,
+		subs:    make(map[int]func(Transition)),
+		ready:   make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// State returns the current state.
+func (m *Monitor) State() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Set moves the monitor to state to and reports whether the state changed.
+func (m *Monitor) Set(to State, attempt int, err error) bool {
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+	m.mu.Lock()
+	from := m.state
+	m.mu.Unlock()
+	return m.transit(from, to, attempt, err)
+}
+
+// CompareAndSet moves the monitor to state to only if it is currently in from.
+func (m *Monitor) CompareAndSet(from, to State, attempt int, err error) bool {
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+	return m.transit(from, to, attempt, err)
+}
+
+func (m *Monitor) transit(from, to State, attempt int, err error) bool {
+	m.mu.Lock()
+	if m.state != from || from == to || m.stopErr != nil {
+		m.mu.Unlock()
+		return false
+	}
+	m.state = to
+	if to == StateOpen {
+		close(m.ready)
+	} else if from == StateOpen {
+		m.ready = make(chan struct{})
+	}
+	subs := make([]func(Transition), 0, len(m.subs))
+	for _, fn := range m.subs {
+		subs = append(subs, fn)
+	}
+	m.mu.Unlock()
+
+	t := Transition{From: from, To: to, Err: err, Attempt: attempt, At: m.clock.Now()}
+	for _, fn := range subs {
+		fn(t)
+	}
+	return true
+}
+
+// Stop moves the monitor to StateClosed for good and releases every WaitReady
+// caller with err, or ErrStopped when err is nil. Later transitions are ignored.
+func (m *Monitor) Stop(err error) {
+	if err == nil {
+		err = ErrStopped
+	}
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+	m.mu.Lock()
+	from := m.state
+	m.mu.Unlock()
+	m.transit(from, StateClosed, 0, nil)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopErr == nil {
+		m.stopErr = err
+		close(m.stopped)
+	}
+}
+
+// WaitReady blocks until the state is StateOpen, ctx ends or the monitor is stopped.
+func (m *Monitor) WaitReady(ctx context.Context) error {
+	for {
+		m.mu.Lock()
+		if m.stopErr != nil {
+			err := m.stopErr
+			m.mu.Unlock()
+			return err
+		}
+		if m.state == StateOpen {
+			m.mu.Unlock()
+			return nil
+		}
+		ready := m.ready
+		m.mu.Unlock()
+
+		select {
+		case <-ready:
+		case <-m.stopped:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Subscribe registers fn for every future transition. The returned function unsubscribes.
+func (m *Monitor) Subscribe(fn func(Transition)) (cancel func()) {
+	m.mu.Lock()
+	id := m.nextID
+	m.nextID++
+	m.subs[id] = fn
+	m.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mu.Lock()
+			delete(m.subs, id)
+			m.mu.Unlock()
+		})
+	}
+}
+
+// Watch delivers transitions on a channel buffered to size.
+// Transitions are dropped while the buffer is full. cancel closes the channel.
+func (m *Monitor) Watch(size int) (<-chan Transition, func()) {
+	var mu sync.Mutex
+	closed := false
+	ch := make(chan Transition, size)
+	unsubscribe := m.Subscribe(func(t Transition) {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case ch <- t:
+		default:
+		}
+	})
+	return ch, func() {
+		unsubscribe()
+		mu.Lock()
+		defer mu.Unlock()
+		if !closed {
+			closed = true
+			close(ch)
+		}
+	}
+}